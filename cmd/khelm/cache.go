@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"text/tabwriter"
+
+	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/spf13/cobra"
+)
+
+const timeFormat = "2006-01-02 15:04:05"
+
+func cacheCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspects and cleans up the chart cache",
+		Long: `Inspects and cleans up the charts and repository index files that are cached within the helm home directory ($HELM_HOME).
+The commands can be run safely while other khelm processes use the same cache.`,
+	}
+	cmd.AddCommand(cacheListCommand(h, writer), cachePruneCommand(h, writer), cacheVerifyCommand(h, writer))
+	return cmd
+}
+
+func cacheListCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Lists the cached charts and repository index files",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			charts, err := h.CachedCharts()
+			if err != nil {
+				return err
+			}
+			indexFiles, err := h.CachedIndexFiles()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "CHART\tVERSION\tDIGEST\tREPOSITORY\tSIZE\tLAST USED")
+			for _, c := range charts {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Name, c.Version, c.Digest, path.Join(c.Host, c.Path), humanSize(c.Size), c.LastUsed.Format(timeFormat))
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			fmt.Fprintln(writer)
+			w = tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "INDEX FILE\tSIZE\tDOWNLOADED")
+			for _, f := range indexFiles {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", f.File, humanSize(f.Size), f.Downloaded.Format(timeFormat))
+			}
+			return w.Flush()
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+}
+
+func cachePruneCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
+	opts := helm.CachePruneOptions{}
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Removes charts and repository index files from the cache",
+		Long: `Removes charts that have not been used within the given duration and repository index files that have been downloaded before that.
+When --keep-latest is specified the latest versions of each chart are kept.
+When both options are specified only charts that are older and not among the latest versions are removed.
+The lock files of the removed entries are removed with them (without being listed).`,
+		Example: "  khelm cache prune --older-than=720h\n  khelm cache prune --keep-latest=2\n  khelm cache prune --older-than=168h --keep-latest=1",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.OlderThan <= 0 && opts.KeepLatest <= 0 {
+				_ = cmd.Help()
+				return fmt.Errorf("requires --older-than or --keep-latest option")
+			}
+			removed, err := h.PruneCache(signalContext(), opts)
+			for _, file := range removed {
+				fmt.Fprintln(writer, file)
+			}
+			return err
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	f := cmd.Flags()
+	f.DurationVar(&opts.OlderThan, "older-than", 0, "Remove charts that have not been used and index files that have been downloaded before the given duration (e.g. 720h)")
+	f.IntVar(&opts.KeepLatest, "keep-latest", 0, "Amount of latest versions to keep per chart")
+	f.BoolVar(&opts.DryRun, "dry-run", false, "List the files that would be removed without removing them")
+	return cmd
+}
+
+func cacheVerifyCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "Verifies the digests of the cached charts",
+		Long:  "Verifies the digests of the cached charts and lists the corrupted ones. Corrupted charts can be removed from the cache in order to download them again.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			corrupted, err := h.VerifyCache()
+			if err != nil {
+				return err
+			}
+			for _, c := range corrupted {
+				fmt.Fprintln(writer, c.File)
+			}
+			if len(corrupted) > 0 {
+				return fmt.Errorf("found %d corrupted charts within the cache", len(corrupted))
+			}
+			return nil
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB"}
+	s := float64(size)
+	i := 0
+	for ; s >= 1000 && i < len(units)-1; i++ {
+		s /= 1000
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", s, units[i])
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khelm-cache-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("HELM_HOME", filepath.Join(dir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	cachedChart := func(version string, content []byte) string {
+		digest := fmt.Sprintf("%x", sha256.Sum256(content))[:16]
+		file := filepath.Join(dir, "helm", "cache", "archive", "khelm", "charts.example.org", fmt.Sprintf("mychart-%s-%s", version, digest), fmt.Sprintf("mychart-%s.tgz", version))
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(file, content, 0644)
+		require.NoError(t, err)
+		return file
+	}
+	oldChart := cachedChart("0.1.0", []byte("fake chart 0.1.0"))
+	newChart := cachedChart("0.2.0", []byte("fake chart 0.2.0"))
+
+	for _, c := range []struct {
+		name    string
+		args    []string
+		expect  []string
+		exists  []string
+		removed []string
+	}{
+		{"list", []string{"list"}, []string{"mychart", "0.1.0", "0.2.0", "charts.example.org"}, []string{oldChart, newChart}, nil},
+		{"verify", []string{"verify"}, nil, nil, nil},
+		{"prune dry-run", []string{"prune", "--keep-latest=1", "--dry-run"}, []string{oldChart}, []string{oldChart, newChart}, nil},
+		{"prune", []string{"prune", "--keep-latest=1"}, []string{oldChart}, []string{newChart}, []string{oldChart}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			os.Args = append([]string{"testee", "cache"}, c.args...)
+			err := Execute(nil, &out)
+			require.NoError(t, err)
+			for _, s := range c.expect {
+				require.Contains(t, out.String(), s, "output")
+			}
+			for _, f := range c.exists {
+				require.FileExists(t, f)
+			}
+			for _, f := range c.removed {
+				require.NoFileExists(t, f)
+			}
+		})
+	}
+
+	err = ioutil.WriteFile(newChart, []byte("corrupted"), 0644)
+	require.NoError(t, err)
+	for _, c := range []struct {
+		name string
+		args []string
+	}{
+		{"verify corrupted", []string{"verify"}},
+		{"prune without options", []string{"prune"}},
+		{"prune invalid duration", []string{"prune", "--older-than=invalid"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			os.Args = append([]string{"testee", "cache"}, c.args...)
+			err := Execute(nil, &bytes.Buffer{})
+			require.Error(t, err)
+		})
+	}
+}
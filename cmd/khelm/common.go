@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/mgoltzsche/khelm/pkg/config"
 	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/spf13/pflag"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
@@ -24,7 +26,13 @@ func marshal(resources []*yaml.RNode, writer io.Writer) error {
 }
 
 func render(h *helm.Helm, req *config.ChartConfig) ([]*yaml.RNode, error) {
-	ctx := context.Background()
+	rendered, err := h.Render(signalContext(), req)
+	logErrorHint(err)
+	return rendered, err
+}
+
+// signalContext returns a context that is cancelled when the process receives SIGINT or SIGTERM
+func signalContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -33,10 +41,65 @@ func render(h *helm.Helm, req *config.ChartConfig) ([]*yaml.RNode, error) {
 		log.Printf("Received %s signal", s)
 		cancel()
 	}()
+	return ctx
+}
 
-	rendered, err := h.Render(ctx, req)
+func logErrorHint(err error) {
 	if helm.IsUntrustedRepository(err) {
 		log.Printf("HINT: access to untrusted repositories can be enabled using env var %s=true or option --%s", envTrustAnyRepo, flagTrustAnyRepo)
+	} else if helm.IsNotCached(err) {
+		log.Println("HINT: the cache can be populated by running khelm without offline mode or using `khelm prefetch`")
 	}
-	return rendered, err
+}
+
+// addRepositoryAccessFlags adds the flags that configure how repositories are accessed
+func addRepositoryAccessFlags(f *pflag.FlagSet, h *helm.Helm) {
+	f.Var((*mirrorsFlag)(&h.Mirrors), flagMirror, fmt.Sprintf("Access a repository through a mirror specified as <repository URL>=<mirror URL> (can specify multiple; %s)", envMirrors))
+	f.StringVar(&h.CredentialHelper, flagCredentialHelper, h.CredentialHelper, fmt.Sprintf("Docker-compatible credential helper executable that provides the credentials of repositories that have none configured (%s)", envCredentialHelper))
+	f.Var(&trustPolicyFlag{policy: &h.TrustPolicy}, flagTrustPolicy, fmt.Sprintf("Trust policy file that allows or denies repositories by scheme, host and URL prefix (%s)", envTrustPolicy))
+	f.IntVar(&h.Retry.MaxRetries, "retries", h.Retry.MaxRetries, fmt.Sprintf("Amount of retries of failed repository index and chart downloads (%s)", envRetries))
+	f.DurationVar(&h.Retry.InitialBackoff, "retry-backoff", h.Retry.InitialBackoff, "Initial delay between download retries that doubles with every retry")
+	f.DurationVar(&h.Retry.MaxBackoff, "retry-max-backoff", h.Retry.MaxBackoff, "Max delay between download retries")
+}
+
+// mirrorsFlag adds the mirrors specified as <repository URL>=<mirror URL>
+type mirrorsFlag helm.Mirrors
+
+func (f *mirrorsFlag) Set(s string) error {
+	if *f == nil {
+		*f = mirrorsFlag{}
+	}
+	return helm.Mirrors(*f).Add(s)
+}
+
+func (f *mirrorsFlag) Type() string {
+	return "strings"
+}
+
+func (f *mirrorsFlag) String() string {
+	return ""
+}
+
+// trustPolicyFlag loads the trust policy from the specified file
+type trustPolicyFlag struct {
+	policy **helm.TrustPolicy
+	file   string
+}
+
+func (f *trustPolicyFlag) Set(file string) error {
+	p, err := helm.LoadTrustPolicy(file)
+	if err != nil {
+		return err
+	}
+	*f.policy = p
+	f.file = file
+	return nil
+}
+
+func (f *trustPolicyFlag) Type() string {
+	return "string"
+}
+
+func (f *trustPolicyFlag) String() string {
+	return f.file
 }
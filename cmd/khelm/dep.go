@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/spf13/cobra"
+)
+
+func depCommand(h *helm.Helm) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "dep",
+		Aliases: []string{"dependency", "dependencies"},
+		Short:   "Manages the dependencies of a local chart",
+	}
+	cmd.AddCommand(depSubCommand(h, "update", h.UpdateDependencies,
+		"Resolves the latest dependency versions and writes them into the chart's lock file and charts directory",
+		`Resolves the latest versions of the dependencies declared within the chart's requirements.yaml (or Chart.yaml) that match their constraints.
+The dependencies are downloaded into the chart's charts directory and the resolved versions are written into its requirements.lock (or Chart.lock).
+The dependencies of local dependencies (file://) are updated recursively.`))
+	cmd.AddCommand(depSubCommand(h, "build", h.BuildDependencies,
+		"Downloads the dependencies listed within the chart's lock file into its charts directory",
+		`Downloads the dependencies listed within the chart's requirements.lock (or Chart.lock) into its charts directory.
+When the chart has no lock file its dependencies are resolved and the lock file is written as "dep update" does.
+The dependencies of local dependencies (file://) are built recursively.`))
+	return cmd
+}
+
+func depSubCommand(h *helm.Helm, use string, run func(context.Context, *config.ChartConfig) error, short, long string) *cobra.Command {
+	trustAnyRepo := false
+	req := config.NewChartConfig()
+	cmd := &cobra.Command{
+		Use: use,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				_ = cmd.Help()
+				return fmt.Errorf("accepts single CHART argument but received %d arguments", len(args))
+			}
+			return nil
+		},
+		Short:   short,
+		Long:    long,
+		Example: fmt.Sprintf("  khelm dep %s ./chart", use),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed(flagTrustAnyRepo) {
+				h.TrustAnyRepository = &trustAnyRepo
+			}
+			req.Chart = args[0]
+			err := run(signalContext(), req)
+			logErrorHint(err)
+			return err
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		_ = cmd.Help()
+		return err
+	})
+	f := cmd.Flags()
+	f.BoolVar(&req.Verify, "verify", false, "Verify the dependencies before using them")
+	f.StringVar(&req.Keyring, "keyring", req.Keyring, "Keyring used to verify the dependencies")
+	f.BoolVar(&trustAnyRepo, flagTrustAnyRepo, trustAnyRepo,
+		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
+	addRepositoryAccessFlags(f, h)
+	return cmd
+}
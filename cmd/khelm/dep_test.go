@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDepCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khelm-dep-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("HELM_HOME", filepath.Join(dir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartDir := filepath.Join(dir, "mychart")
+	err = os.MkdirAll(chartDir, 0755)
+	require.NoError(t, err)
+	exampleDir, err := filepath.Abs(filepath.Join("..", "..", "example"))
+	require.NoError(t, err)
+	rel, err := filepath.Rel(chartDir, filepath.Join(exampleDir, "namespace"))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v2\nname: mychart\nversion: 0.1.0\ndependencies:\n- name: namespace\n  version: 0.1.0\n  repository: file://"+filepath.ToSlash(rel)+"\n"), 0644)
+	require.NoError(t, err)
+
+	for _, cmd := range []string{"update", "build"} {
+		err = os.RemoveAll(filepath.Join(chartDir, "charts"))
+		require.NoError(t, err)
+		os.Args = []string{"testee", "dep", cmd, chartDir}
+		err = Execute(nil, &bytes.Buffer{})
+		require.NoError(t, err, "dep %s", cmd)
+		require.FileExists(t, filepath.Join(chartDir, "Chart.lock"), "dep %s", cmd)
+		require.FileExists(t, filepath.Join(chartDir, "charts", "namespace-0.1.0.tgz"), "dep %s", cmd)
+	}
+
+	for _, c := range []struct {
+		name string
+		args []string
+	}{
+		{"no args", nil},
+		{"nonexisting chart", []string{filepath.Join(dir, "nonexisting")}},
+		{"chart file", []string{filepath.Join(chartDir, "Chart.yaml")}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			os.Args = append([]string{"testee", "dep", "update"}, c.args...)
+			err := Execute(nil, &bytes.Buffer{})
+			require.Error(t, err)
+		})
+	}
+}
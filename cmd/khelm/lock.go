@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/spf13/cobra"
+)
+
+func lockCommand(h *helm.Helm) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Manages the lock files of generator configs",
+	}
+	cmd.AddCommand(lockUpdateCommand(h))
+	return cmd
+}
+
+func lockUpdateCommand(h *helm.Helm) *cobra.Command {
+	trustAnyRepo := false
+	cmd := &cobra.Command{
+		Use: "update",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				_ = cmd.Help()
+				return fmt.Errorf("requires at least one CONFIG file argument")
+			}
+			return nil
+		},
+		Short: "Resolves the latest chart versions and records them within the generator configs' lock files",
+		Long: `Resolves the latest versions of the charts and their remote dependencies that match the version constraints of the provided generator configs.
+The resolved versions, URLs and digests are recorded within the lock file each config specifies (lockFile) and the charts are downloaded into the cache.
+A config file can contain ChartRenderer objects (kustomize plugin) and kpt function ConfigMaps.`,
+		Example: "  khelm lock update ./generator.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed(flagTrustAnyRepo) {
+				h.TrustAnyRepository = &trustAnyRepo
+			}
+			return forEachChartConfig(args, h.UpdateLock)
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		_ = cmd.Help()
+		return err
+	})
+	f := cmd.Flags()
+	f.BoolVar(&trustAnyRepo, flagTrustAnyRepo, trustAnyRepo,
+		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
+	f.StringVar(&h.RegistryConfig, "registry-config", h.RegistryConfig, "Docker config file that provides the OCI registry credentials")
+	addRepositoryAccessFlags(f, h)
+	return cmd
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockUpdateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khelm-lock-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("HELM_HOME", filepath.Join(dir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	exampleDir, err := filepath.Abs(filepath.Join("..", "..", "example"))
+	require.NoError(t, err)
+	generator := "apiVersion: khelm.mgoltzsche.github.com/v1\nkind: ChartRenderer\nmetadata:\n  name: mychart\nchart: " + filepath.Join(exampleDir, "namespace") + "\n"
+	lockedFile := filepath.Join(dir, "locked.yaml")
+	err = ioutil.WriteFile(lockedFile, []byte(generator+"lockFile: khelm.lock\n"), 0644)
+	require.NoError(t, err)
+	unlockedFile := filepath.Join(dir, "unlocked.yaml")
+	err = ioutil.WriteFile(unlockedFile, []byte(generator), 0644)
+	require.NoError(t, err)
+
+	os.Args = []string{"testee", "lock", "update", lockedFile}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name string
+		args []string
+	}{
+		{"no args", nil},
+		{"no lock file configured", []string{unlockedFile}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			os.Args = append([]string{"testee", "lock", "update"}, c.args...)
+			err := Execute(nil, &bytes.Buffer{})
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const prefetchUsageExample = "  khelm prefetch ./generator.yaml\n  khelm prefetch ./kpt/functions.yaml ./kustomize/*-generator.yaml"
+
+func prefetchCommand(h *helm.Helm) *cobra.Command {
+	trustAnyRepo := false
+	cmd := &cobra.Command{
+		Use: "prefetch",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				_ = cmd.Help()
+				return fmt.Errorf("requires at least one CONFIG file argument")
+			}
+			return nil
+		},
+		SuggestFor: []string{"pull", "fetch", "download"},
+		Short:      "Downloads the charts referred to by generator configs into the cache",
+		Long: `Downloads the charts referred to by the provided generator configs into the cache.
+This includes the repository index files, chart archives and their transitive dependencies.
+A config file can contain ChartRenderer objects (kustomize plugin) and kpt function ConfigMaps.
+Like the kpt function resolves them relative to its working directory
+the relative paths within a ConfigMap are resolved relative to the current working directory.
+The cache can be used to render the charts in offline mode afterwards.`,
+		Example: prefetchUsageExample,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed(flagTrustAnyRepo) {
+				h.TrustAnyRepository = &trustAnyRepo
+			}
+			return forEachChartConfig(args, h.Prefetch)
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		_ = cmd.Help()
+		return err
+	})
+	f := cmd.Flags()
+	f.BoolVar(&trustAnyRepo, flagTrustAnyRepo, trustAnyRepo,
+		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
+	f.StringVar(&h.RegistryConfig, "registry-config", h.RegistryConfig, "Docker config file that provides the OCI registry credentials")
+	addRepositoryAccessFlags(f, h)
+	return cmd
+}
+
+// forEachChartConfig calls the given function for every chart config within the given files
+func forEachChartConfig(files []string, fn func(context.Context, *config.ChartConfig) error) error {
+	ctx := signalContext()
+	for _, file := range files {
+		configs, err := readChartConfigs(file)
+		if err != nil {
+			return err
+		}
+		if len(configs) == 0 {
+			log.Printf("WARNING: %s does not contain any chart config", file)
+		}
+		for _, cfg := range configs {
+			if err = fn(ctx, cfg); err != nil {
+				logErrorHint(err)
+				return errors.Wrap(err, file)
+			}
+		}
+	}
+	return nil
+}
+
+// readChartConfigs reads the ChartRenderer objects and kpt function ConfigMaps from the given file.
+// Relative paths are resolved like the kustomize plugin and the kpt function resolve them:
+// relative to the file for a ChartRenderer and relative to the working directory for a ConfigMap.
+// ConfigMaps that do not specify a chart (other kpt functions' configs) and objects of other kinds are ignored.
+func readChartConfigs(file string) ([]*config.ChartConfig, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	baseDir := filepath.Dir(file)
+	configs := []*config.ChartConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	for i := 0; ; i++ {
+		var doc yaml.Node
+		if err = dec.Decode(&doc); err != nil {
+			if err == io.EOF {
+				return configs, nil
+			}
+			return nil, errors.Wrapf(err, "read %s", file)
+		}
+		var obj struct {
+			Kind string `yaml:"kind"`
+		}
+		if err = doc.Decode(&obj); err != nil {
+			return nil, errors.Wrapf(err, "read %s: object %d", file, i)
+		}
+		var cfg *config.ChartConfig
+		switch obj.Kind {
+		case config.GeneratorKind:
+			y, err := yaml.Marshal(&doc)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			genCfg, err := config.ReadGeneratorConfig(bytes.NewReader(y))
+			if err != nil {
+				return nil, errors.Wrapf(err, "read %s: object %d", file, i)
+			}
+			cfg = &genCfg.ChartConfig
+			cfg.BaseDir = baseDir
+		case "ConfigMap":
+			fnCfg := kptFnConfigMap{Data: kptFnConfig{ChartConfig: config.NewChartConfig()}}
+			if err = doc.Decode(&fnCfg); err != nil {
+				return nil, errors.Wrapf(err, "read %s: object %d", file, i)
+			}
+			if fnCfg.Data.Chart == "" {
+				continue
+			}
+			cfg = fnCfg.Data.ChartConfig
+		default:
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+}
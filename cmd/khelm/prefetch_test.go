@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khelm-prefetch-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("HELM_HOME", filepath.Join(dir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	exampleDir, err := filepath.Abs(filepath.Join("..", "..", "example"))
+	require.NoError(t, err)
+	generatorFile := filepath.Join(exampleDir, "include", "generator.yaml")
+	fnFile := filepath.Join(dir, "functions.yaml")
+	fnConfig := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chart-generator
+  annotations:
+    config.kubernetes.io/function: |
+      container:
+        image: mgoltzsche/khelm:latest
+data:
+  chart: ` + filepath.Join(exampleDir, "release-name") + `
+  name: myrelease
+  outputPath: generated-manifest.yaml
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-function
+  annotations:
+    config.kubernetes.io/function: |
+      container:
+        image: mgoltzsche/kustomizr:0.1
+data:
+  path: ./kustomization
+`
+	err = ioutil.WriteFile(fnFile, []byte(fnConfig), 0644)
+	require.NoError(t, err)
+	os.Args = []string{"testee", "prefetch", generatorFile, fnFile}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	// Resolve a kpt function's relative chart path against the working directory
+	relFnFile := filepath.Join(dir, "relative-functions.yaml")
+	err = ioutil.WriteFile(relFnFile, []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: chart-generator\ndata:\n  chart: ./release-name\n  name: myrelease\n"), 0644)
+	require.NoError(t, err)
+	wdOrig, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wdOrig)
+	err = os.Chdir(exampleDir)
+	require.NoError(t, err)
+	os.Args = []string{"testee", "prefetch", relFnFile}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err, "prefetch kpt function with chart path relative to the working directory")
+}
+
+func TestPrefetchCommandError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khelm-prefetch-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("HELM_HOME", filepath.Join(dir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	missingChartFile := filepath.Join(dir, "missing-chart.yaml")
+	err = ioutil.WriteFile(missingChartFile, []byte("apiVersion: khelm.mgoltzsche.github.com/v1\nkind: ChartRenderer\nmetadata:\n  name: missing\nchart: ./nonexisting\n"), 0644)
+	require.NoError(t, err)
+	for _, c := range []struct {
+		name string
+		args []string
+	}{
+		{"no args", nil},
+		{"nonexisting file", []string{filepath.Join(dir, "nonexisting.yaml")}},
+		{"nonexisting chart", []string{missingChartFile}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			os.Args = append([]string{"testee", "prefetch"}, c.args...)
+			err := Execute(nil, &bytes.Buffer{})
+			require.Error(t, err)
+		})
+	}
+}
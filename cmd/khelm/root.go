@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -18,9 +19,16 @@ const (
 	envKustomizePluginConfig     = "KUSTOMIZE_PLUGIN_CONFIG_STRING"
 	envKustomizePluginConfigRoot = "KUSTOMIZE_PLUGIN_CONFIG_ROOT"
 	envTrustAnyRepo              = "KHELM_TRUST_ANY_REPO"
+	envTrustPolicy               = "KHELM_TRUST_POLICY"
+	envMirrors                   = "KHELM_MIRRORS"
+	envCredentialHelper          = "KHELM_CREDENTIAL_HELPER"
+	envRetries                   = "KHELM_RETRIES"
 	envDebug                     = "KHELM_DEBUG"
 	envHelmDebug                 = "HELM_DEBUG"
 	flagTrustAnyRepo             = "trust-any-repo"
+	flagTrustPolicy              = "trust-policy"
+	flagMirror                   = "mirror"
+	flagCredentialHelper         = "credential-helper"
 	usageExample                 = "  khelm template ./chart\n  khelm template stable/jenkins\n  khelm template jenkins --version=2.5.3 --repo=https://kubernetes-charts.storage.googleapis.com"
 )
 
@@ -41,6 +49,28 @@ func Execute(reader io.Reader, writer io.Writer) error {
 		trust, _ := strconv.ParseBool(trustAnyRepo)
 		h.TrustAnyRepository = &trust
 	}
+	if trustPolicyFile := os.Getenv(envTrustPolicy); trustPolicyFile != "" {
+		p, err := helm.LoadTrustPolicy(trustPolicyFile)
+		if err != nil {
+			return errors.Wrap(err, envTrustPolicy)
+		}
+		h.TrustPolicy = p
+	}
+	if mirrors, ok := os.LookupEnv(envMirrors); ok {
+		m, err := helm.ParseMirrors(strings.Split(mirrors, ","))
+		if err != nil {
+			return errors.Wrap(err, envMirrors)
+		}
+		h.Mirrors = m
+	}
+	h.CredentialHelper = os.Getenv(envCredentialHelper)
+	if retries, ok := os.LookupEnv(envRetries); ok {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 {
+			return errors.Errorf("%s: invalid amount of retries %q", envRetries, retries)
+		}
+		h.Retry.MaxRetries = n
+	}
 
 	// Run as kustomize plugin (if kustomize-specific env var provided)
 	if kustomizeGenCfgYAML, isKustomizePlugin := os.LookupEnv(envKustomizePluginConfig); isKustomizePlugin {
@@ -80,9 +110,14 @@ func Execute(reader io.Reader, writer io.Writer) error {
 In addition to helm's templating capabilities khelm allows to:
  * build local charts automatically when templating
  * use any repository without registering it in repositories.yaml
+ * allow or deny repositories using a trust policy
+ * access repositories through mirrors
  * enforce namespace-scoped resources within the template output
  * set a namespace on all resources
- * convert a helm chart's output into a kustomization`
+ * convert a helm chart's output into a kustomization
+ * prefetch charts to render them in offline mode later
+ * lock the resolved chart versions and digests
+ * update and build the dependencies of local charts`
 
 	// Add template command (for non-kpt usage)
 	templateCmd := templateCommand(h, writer)
@@ -91,6 +126,43 @@ In addition to helm's templating capabilities khelm allows to:
 	templateCmd.PreRun = logVersionPreRun
 	rootCmd.AddCommand(templateCmd)
 
+	// Add prefetch command
+	prefetchCmd := prefetchCommand(h)
+	prefetchCmd.SetOut(writer)
+	prefetchCmd.SetErr(&errBuf)
+	prefetchCmd.PreRun = logVersionPreRun
+	rootCmd.AddCommand(prefetchCmd)
+
+	// Add lock command
+	lockCmd := lockCommand(h)
+	lockCmd.SetOut(writer)
+	lockCmd.SetErr(&errBuf)
+	for _, c := range lockCmd.Commands() {
+		c.SetErr(&errBuf)
+		c.PreRun = logVersionPreRun
+	}
+	rootCmd.AddCommand(lockCmd)
+
+	// Add dep command
+	depCmd := depCommand(h)
+	depCmd.SetOut(writer)
+	depCmd.SetErr(&errBuf)
+	for _, c := range depCmd.Commands() {
+		c.SetErr(&errBuf)
+		c.PreRun = logVersionPreRun
+	}
+	rootCmd.AddCommand(depCmd)
+
+	// Add cache command
+	cacheCmd := cacheCommand(h, writer)
+	cacheCmd.SetOut(writer)
+	cacheCmd.SetErr(&errBuf)
+	for _, c := range cacheCmd.Commands() {
+		c.SetErr(&errBuf)
+		c.PreRun = logVersionPreRun
+	}
+	rootCmd.AddCommand(cacheCmd)
+
 	// Run command
 	if err := rootCmd.Execute(); err != nil {
 		logStackTrace(err, debug)
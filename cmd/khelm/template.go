@@ -3,10 +3,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"net/url"
+	"path/filepath"
 
 	"github.com/mgoltzsche/khelm/internal/output"
 	"github.com/mgoltzsche/khelm/pkg/config"
 	"github.com/mgoltzsche/khelm/pkg/helm"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"k8s.io/helm/pkg/strvals"
 )
@@ -16,6 +19,7 @@ func templateCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
 	req.Name = "release-name"
 	outOpts := output.Options{Writer: writer}
 	trustAnyRepo := false
+	repoAuth := config.RepositoryAuth{}
 	cmd := &cobra.Command{
 		Use: "template",
 		Args: func(cmd *cobra.Command, args []string) error {
@@ -37,6 +41,11 @@ func templateCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
 				return err
 			}
 			req.Chart = args[0]
+			if repoAuth != (config.RepositoryAuth{}) {
+				if err = addRepositoryAuth(req, repoAuth); err != nil {
+					return err
+				}
+			}
 			resources, err := render(h, req)
 			if err != nil {
 				return err
@@ -55,27 +64,67 @@ func templateCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
 	f.StringVar(&req.Repository, "repository", "", "Chart repository url where to locate the requested chart")
 	f.Lookup("repository").Hidden = true
 	f.StringVar(&req.Version, "version", "", "Specify the exact chart version to use. If this is not specified, the latest version is used")
+	f.StringVar(&repoAuth.CAFile, "ca-file", "", "Verify the certificates of the --repo server using this CA bundle")
+	f.StringVar(&repoAuth.CertFile, "cert-file", "", "Identify to the --repo server using this TLS client certificate file")
+	f.StringVar(&repoAuth.KeyFile, "key-file", "", "Identify to the --repo server using this TLS client key file")
+	f.StringVar(&repoAuth.TokenFile, "token-file", "", "Authenticate with the --repo server using the bearer token within this file")
 	f.BoolVar(&trustAnyRepo, flagTrustAnyRepo, trustAnyRepo,
 		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
+	f.StringVar(&h.RegistryConfig, "registry-config", h.RegistryConfig, "Docker config file that provides the OCI registry credentials")
+	addRepositoryAccessFlags(f, h)
 	f.BoolVar(&req.NamespacedOnly, "namespaced-only", false, "Fail on known cluster-scoped resources and those of unknown kinds")
 	f.StringVar(&req.Keyring, "keyring", req.Keyring, "Keyring used to verify the chart")
 	f.BoolVar(&req.Verify, "verify", false, "Verify the package before using it")
-	f.BoolVar(&req.ReplaceLockFile, "replace-lock-file", false, "Remove requirements.lock and reload charts when it is out of sync")
+	f.BoolVar(&req.ReplaceLockFile, "replace-lock-file", false, "Ignore requirements.lock (or Chart.lock) and resolve the dependencies again when it is out of sync")
+	f.BoolVar(&req.Offline, "offline", false, "Never access the network but load all repository index files and charts from the cache")
+	f.StringVar(&req.LockFile, "lock-file", "", "Lock file that records the resolved chart versions and digests and is honoured when present")
+	f.DurationVar(&req.IndexMaxAge, "index-ttl", 0, "Max age of cached repository index files before they are updated when a version range is requested (default 0 updates them on every run)")
+	f.BoolVar(&req.Refresh, "refresh", false, "Download the repository index files even if they are cached and not expired")
 	f.StringVar(&req.Name, "name", req.Name, "Release name")
 	f.StringVar(&req.Namespace, "namespace", req.Namespace, "Set the installation namespace used by helm templates")
 	f.StringVar(&req.ForceNamespace, "force-namespace", req.ForceNamespace, "Set namespace on all namespaced resources (and those of unknown kinds)")
+	f.BoolVar(&req.StripHelmMetadata, "strip-helm-metadata", req.StripHelmMetadata, "Remove the labels and annotations that refer to Helm (helm.sh/chart, heritage, app.kubernetes.io/managed-by) unless used by a label selector")
+	f.StringVar(&req.ManagedBy, "managed-by", req.ManagedBy, "Set the app.kubernetes.io/managed-by label to this value instead of removing it when stripping Helm metadata")
+	f.StringToStringVar(&req.CommonLabels, "common-labels", req.CommonLabels, "Labels to add to all resources and pod templates (can specify multiple or separate labels with commas: key1=val1,key2=val2)")
+	f.BoolVar(&req.CommonLabelSelectors, "common-label-selectors", req.CommonLabelSelectors, "Add the common labels to the label selectors as well")
+	f.BoolVar(&req.CommonLabelsPodTemplates, "common-labels-pod-templates", req.CommonLabelsPodTemplates, "Add the common labels to the pod templates as well")
+	f.StringToStringVar(&req.CommonAnnotations, "common-annotations", req.CommonAnnotations, "Annotations to add to all resources and pod templates (can specify multiple or separate annotations with commas: key1=val1,key2=val2)")
 	f.Var((*valuesFlag)(&req.Values), "set", "Set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 	f.StringSliceVarP(&req.ValueFiles, "values", "f", nil, "Specify values in a YAML file or a URL (can specify multiple)")
 	f.StringSliceVar(&req.APIVersions, "api-versions", nil, "Kubernetes api versions used for Capabilities.APIVersions")
 	f.StringVar(&req.KubeVersion, "kube-version", req.KubeVersion, "Kubernetes version used as Capabilities.KubeVersion.Major/Minor")
 	f.BoolVar(&req.ExcludeHooks, "no-hooks", req.ExcludeHooks, "If enabled hooks are omitted from the output")
 	f.BoolVar(&req.ExcludeHooks, "exclude-hooks", req.ExcludeHooks, "If enabled hooks are omitted from the output")
+	f.StringVar(&req.HookMode, "hook-mode", req.HookMode, fmt.Sprintf("Convert chart hooks into plain resources (%s), Argo CD hooks (%s) or kpt dependencies (%s) instead of keeping them (%s)", config.HookModePlain, config.HookModeArgoCD, config.HookModeKpt, config.HookModeKeep))
+	f.BoolVar(&req.StripHookDeletePolicy, "strip-hook-delete-policy", req.StripHookDeletePolicy, "Remove the helm.sh/hook-delete-policy annotation from the hooks")
 	f.Lookup("exclude-hooks").Hidden = true
 	f.StringVarP(&outOpts.FileOrDir, "output", "o", "-", "Write rendered output to given file or directory (as kustomization)")
 	f.BoolVar(&outOpts.Replace, "output-replace", false, "Delete and recreate the whole output directory or file")
 	return cmd
 }
 
+// addRepositoryAuth adds the TLS settings and token specified via CLI options for the --repo server
+func addRepositoryAuth(req *config.ChartConfig, auth config.RepositoryAuth) error {
+	if u, err := url.Parse(req.Repository); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("--ca-file, --cert-file, --key-file and --token-file require --repo to specify a repository URL")
+	}
+	if (auth.CertFile == "") != (auth.KeyFile == "") {
+		return errors.New("--cert-file and --key-file must be specified together")
+	}
+	auth.URL = req.Repository
+	for _, file := range []*string{&auth.CAFile, &auth.CertFile, &auth.KeyFile, &auth.TokenFile} {
+		if *file != "" {
+			abs, err := filepath.Abs(*file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			*file = abs
+		}
+	}
+	req.RepositoryAuth = append(req.RepositoryAuth, auth)
+	return nil
+}
+
 type valuesFlag map[string]interface{}
 
 func (f *valuesFlag) Set(s string) error {
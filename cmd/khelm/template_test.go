@@ -84,11 +84,26 @@ func TestTemplateCommand(t *testing.T) {
 			[]string{filepath.Join(exampleDir, "force-namespace"), "--force-namespace=forced-namespace"},
 			5, "namespace: forced-namespace",
 		},
+		{
+			"common-labels",
+			[]string{filepath.Join(exampleDir, "namespace"), "--common-labels=team=myteam,tier=backend", "--common-annotations=example.org/owner=myteam"},
+			3, "    example.org/owner: myteam\n",
+		},
 		{
 			"chart-hooks",
 			[]string{filepath.Join(exampleDir, "chart-hooks")},
 			10, "helm.sh/hook",
 		},
+		{
+			"chart-hooks-argocd",
+			[]string{filepath.Join(exampleDir, "chart-hooks"), "--hook-mode=argocd", "--strip-hook-delete-policy"},
+			5, "argocd.argoproj.io/hook: PreSync",
+		},
+		{
+			"strip-helm-metadata",
+			[]string{filepath.Join(exampleDir, "chart-hooks"), "--strip-helm-metadata", "--managed-by=kpt"},
+			10, "app.kubernetes.io/managed-by: kpt",
+		},
 		{
 			"chart-hooks-excluded",
 			[]string{filepath.Join(exampleDir, "chart-hooks"), "--no-hooks"},
@@ -129,6 +144,14 @@ func TestTemplateCommandError(t *testing.T) {
 			"reject cluster scoped resources",
 			[]string{"cert-manager", "--repo=https://charts.jetstack.io", "--namespaced-only"},
 		},
+		{
+			"reject repository auth without repo",
+			[]string{filepath.Join("..", "..", "example", "namespace"), "--ca-file=ca.pem"},
+		},
+		{
+			"reject client certificate without key",
+			[]string{"cert-manager", "--repo=https://charts.jetstack.io", "--cert-file=client.pem", "--trust-any-repo"},
+		},
 	} {
 		t.Run(c.name, func(t *testing.T) {
 			os.Args = append([]string{"testee", "template"}, c.args...)
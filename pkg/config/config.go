@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
@@ -22,6 +24,17 @@ const (
 	oldGeneratorAPIVersion = "helm.kustomize.mgoltzsche.github.com/v1"
 )
 
+const (
+	// HookModeKeep keeps chart hooks as they are (default)
+	HookModeKeep = "keep"
+	// HookModePlain converts install/upgrade hooks into plain resources ordered by phase and weight
+	HookModePlain = "plain"
+	// HookModeArgoCD converts install/upgrade hooks into Argo CD sync hooks
+	HookModeArgoCD = "argocd"
+	// HookModeKpt converts install/upgrade hooks into resources that depend on each other using kpt's depends-on annotation
+	HookModeKpt = "kpt"
+)
+
 // GeneratorConfig define the kustomize plugin's input file content
 type GeneratorConfig struct {
 	APIVersion  string      `yaml:"apiVersion"`
@@ -67,27 +80,80 @@ func (cfg *ChartConfig) applyDefaults() {
 
 // LoaderConfig define the configuration to load a chart
 type LoaderConfig struct {
-	Repository      string `yaml:"repository,omitempty"`
-	Chart           string `yaml:"chart"`
-	Version         string `yaml:"version,omitempty"`
-	Verify          bool   `yaml:"verify,omitempty"`
-	Keyring         string `yaml:"keyring,omitempty"`
-	ReplaceLockFile bool   `yaml:"replaceLockFile,omitempty"`
+	Repository      string        `yaml:"repository,omitempty"`
+	Chart           string        `yaml:"chart"`
+	Version         string        `yaml:"version,omitempty"`
+	Verify          bool          `yaml:"verify,omitempty"`
+	Keyring         string        `yaml:"keyring,omitempty"`
+	ReplaceLockFile bool          `yaml:"replaceLockFile,omitempty"`
+	Offline         bool          `yaml:"offline,omitempty"`
+	LockFile        string        `yaml:"lockFile,omitempty"`
+	IndexMaxAge     time.Duration `yaml:"indexMaxAge,omitempty"`
+	Refresh         bool          `yaml:"refresh,omitempty"`
+	// RepositoryAuth specifies the TLS settings and bearer tokens of repositories
+	RepositoryAuth []RepositoryAuth `yaml:"repositoryAuth,omitempty"`
+}
+
+// RepositoryAuth specifies how to authenticate with the repository at the given URL.
+// It applies to all URLs that start with the repository URL.
+// Relative file paths are resolved relative to the config's base directory.
+type RepositoryAuth struct {
+	URL       string `yaml:"url"`
+	CAFile    string `yaml:"caFile,omitempty"`
+	CertFile  string `yaml:"certFile,omitempty"`
+	KeyFile   string `yaml:"keyFile,omitempty"`
+	TokenFile string `yaml:"tokenFile,omitempty"`
 }
 
 // RendererConfig defines the configuration to render a chart
 type RendererConfig struct {
-	Name           string                 `yaml:"name,omitempty"`
-	Namespace      string                 `yaml:"namespace,omitempty"`
-	ValueFiles     []string               `yaml:"valueFiles,omitempty"`
-	Values         map[string]interface{} `yaml:"values,omitempty"`
-	KubeVersion    string                 `yaml:"kubeVersion,omitempty"`
-	APIVersions    []string               `yaml:"apiVersions,omitempty"`
-	Include        []ResourceSelector     `yaml:"include,omitempty"`
-	Exclude        []ResourceSelector     `yaml:"exclude,omitempty"`
-	ExcludeHooks   bool                   `yaml:"excludeHooks,omitempty"`
-	NamespacedOnly bool                   `yaml:"namespacedOnly,omitempty"`
-	ForceNamespace string                 `yaml:"forceNamespace,omitempty"`
+	Name                     string                 `yaml:"name,omitempty"`
+	Namespace                string                 `yaml:"namespace,omitempty"`
+	ValueFiles               []string               `yaml:"valueFiles,omitempty"`
+	Values                   map[string]interface{} `yaml:"values,omitempty"`
+	KubeVersion              string                 `yaml:"kubeVersion,omitempty"`
+	APIVersions              []string               `yaml:"apiVersions,omitempty"`
+	Include                  []ResourceSelector     `yaml:"include,omitempty"`
+	Exclude                  []ResourceSelector     `yaml:"exclude,omitempty"`
+	ExcludeHooks             bool                   `yaml:"excludeHooks,omitempty"`
+	HookMode                 string                 `yaml:"hookMode,omitempty"`
+	StripHookDeletePolicy    bool                   `yaml:"stripHookDeletePolicy,omitempty"`
+	NamespacedOnly           bool                   `yaml:"namespacedOnly,omitempty"`
+	ForceNamespace           string                 `yaml:"forceNamespace,omitempty"`
+	CommonLabels             map[string]string      `yaml:"commonLabels,omitempty"`
+	CommonLabelSelectors     bool                   `yaml:"commonLabelSelectors,omitempty"`
+	CommonLabelsPodTemplates bool                   `yaml:"commonLabelsPodTemplates,omitempty"`
+	CommonAnnotations        map[string]string      `yaml:"commonAnnotations,omitempty"`
+	StripHelmMetadata        bool                   `yaml:"stripHelmMetadata,omitempty"`
+	ManagedBy                string                 `yaml:"managedBy,omitempty"`
+	Patches                  []Patch                `yaml:"patches,omitempty"`
+	Images                   []Image                `yaml:"images,omitempty"`
+}
+
+// Image specifies how the references to a container image within the rendered pod templates are rewritten.
+// An image is matched by its name without tag and digest.
+type Image struct {
+	Name        string `yaml:"name"`
+	NewRegistry string `yaml:"newRegistry,omitempty"`
+	NewName     string `yaml:"newName,omitempty"`
+	NewTag      string `yaml:"newTag,omitempty"`
+	Digest      string `yaml:"digest,omitempty"`
+}
+
+// Patch specifies a strategic merge patch or a JSON 6902 patch that is applied to the rendered resources the target selects.
+// A strategic merge patch that does not specify a target selects the resource that matches its own kind, name (and apiVersion and namespace if specified).
+type Patch struct {
+	Target         *ResourceSelector      `yaml:"target,omitempty"`
+	StrategicMerge map[string]interface{} `yaml:"strategicMerge,omitempty"`
+	JSON6902       []JSONPatchOperation   `yaml:"json6902,omitempty"`
+}
+
+// JSONPatchOperation specifies a JSON 6902 patch operation
+type JSONPatchOperation struct {
+	Op    string      `yaml:"op"`
+	Path  string      `yaml:"path"`
+	From  string      `yaml:"from,omitempty"`
+	Value interface{} `yaml:"value,omitempty"`
 }
 
 // ResourceSelector specifies a Kubernetes resource selector
@@ -109,6 +175,85 @@ func (cfg *ChartConfig) Validate() (errs []string) {
 	if cfg.Namespace == "" {
 		errs = append(errs, "release namespace not specified")
 	}
+	for i, patch := range cfg.Patches {
+		for _, err := range patch.validate() {
+			errs = append(errs, fmt.Sprintf("patches[%d]: %s", i, err))
+		}
+	}
+	switch cfg.HookMode {
+	case "", HookModeKeep:
+	case HookModePlain, HookModeArgoCD, HookModeKpt:
+		if cfg.ExcludeHooks {
+			errs = append(errs, fmt.Sprintf("hookMode %s cannot be combined with excludeHooks", cfg.HookMode))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported hookMode %q, expected one of %s, %s, %s, %s", cfg.HookMode, HookModeKeep, HookModePlain, HookModeArgoCD, HookModeKpt))
+	}
+	if cfg.ManagedBy != "" && !cfg.StripHelmMetadata {
+		errs = append(errs, "managedBy requires stripHelmMetadata to be enabled")
+	}
+	for i, image := range cfg.Images {
+		for _, err := range image.validate() {
+			errs = append(errs, fmt.Sprintf("images[%d]: %s", i, err))
+		}
+	}
+	for i, auth := range cfg.RepositoryAuth {
+		if u, err := url.Parse(auth.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("repositoryAuth[%d].url must specify an absolute URL but was %q", i, auth.URL))
+		}
+		if (auth.CertFile == "") != (auth.KeyFile == "") {
+			errs = append(errs, fmt.Sprintf("repositoryAuth[%d]: certFile and keyFile must be specified together", i))
+		}
+	}
+	return
+}
+
+func (img *Image) validate() (errs []string) {
+	if img.Name == "" {
+		errs = append(errs, "name not specified")
+	}
+	if img.NewRegistry == "" && img.NewName == "" && img.NewTag == "" && img.Digest == "" {
+		errs = append(errs, "neither newRegistry, newName, newTag nor digest specified")
+	}
+	if img.NewTag != "" && img.Digest != "" {
+		errs = append(errs, "newTag and digest are mutually exclusive")
+	}
+	if img.Digest != "" && !strings.Contains(img.Digest, ":") {
+		errs = append(errs, fmt.Sprintf("invalid digest %q, expected <algorithm>:<hex>", img.Digest))
+	}
+	return
+}
+
+func (p *Patch) validate() (errs []string) {
+	if (len(p.StrategicMerge) > 0) == (len(p.JSON6902) > 0) {
+		return []string{"either strategicMerge or json6902 must be specified"}
+	}
+	if p.Target != nil && *p.Target == (ResourceSelector{}) {
+		errs = append(errs, "empty target")
+	}
+	if len(p.StrategicMerge) > 0 && p.Target == nil {
+		meta, _ := p.StrategicMerge["metadata"].(map[string]interface{})
+		if p.StrategicMerge["kind"] == nil || meta == nil || meta["name"] == nil {
+			errs = append(errs, "strategicMerge patch must specify a target or its kind and metadata.name")
+		}
+	}
+	if len(p.JSON6902) > 0 && p.Target == nil {
+		errs = append(errs, "json6902 patch must specify a target")
+	}
+	for i, op := range p.JSON6902 {
+		switch op.Op {
+		case "add", "remove", "replace", "test":
+		case "move", "copy":
+			if op.From == "" {
+				errs = append(errs, fmt.Sprintf("json6902[%d]: %s operation must specify from", i, op.Op))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("json6902[%d]: unsupported operation %q", i, op.Op))
+		}
+		if op.Path != "" && !strings.HasPrefix(op.Path, "/") {
+			errs = append(errs, fmt.Sprintf("json6902[%d]: path %q must start with /", i, op.Path))
+		}
+	}
 	return
 }
 
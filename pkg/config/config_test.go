@@ -4,7 +4,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,6 +19,9 @@ var rootDir = func() string {
 	return filepath.Join(wd, "..", "..")
 }()
 
+// chartRendererHeader is the minimal ChartRenderer config the test cases append their fields to
+const chartRendererHeader = "apiVersion: khelm.mgoltzsche.github.com/v1\nkind: ChartRenderer\nmetadata:\n  name: mychart\nchart: mychart\n"
+
 func TestReadGeneratorConfig(t *testing.T) {
 	f, err := os.Open(filepath.Join(rootDir, "example/invalid-requirements-lock/generator.yaml"))
 	require.NoError(t, err)
@@ -34,3 +39,86 @@ func TestReadGeneratorConfigUnsupportedFieldError(t *testing.T) {
 	_, err = ReadGeneratorConfig(f)
 	require.Error(t, err)
 }
+
+func TestReadGeneratorConfigIndexMaxAge(t *testing.T) {
+	cfg, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "indexMaxAge: 1h30m\n"))
+	require.NoError(t, err)
+	require.Equal(t, 90*time.Minute, cfg.IndexMaxAge, "indexMaxAge")
+}
+
+func TestReadGeneratorConfigRepositoryAuth(t *testing.T) {
+	cfg, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "repositoryAuth:\n- url: https://charts.example.org\n  caFile: ca.pem\n  certFile: client.pem\n  keyFile: client-key.pem\n  tokenFile: token\n"))
+	require.NoError(t, err)
+	expected := []RepositoryAuth{{URL: "https://charts.example.org", CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client-key.pem", TokenFile: "token"}}
+	require.Equal(t, expected, cfg.RepositoryAuth, "repositoryAuth")
+
+	for _, invalid := range []string{
+		"repositoryAuth:\n- caFile: ca.pem\n",
+		"repositoryAuth:\n- url: charts.example.org\n",
+		"repositoryAuth:\n- url: https://charts.example.org\n  certFile: client.pem\n",
+	} {
+		_, err = ReadGeneratorConfig(strings.NewReader(chartRendererHeader + invalid))
+		require.Error(t, err, "invalid config: %s", invalid)
+	}
+}
+
+func TestReadGeneratorConfigPatches(t *testing.T) {
+	cfg, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "patches:\n- strategicMerge:\n    kind: ConfigMap\n    metadata:\n      name: myconfig\n    data:\n      key: value\n- target:\n    kind: ConfigMap\n  json6902:\n  - op: move\n    from: /data/a\n    path: /data/b\n"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(cfg.Patches), "patches")
+	require.Equal(t, []JSONPatchOperation{{Op: "move", From: "/data/a", Path: "/data/b"}}, cfg.Patches[1].JSON6902, "json6902")
+
+	for _, invalid := range []string{
+		"patches:\n- target:\n    kind: ConfigMap\n",
+		"patches:\n- strategicMerge:\n    data:\n      key: value\n",
+		"patches:\n- json6902:\n  - op: remove\n    path: /data\n",
+		"patches:\n- target:\n    kind: ConfigMap\n  json6902:\n  - op: delete\n    path: /data\n",
+		"patches:\n- target:\n    kind: ConfigMap\n  json6902:\n  - op: remove\n    path: data\n",
+		"patches:\n- target:\n    kind: ConfigMap\n  json6902:\n  - op: copy\n    path: /data\n",
+	} {
+		_, err = ReadGeneratorConfig(strings.NewReader(chartRendererHeader + invalid))
+		require.Error(t, err, "invalid config: %s", invalid)
+	}
+}
+
+func TestReadGeneratorConfigImages(t *testing.T) {
+	cfg, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "images:\n- name: nginx\n  newRegistry: mirror.example.org\n  newTag: \"1.19\"\n"))
+	require.NoError(t, err)
+	expected := []Image{{Name: "nginx", NewRegistry: "mirror.example.org", NewTag: "1.19"}}
+	require.Equal(t, expected, cfg.Images, "images")
+
+	for _, invalid := range []string{
+		"images:\n- newTag: \"1.19\"\n",
+		"images:\n- name: nginx\n",
+		"images:\n- name: nginx\n  newTag: \"1.19\"\n  digest: sha256:abc\n",
+		"images:\n- name: nginx\n  digest: abc\n",
+	} {
+		_, err = ReadGeneratorConfig(strings.NewReader(chartRendererHeader + invalid))
+		require.Error(t, err, "invalid config: %s", invalid)
+	}
+}
+
+func TestReadGeneratorConfigHookMode(t *testing.T) {
+	for _, mode := range []string{HookModeKeep, HookModePlain, HookModeArgoCD, HookModeKpt} {
+		cfg, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "hookMode: " + mode + "\nstripHookDeletePolicy: true\n"))
+		require.NoError(t, err, "hookMode %s", mode)
+		require.Equal(t, mode, cfg.HookMode, "hookMode")
+		require.True(t, cfg.StripHookDeletePolicy, "stripHookDeletePolicy")
+	}
+	for _, invalid := range []string{
+		"hookMode: helm\n",
+		"hookMode: argocd\nexcludeHooks: true\n",
+	} {
+		_, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + invalid))
+		require.Error(t, err, "invalid config: %s", invalid)
+	}
+}
+
+func TestReadGeneratorConfigStripHelmMetadata(t *testing.T) {
+	cfg, err := ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "stripHelmMetadata: true\nmanagedBy: kpt\n"))
+	require.NoError(t, err)
+	require.True(t, cfg.StripHelmMetadata, "stripHelmMetadata")
+	require.Equal(t, "kpt", cfg.ManagedBy, "managedBy")
+	_, err = ReadGeneratorConfig(strings.NewReader(chartRendererHeader + "managedBy: kpt\n"))
+	require.Error(t, err, "managedBy without stripHelmMetadata")
+}
@@ -0,0 +1,146 @@
+package helm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/tlsutil"
+	"k8s.io/helm/pkg/version"
+)
+
+// repositoryAuthGetters returns getters that apply the TLS settings and bearer token
+// of the repository a requested URL belongs to.
+// Since helm passes the repository's (or the requested chart's or values file's) URL when creating a getter
+// this applies to index, chart and values file downloads.
+// TLS settings that are passed explicitly (from repositories.yaml) take precedence.
+func repositoryAuthGetters(providers getter.Providers, auths []config.RepositoryAuth, baseDir string) getter.Providers {
+	if len(auths) == 0 {
+		return providers
+	}
+	wrapped := make(getter.Providers, len(providers))
+	for i, p := range providers {
+		newGetter := p.New
+		wrapped[i] = getter.Provider{
+			Schemes: p.Schemes,
+			New: func(u, certFile, keyFile, caFile string) (getter.Getter, error) {
+				auth := repositoryAuthForURL(auths, u)
+				if auth == nil {
+					return newGetter(u, certFile, keyFile, caFile)
+				}
+				if certFile == "" && keyFile == "" && auth.CertFile != "" {
+					certFile = absPath(auth.CertFile, baseDir)
+					keyFile = absPath(auth.KeyFile, baseDir)
+				}
+				if caFile == "" && auth.CAFile != "" {
+					caFile = absPath(auth.CAFile, baseDir)
+				}
+				if auth.TokenFile == "" {
+					return newGetter(u, certFile, keyFile, caFile)
+				}
+				token, err := ioutil.ReadFile(absPath(auth.TokenFile, baseDir))
+				if err != nil {
+					return nil, errors.Wrap(err, "read repository token")
+				}
+				return newBearerTokenGetter(u, certFile, keyFile, caFile, strings.TrimSpace(string(token)))
+			},
+		}
+	}
+	return wrapped
+}
+
+// identityTokenGetters returns getters that authenticate using the identity token of the repository a requested URL belongs to.
+// The tokens map the URLs the repositories are accessed with to the identity tokens the credential helper returned.
+// Since the tokens are looked up when a getter is created they can be added after the getters have been returned.
+func identityTokenGetters(providers getter.Providers, tokens map[string]string) getter.Providers {
+	wrapped := make(getter.Providers, len(providers))
+	for i, p := range providers {
+		newGetter := p.New
+		wrapped[i] = getter.Provider{
+			Schemes: p.Schemes,
+			New: func(u, certFile, keyFile, caFile string) (getter.Getter, error) {
+				if token := identityTokenForURL(tokens, u); token != "" {
+					return newBearerTokenGetter(u, certFile, keyFile, caFile, token)
+				}
+				return newGetter(u, certFile, keyFile, caFile)
+			},
+		}
+	}
+	return wrapped
+}
+
+// identityTokenForURL returns the identity token of the repository the given URL belongs to.
+// When multiple repositories match the token of the one with the longest URL is returned.
+func identityTokenForURL(tokens map[string]string, u string) string {
+	match, token := "", ""
+	for repoURL, t := range tokens {
+		repoURL = strings.TrimSuffix(repoURL, "/")
+		if (u == repoURL || strings.HasPrefix(u, repoURL+"/")) && len(repoURL) > len(match) {
+			match, token = repoURL, t
+		}
+	}
+	return token
+}
+
+// repositoryAuthForURL returns the auth config of the repository the given URL belongs to.
+// When multiple repositories match the one with the longest URL is returned.
+func repositoryAuthForURL(auths []config.RepositoryAuth, u string) *config.RepositoryAuth {
+	var match *config.RepositoryAuth
+	for i, auth := range auths {
+		repoURL := strings.TrimSuffix(auth.URL, "/")
+		if (u == repoURL || strings.HasPrefix(u, repoURL+"/")) && (match == nil || len(repoURL) > len(strings.TrimSuffix(match.URL, "/"))) {
+			match = &auths[i]
+		}
+	}
+	return match
+}
+
+// bearerTokenGetter is an HTTP(S) getter that authenticates using a bearer token.
+// Unlike helm's HttpGetter it does not support basic auth.
+type bearerTokenGetter struct {
+	client *http.Client
+	token  string
+}
+
+func newBearerTokenGetter(u, certFile, keyFile, caFile, token string) (getter.Getter, error) {
+	tr := &http.Transport{
+		DisableCompression: true,
+		Proxy:              http.ProxyFromEnvironment,
+	}
+	if (certFile != "" && keyFile != "") || caFile != "" {
+		tlsConf, err := tlsutil.NewTLSConfig(u, certFile, keyFile, caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create TLS config")
+		}
+		tr.TLSClientConfig = tlsConf
+	}
+	return &bearerTokenGetter{
+		client: &http.Client{Transport: tr},
+		token:  token,
+	}, nil
+}
+
+func (g *bearerTokenGetter) Get(u string) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(nil)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return buf, errors.WithStack(err)
+	}
+	req.Header.Set("User-Agent", "Helm/"+strings.TrimPrefix(version.GetVersion(), "v"))
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return buf, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return buf, errors.Errorf("failed to fetch %s : %s", u, resp.Status)
+	}
+	_, err = io.Copy(buf, resp.Body)
+	return buf, errors.WithStack(err)
+}
@@ -0,0 +1,296 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/helm/helmpath"
+)
+
+var cacheDigestSuffixRegex = regexp.MustCompile(`-([0-9a-f]{16})$`)
+
+// CachedChart describes a chart archive within the cache
+type CachedChart struct {
+	File     string
+	Host     string
+	Path     string
+	Name     string
+	Version  string
+	Digest   string
+	Size     int64
+	LastUsed time.Time
+}
+
+// CachedIndexFile describes a repository index file within the cache
+type CachedIndexFile struct {
+	File       string
+	Size       int64
+	Downloaded time.Time
+}
+
+// CachePruneOptions specifies which cache entries are removed.
+// When both options are specified only entries that are older and not among the latest versions are removed.
+type CachePruneOptions struct {
+	// OlderThan specifies the duration since a chart has been used or a repository index has been downloaded.
+	OlderThan time.Duration
+	// KeepLatest specifies the amount of latest versions that are kept per chart.
+	KeepLatest int
+	// DryRun reports the cache entries that would be removed without removing them.
+	DryRun bool
+}
+
+// chartCacheDir returns the directory charts are cached within
+func chartCacheDir(home helmpath.Home) string {
+	return filepath.Join(home.Archive(), "khelm")
+}
+
+// CachedCharts returns the chart archives within the cache.
+// Temporary files of downloads that are in progress are ignored.
+func (h *Helm) CachedCharts() ([]CachedChart, error) {
+	cacheDir := chartCacheDir(h.Settings.Home)
+	charts := []CachedChart{}
+	err := filepath.Walk(cacheDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed concurrently
+			}
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || filepath.Ext(file) != ".tgz" {
+			return nil
+		}
+		rel, err := filepath.Rel(cacheDir, file)
+		if err != nil {
+			return err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		if len(segments) < 3 {
+			return nil
+		}
+		entryDir := segments[len(segments)-2]
+		m := cacheDigestSuffixRegex.FindStringSubmatch(entryDir)
+		if m == nil {
+			return nil
+		}
+		name, version := splitChartNameVersion(strings.TrimSuffix(entryDir, m[0]))
+		charts = append(charts, CachedChart{
+			File:     file,
+			Host:     cacheHost(segments[0]),
+			Path:     strings.Join(segments[1:len(segments)-2], "/"),
+			Name:     name,
+			Version:  version,
+			Digest:   m[1],
+			Size:     fi.Size(),
+			LastUsed: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list cached charts")
+	}
+	return charts, nil
+}
+
+// splitChartNameVersion splits the <name>-<version> string of a cache directory name
+func splitChartNameVersion(nameVersion string) (name, version string) {
+	for i, c := range nameVersion {
+		if c != '-' {
+			continue
+		}
+		if _, err := semver.StrictNewVersion(strings.TrimPrefix(nameVersion[i+1:], "v")); err == nil {
+			return nameVersion[:i], nameVersion[i+1:]
+		}
+	}
+	return nameVersion, ""
+}
+
+// CachedIndexFiles returns the repository index files within the cache
+func (h *Helm) CachedIndexFiles() ([]CachedIndexFile, error) {
+	files, err := ioutil.ReadDir(h.Settings.Home.Cache())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "list cached repository index files")
+	}
+	indexFiles := []CachedIndexFile{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), "-index.yaml") {
+			continue
+		}
+		indexFiles = append(indexFiles, CachedIndexFile{
+			File:       filepath.Join(h.Settings.Home.Cache(), f.Name()),
+			Size:       f.Size(),
+			Downloaded: f.ModTime(),
+		})
+	}
+	return indexFiles, nil
+}
+
+// PruneCache removes the chart archives and repository index files from the cache that match the given options
+// and returns the removed files.
+// Cache entries are locked and moved atomically before they are deleted in order to not disturb concurrent khelm processes.
+// The lock files of the removed entries are deleted with them and, when a max age is specified,
+// the lock files of local chart directories that have not been used within it as well.
+// Lock files are not listed among the removed files.
+func (h *Helm) PruneCache(ctx context.Context, opts CachePruneOptions) ([]string, error) {
+	if opts.OlderThan <= 0 && opts.KeepLatest <= 0 {
+		return nil, errors.New("prune cache: neither max age nor amount of latest versions to keep specified")
+	}
+	charts, err := h.CachedCharts()
+	if err != nil {
+		return nil, err
+	}
+	indexFiles, err := h.CachedIndexFiles()
+	if err != nil {
+		return nil, err
+	}
+	expired := func(t time.Time) bool {
+		return opts.OlderThan <= 0 || time.Since(t) > opts.OlderThan
+	}
+	removed := []string{}
+
+	// Group charts by repository and name, latest version first
+	groups := map[string][]CachedChart{}
+	for _, c := range charts {
+		key := fmt.Sprintf("%s/%s/%s", c.Host, c.Path, c.Name)
+		groups[key] = append(groups[key], c)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			vi, erri := semver.NewVersion(group[i].Version)
+			vj, errj := semver.NewVersion(group[j].Version)
+			if erri == nil && errj == nil && !vi.Equal(vj) {
+				return vi.GreaterThan(vj)
+			}
+			return group[i].LastUsed.After(group[j].LastUsed)
+		})
+		for i, c := range group {
+			if opts.KeepLatest > 0 && i < opts.KeepLatest || !expired(c.LastUsed) {
+				continue
+			}
+			if !opts.DryRun {
+				if err = removeCacheEntry(ctx, filepath.Dir(c.File)); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, c.File)
+		}
+	}
+
+	// Remove expired repository index files
+	if opts.OlderThan > 0 {
+		for _, f := range indexFiles {
+			if !expired(f.Downloaded) {
+				continue
+			}
+			if !opts.DryRun {
+				if err = removeCacheFile(ctx, f.File); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, f.File)
+		}
+		if !opts.DryRun {
+			if err = removeExpiredChartDirLockFiles(chartDirLockDir(h.Settings.Home), expired); err != nil {
+				return removed, err
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// removeCacheFile deletes the given cache file and its lock file.
+// It waits for a concurrent download of the file to complete.
+func removeCacheFile(ctx context.Context, file string) error {
+	unlock, err := lockPath(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return removeLockFile(pathLockFile(file))
+}
+
+// removeExpiredChartDirLockFiles deletes the local chart directory lock files that have not been used within the max age
+// and are not held by another process.
+func removeExpiredChartDirLockFiles(lockDir string, expired func(time.Time) bool) error {
+	files, err := ioutil.ReadDir(lockDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "list chart directory lock files")
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "chart-") || filepath.Ext(f.Name()) != ".lock" || !expired(f.ModTime()) {
+			continue
+		}
+		if _, err = removeUnusedLockFile(filepath.Join(lockDir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCacheEntry moves the given cache directory to a temporary location and deletes it together with its lock file.
+// It waits for concurrent downloads into the directory to complete.
+func removeCacheEntry(ctx context.Context, dir string) error {
+	unlock, err := lockPath(ctx, dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), fmt.Sprintf(".tmp-rm-%s-", filepath.Base(dir)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpEntryDir := filepath.Join(tmpDir, filepath.Base(dir))
+	err = os.Rename(dir, tmpEntryDir)
+	if err != nil && !os.IsNotExist(err) {
+		_ = os.Remove(tmpDir)
+		return errors.WithStack(err)
+	}
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return errors.WithStack(err)
+	}
+	return removeLockFile(pathLockFile(dir))
+}
+
+// VerifyCache verifies the digests of all cached chart archives and returns the corrupted ones
+func (h *Helm) VerifyCache() (corrupted []CachedChart, err error) {
+	charts, err := h.CachedCharts()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range charts {
+		if err = verifyChartDigest(c.File, c.Digest); err != nil {
+			if _, e := os.Stat(c.File); os.IsNotExist(e) {
+				continue // removed concurrently
+			}
+			log.Printf("Cached chart %s %s is corrupted: %s", c.Name, c.Version, err)
+			corrupted = append(corrupted, c)
+		}
+	}
+	return corrupted, nil
+}
+
+// touchCachedChart marks the cached chart as used.
+// This is best effort since the cache may be mounted read-only.
+func touchCachedChart(file string) {
+	now := time.Now()
+	_ = os.Chtimes(file, now, now)
+}
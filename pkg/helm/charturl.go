@@ -0,0 +1,354 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/downloader"
+	"k8s.io/helm/pkg/getter"
+	cli "k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+	"k8s.io/helm/pkg/repo"
+)
+
+// isChartURL returns true if the given chart refers to a chart archive by its HTTP(S) URL
+func isChartURL(chart string) bool {
+	return strings.HasPrefix(chart, "https://") || strings.HasPrefix(chart, "http://")
+}
+
+// isChartArchive returns true if the given local chart path refers to a file (a packaged chart) instead of a directory
+func isChartArchive(chartPath string) bool {
+	fi, err := os.Stat(chartPath)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// loadChartArchive loads a local packaged chart, verifying its provenance file if requested.
+// Since an archive cannot be modified its dependencies are expected to be contained within its charts directory.
+func loadChartArchive(cfg *config.LoaderConfig, chartPath string) (ch *chart.Chart, err error) {
+	if cfg.Verify {
+		if _, err = downloader.VerifyChart(chartPath, cfg.Keyring); err != nil {
+			return nil, err
+		}
+	}
+	return loadChartPath(chartPath)
+}
+
+// locateChartURL fetches the chart archive the configured URL points to if not present in cache and returns it.
+// Since the archive's digest is not known before it has been downloaded
+// a cached archive is only downloaded again when the lock file specifies another digest or a refresh is requested.
+// The archive's name, version and digest are recorded within the lock file.
+func locateChartURL(ctx context.Context, cfg *config.LoaderConfig, lock *lockFile, opts *repositoryOptions, settings *cli.EnvSettings, getters getter.Providers) (*cachedChartArchive, error) {
+	chartURL := cfg.Chart
+	u, err := url.Parse(chartURL)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.Errorf("invalid chart URL %q", chartURL)
+	}
+	entry, err := chartURLRepositoryEntry(chartURL, opts.TrustAnyRepository, opts.TrustPolicy, settings)
+	if err != nil {
+		return nil, err
+	}
+	refresh := cfg.Refresh || lock != nil && lock.update
+	cacheFile, err := cachedChartURLFile(chartURL, lock.GetURL(chartURL, cfg.Version), refresh, chartCacheDir(settings.Home))
+	if err != nil {
+		return nil, err
+	}
+	var archive *cachedChartArchive
+	// Download the chart again if a concurrent cache prune removed it meanwhile
+	for attempt := 0; archive == nil; attempt++ {
+		if cacheFile == "" {
+			if cfg.Offline {
+				return nil, newNotCachedError(fmt.Sprintf("chart %s", chartURL))
+			}
+			if cacheFile, err = downloadChartURL(ctx, cfg, entry, opts, settings, getters); err != nil {
+				return nil, err
+			}
+		} else if cfg.Verify {
+			// The chart may have been cached without its provenance file
+			err = fetchChartURLProvenance(ctx, cfg, cacheFile, entry, opts, getters)
+		}
+		if err == nil {
+			archive, err = readCachedChart(ctx, cacheFile, cacheEntryDigest(cacheFile), cfg)
+		}
+		if err != nil {
+			if !isNotExist(err) || attempt == 2 {
+				return nil, err
+			}
+			cacheFile = ""
+		}
+	}
+	cv, err := chartArchiveVersion(archive)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Version != "" {
+		c, err := semver.NewConstraint(cfg.Version)
+		if err != nil {
+			return nil, errors.Wrap(err, "chart version")
+		}
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil || !c.Check(v) {
+			return nil, errors.Errorf("chart %s has version %s which does not match %q", chartURL, cv.Version, cfg.Version)
+		}
+	}
+	if err = lock.Lock(chartURL, cfg.Version, cv, chartURL); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// chartURLRepositoryEntry returns the registered repository the given chart URL belongs to
+// (providing its credentials and TLS settings) or an empty entry if the URL may be used without being registered.
+func chartURLRepositoryEntry(chartURL string, trustAnyRepo *bool, trustPolicy *TrustPolicy, settings *cli.EnvSettings) (*repo.Entry, error) {
+	allowed, err := trustPolicy.check(chartURL)
+	if err != nil {
+		return nil, err
+	}
+	repoFile := settings.Home.RepositoryFile()
+	repos, err := repo.LoadRepositoriesFile(repoFile)
+	if err != nil {
+		if _, e := os.Stat(repoFile); e != nil && !os.IsNotExist(e) {
+			return nil, errors.Wrapf(err, "load %s", repoFile)
+		}
+		repos = nil
+	}
+	if repos != nil {
+		var match *repo.Entry
+		for _, e := range repos.Repositories {
+			repoURL := strings.TrimSuffix(e.URL, "/")
+			if strings.HasPrefix(chartURL, repoURL+"/") && (match == nil || len(e.URL) > len(match.URL)) {
+				match = e
+			}
+		}
+		if match != nil {
+			entry := *match
+			return &entry, nil
+		}
+	}
+	if !allowed && !isUnknownRepositoryTrusted(trustAnyRepo, repos != nil, trustPolicy) {
+		err = errors.Errorf("chart URL %q does not belong to any repository within %s and usage of untrusted repositories is disabled", chartURL, repoFile)
+		return nil, &untrustedRepoError{err}
+	}
+	return &repo.Entry{URL: chartURL}, nil
+}
+
+// cachedChartURLFile returns the path of the cached (yet unverified) archive of the given chart URL
+// or an empty string if the archive needs to be downloaded.
+// When the URL is locked the archive with the locked digest is returned,
+// otherwise the most recently used one.
+func cachedChartURLFile(chartURL string, locked *lockedChart, refresh bool, cacheDir string) (string, error) {
+	if refresh {
+		return "", nil
+	}
+	// Match the <name>-<version>-<digest> directories of the URL
+	cv := &repo.ChartVersion{Metadata: &chart.Metadata{}, Digest: strings.Repeat("0", 16)}
+	pattern, err := cacheFilePath(chartURL, cv, cacheDir)
+	if err != nil {
+		return "", errors.Wrap(err, "derive chart cache file")
+	}
+	pattern = filepath.Join(filepath.Dir(filepath.Dir(pattern)), "*", filepath.Base(pattern))
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	var latest os.FileInfo
+	latestFile := ""
+	for _, file := range files {
+		dirName := filepath.Base(filepath.Dir(file))
+		m := cacheDigestSuffixRegex.FindStringSubmatch(dirName)
+		if m == nil || strings.HasPrefix(dirName, ".") {
+			continue
+		}
+		if locked != nil && (len(locked.Digest) < 16 || locked.Digest[:16] != m[1]) {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil || latest != nil && !fi.ModTime().After(latest.ModTime()) {
+			continue
+		}
+		latest = fi
+		latestFile = file
+	}
+	if latestFile == "" {
+		return "", nil
+	}
+	return latestFile, nil
+}
+
+// downloadChartURL downloads the chart archive (and its provenance file if verification is requested)
+// and moves it into the cache directory that is derived from its URL, name, version and digest.
+func downloadChartURL(ctx context.Context, cfg *config.LoaderConfig, entry *repo.Entry, opts *repositoryOptions, settings *cli.EnvSettings, getters getter.Providers) (string, error) {
+	chartURL := cfg.Chart
+	// The chart URL identifies the chart within the cache and lock file while it is downloaded from the mirror (if any)
+	downloadURL := opts.Mirrors.Rewrite(chartURL)
+	if downloadURL != chartURL {
+		log.Printf("Downloading chart %s via mirror %s", chartURL, downloadURL)
+	} else {
+		log.Printf("Downloading chart %s", chartURL)
+	}
+	g, err := chartURLGetter(ctx, downloadURL, entry, opts, getters)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse chart URL %q", downloadURL)
+	}
+
+	// Download into a temporary directory within the cache since the cache path depends on the archive's digest
+	cacheDir := chartCacheDir(settings.Home)
+	if err = os.MkdirAll(cacheDir, 0750); err != nil {
+		return "", errors.WithStack(err)
+	}
+	tmpDir, err := ioutil.TempDir(cacheDir, ".tmp-download-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpFile := filepath.Join(tmpDir, filepath.Base(u.Path))
+	files := map[string]string{downloadURL: tmpFile}
+	if cfg.Verify {
+		files[downloadURL+".prov"] = tmpFile + ".prov"
+	}
+	for fileURL, file := range files {
+		err = retry(ctx, opts.Retry, fmt.Sprintf("download %s", fileURL), func() error {
+			data, err := g.Get(fileURL)
+			if err != nil {
+				return err
+			}
+			return errors.WithStack(ioutil.WriteFile(file, data.Bytes(), 0644))
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to download %s", fileURL)
+		}
+	}
+
+	cv, err := chartURLVersion(tmpFile)
+	if err != nil {
+		return "", err
+	}
+	cacheFile, err := cacheFilePath(chartURL, cv, cacheDir)
+	if err != nil {
+		return "", errors.Wrap(err, "derive chart cache file")
+	}
+	err = downloadToCache(ctx, filepath.Dir(cacheFile), func(destDir string) error {
+		for _, file := range files {
+			if err := os.Rename(file, filepath.Join(destDir, filepath.Base(file))); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return cacheFile, nil
+}
+
+// fetchChartURLProvenance downloads the provenance file of a cached chart archive that has been downloaded without it.
+// Returns an error that satisfies isNotExist if the cached archive has been removed meanwhile.
+func fetchChartURLProvenance(ctx context.Context, cfg *config.LoaderConfig, cacheFile string, entry *repo.Entry, opts *repositoryOptions, getters getter.Providers) error {
+	chartURL := cfg.Chart
+	provFile := cacheFile + provenanceFileSuffix
+	if _, err := os.Stat(provFile); err == nil {
+		return nil
+	}
+	if cfg.Offline {
+		return newNotCachedError(fmt.Sprintf("provenance file of chart %s", chartURL))
+	}
+	downloadURL := opts.Mirrors.Rewrite(chartURL) + provenanceFileSuffix
+	log.Printf("Downloading provenance file %s of cached chart %s", downloadURL, chartURL)
+	g, err := chartURLGetter(ctx, downloadURL, entry, opts, getters)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(cacheFile)
+	unlock, err := lockPath(ctx, dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err = os.Stat(cacheFile); err != nil {
+		return errors.WithStack(err)
+	}
+	var data *bytes.Buffer
+	err = retry(ctx, opts.Retry, fmt.Sprintf("download %s", downloadURL), func() (err error) {
+		data, err = g.Get(downloadURL)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to download %s", downloadURL)
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-prov-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data.Bytes())
+	if e := tmpFile.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpFile.Name(), provFile))
+}
+
+// chartURLGetter returns a getter for the given URL that uses the repository entry's credentials and TLS settings
+func chartURLGetter(ctx context.Context, downloadURL string, entry *repo.Entry, opts *repositoryOptions, getters getter.Providers) (getter.Getter, error) {
+	_, identityToken, err := setCredentials(ctx, entry, downloadURL, opts.CredentialHelper)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse chart URL %q", downloadURL)
+	}
+	if identityToken != "" {
+		getters = identityTokenGetters(getters, map[string]string{downloadURL: identityToken})
+	}
+	newGetter, err := getters.ByScheme(u.Scheme)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	g, err := newGetter(downloadURL, entry.CertFile, entry.KeyFile, entry.CAFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if httpGetter, ok := g.(*getter.HttpGetter); ok {
+		httpGetter.SetCredentials(entry.Username, entry.Password)
+	}
+	return g, nil
+}
+
+// chartURLVersion returns the name, version and digest of the given chart archive
+func chartURLVersion(file string) (*repo.ChartVersion, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return chartArchiveVersion(&cachedChartArchive{File: file, Data: data})
+}
+
+// chartArchiveVersion returns the name, version and digest of the given chart archive
+func chartArchiveVersion(archive *cachedChartArchive) (*repo.ChartVersion, error) {
+	ch, err := loadChartArchiveData(archive.Data, archive.File)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := provenance.Digest(bytes.NewReader(archive.Data))
+	if err != nil {
+		return nil, errors.Wrap(err, "compute chart digest")
+	}
+	return &repo.ChartVersion{Metadata: ch.Metadata, Digest: digest}, nil
+}
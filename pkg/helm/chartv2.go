@@ -0,0 +1,373 @@
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/ignore"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/resolver"
+	"k8s.io/helm/pkg/sympath"
+)
+
+const (
+	chartAPIVersionV2        = "v2"
+	chartFileName            = "Chart.yaml"
+	chartLockFileName        = "Chart.lock"
+	requirementsFileName     = "requirements.yaml"
+	requirementsLockFileName = "requirements.lock"
+	localRepositoryPrefix    = "file://"
+)
+
+// loadChartPath loads the chart from the given directory or archive.
+// Unlike chartutil.Load it also supports charts (and subcharts) of apiVersion v2 (helm 3):
+// their Chart.yaml dependencies and Chart.lock are converted into a requirements.yaml and requirements.lock.
+func loadChartPath(chartPath string) (*chart.Chart, error) {
+	files, err := readChartFiles(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	files, _, err = convertChartV2Files(files)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load chart %s", chartPath)
+	}
+	return chartutil.LoadFiles(files)
+}
+
+// loadChartArchiveData loads the chart from the given archive data like loadChartPath does
+func loadChartArchiveData(data []byte, name string) (*chart.Chart, error) {
+	files, err := readChartArchiveFiles(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read chart archive %s", name)
+	}
+	files, _, err = convertChartV2Files(files)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load chart %s", name)
+	}
+	return chartutil.LoadFiles(files)
+}
+
+// readChartFiles reads the files of the given chart directory or archive
+func readChartFiles(chartPath string) ([]*chartutil.BufferedFile, error) {
+	fi, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		if isChart, err := chartutil.IsChartDir(chartPath); !isChart {
+			return nil, err
+		}
+		return readChartDirFiles(chartPath)
+	}
+	f, err := os.Open(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files, err := readChartArchiveFiles(f)
+	return files, errors.Wrapf(err, "read chart archive %s", chartPath)
+}
+
+// readChartDirFiles reads the files of the given chart directory respecting its .helmignore file
+func readChartDirFiles(dir string) ([]*chartutil.BufferedFile, error) {
+	topDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rules := ignore.Empty()
+	ignoreFile := filepath.Join(topDir, ignore.HelmIgnore)
+	if _, err = os.Stat(ignoreFile); err == nil {
+		if rules, err = ignore.ParseFile(ignoreFile); err != nil {
+			return nil, errors.Wrapf(err, "read %s", ignoreFile)
+		}
+	}
+	rules.AddDefaults()
+	topDir += string(filepath.Separator)
+	files := []*chartutil.BufferedFile{}
+	err = sympath.Walk(topDir, func(name string, fi os.FileInfo, err error) error {
+		n := filepath.ToSlash(strings.TrimPrefix(name, topDir))
+		if n == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if rules.Ignore(n, fi) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rules.Ignore(n, fi) {
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return errors.Errorf("cannot load irregular file %s as it has file mode type bits set", name)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, &chartutil.BufferedFile{Name: n, Data: data})
+		return nil
+	})
+	return files, errors.WithStack(err)
+}
+
+// readChartArchiveFiles reads the files of a chart archive, removing the chart's root directory from their names
+func readChartArchiveFiles(r io.Reader) ([]*chartutil.BufferedFile, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	files := []*chartutil.BufferedFile{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		name := strings.ReplaceAll(hdr.Name, "\\", "/")
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[i+1:]
+		} else if name == chartFileName {
+			return nil, errors.New("chart yaml not in base directory")
+		}
+		name = path.Clean(name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, errors.Errorf("chart archive contains illegal path %s", hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		files = append(files, &chartutil.BufferedFile{Name: name, Data: data})
+	}
+}
+
+// convertChartV2Files converts the files of a chart of apiVersion v2 and those of its subcharts
+// into the format helm 2 supports: Chart.yaml's apiVersion is set to v1 and
+// its dependencies and Chart.lock are converted into a requirements.yaml and requirements.lock.
+// Subchart archives that need to be converted are extracted into the charts directory.
+// Returns true if any file has been converted.
+func convertChartV2Files(files []*chartutil.BufferedFile) ([]*chartutil.BufferedFile, bool, error) {
+	converted := make([]*chartutil.BufferedFile, 0, len(files))
+	subcharts := map[string][]*chartutil.BufferedFile{}
+	subchartNames := []string{}
+	var chartFile, lockFile *chartutil.BufferedFile
+	for _, f := range files {
+		switch {
+		case f.Name == chartFileName:
+			chartFile = f
+		case f.Name == chartLockFileName:
+			lockFile = f
+		case strings.HasPrefix(f.Name, "charts/") && path.Ext(f.Name) != provenanceFileSuffix:
+			name := strings.SplitN(strings.TrimPrefix(f.Name, "charts/"), "/", 2)[0]
+			if strings.IndexAny(name, "._") == 0 {
+				converted = append(converted, f)
+				continue
+			}
+			if _, ok := subcharts[name]; !ok {
+				subchartNames = append(subchartNames, name)
+			}
+			subcharts[name] = append(subcharts[name], f)
+		default:
+			converted = append(converted, f)
+		}
+	}
+
+	// Convert subcharts
+	changed := false
+	for _, name := range subchartNames {
+		scFiles, err := subchartFiles(name, subcharts[name])
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "read subchart %s", name)
+		}
+		scFiles, scChanged, err := convertChartV2Files(scFiles)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "subchart %s", name)
+		}
+		if !scChanged {
+			converted = append(converted, subcharts[name]...)
+			continue
+		}
+		changed = true
+		dir := "charts/" + strings.TrimSuffix(name, ".tgz") + "/"
+		for _, f := range scFiles {
+			converted = append(converted, &chartutil.BufferedFile{Name: dir + f.Name, Data: f.Data})
+		}
+	}
+
+	// Convert the chart itself
+	if chartFile == nil {
+		if lockFile != nil {
+			converted = append(converted, lockFile)
+		}
+		return converted, changed, nil
+	}
+	var lockData []byte
+	if lockFile != nil {
+		lockData = lockFile.Data
+	}
+	metaFiles, isV2, err := convertChartV2Metadata(chartFile.Data, lockData)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isV2 {
+		converted = append(converted, chartFile)
+		if lockFile != nil {
+			converted = append(converted, lockFile)
+		}
+		return converted, changed, nil
+	}
+	generated := map[string]struct{}{}
+	for _, f := range metaFiles {
+		generated[f.Name] = struct{}{}
+	}
+	if _, ok := generated[requirementsFileName]; ok {
+		// A requirements.lock must not be used with the requirements.yaml generated from Chart.yaml
+		generated[requirementsLockFileName] = struct{}{}
+	}
+	result := make([]*chartutil.BufferedFile, 0, len(converted)+len(metaFiles))
+	for _, f := range converted {
+		if _, ok := generated[f.Name]; !ok {
+			result = append(result, f)
+		}
+	}
+	return append(result, metaFiles...), true, nil
+}
+
+// subchartFiles returns the files of a subchart with their names relative to the subchart
+func subchartFiles(name string, files []*chartutil.BufferedFile) ([]*chartutil.BufferedFile, error) {
+	if path.Ext(name) == ".tgz" {
+		if len(files) != 1 || files[0].Name != "charts/"+name {
+			return nil, errors.Errorf("unexpected file %s within charts directory", files[0].Name)
+		}
+		return readChartArchiveFiles(bytes.NewReader(files[0].Data))
+	}
+	prefix := "charts/" + name + "/"
+	scFiles := make([]*chartutil.BufferedFile, 0, len(files))
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, prefix) {
+			scFiles = append(scFiles, &chartutil.BufferedFile{Name: strings.TrimPrefix(f.Name, prefix), Data: f.Data})
+		}
+	}
+	return scFiles, nil
+}
+
+// convertChartV2Metadata returns the converted Chart.yaml, requirements.yaml and requirements.lock
+// if the given Chart.yaml specifies apiVersion v2.
+// The requirements.lock is only considered in sync when the Chart.lock digest matches the dependencies.
+func convertChartV2Metadata(chartYAML, chartLock []byte) ([]*chartutil.BufferedFile, bool, error) {
+	var meta map[string]interface{}
+	if err := yaml.Unmarshal(chartYAML, &meta); err != nil {
+		return nil, false, errors.Wrapf(err, "read %s", chartFileName)
+	}
+	if meta["apiVersion"] != chartAPIVersionV2 {
+		return nil, false, nil
+	}
+	req := &chartutil.Requirements{}
+	if err := yaml.Unmarshal(chartYAML, req); err != nil {
+		return nil, false, errors.Wrapf(err, "read %s dependencies", chartFileName)
+	}
+	meta["apiVersion"] = chartutil.ApiVersionV1
+	delete(meta, "dependencies")
+	chartYAML, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	files := []*chartutil.BufferedFile{{Name: chartFileName, Data: chartYAML}}
+	if len(req.Dependencies) == 0 {
+		return files, true, nil
+	}
+	reqYAML, err := yaml.Marshal(req)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	files = append(files, &chartutil.BufferedFile{Name: requirementsFileName, Data: reqYAML})
+	if chartLock == nil {
+		return files, true, nil
+	}
+	lock := &chartutil.RequirementsLock{}
+	if err = yaml.Unmarshal(chartLock, lock); err != nil {
+		return nil, false, errors.Wrapf(err, "read %s", chartLockFileName)
+	}
+	if sum, err := chartV2LockDigest(req.Dependencies, lock.Dependencies); err == nil && sum == lock.Digest {
+		// Replace the helm 3 digest with the one helm 2 expects
+		if lock.Digest, err = resolver.HashReq(req); err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+	}
+	lockYAML, err := yaml.Marshal(lock)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	files = append(files, &chartutil.BufferedFile{Name: requirementsLockFileName, Data: lockYAML})
+	return files, true, nil
+}
+
+// isChartAPIVersionV2 returns true if the Chart.yaml within the given chart directory specifies apiVersion v2
+func isChartAPIVersionV2(chartDir string) (bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(chartDir, chartFileName))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	var meta struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err = yaml.Unmarshal(b, &meta); err != nil {
+		return false, errors.Wrapf(err, "read %s", chartFileName)
+	}
+	return meta.APIVersion == chartAPIVersionV2, nil
+}
+
+// chartV2LockDigest calculates the digest of a Chart.lock the way helm 3 does
+func chartV2LockDigest(deps, locked []*chartutil.Dependency) (string, error) {
+	b, err := json.Marshal([2][]*chartutil.Dependency{deps, locked})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b)), nil
+}
+
+// writeConvertedChart writes the given chart directory's files into another directory converting them into the helm 2 format
+func writeConvertedChart(srcDir, destDir string) error {
+	files, err := readChartFiles(srcDir)
+	if err != nil {
+		return err
+	}
+	files, _, err = convertChartV2Files(files)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		file := filepath.Join(destDir, filepath.FromSlash(f.Name))
+		if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = ioutil.WriteFile(file, f.Data, 0644); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
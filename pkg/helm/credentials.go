@@ -0,0 +1,116 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/repo"
+)
+
+const (
+	envRepoCredentialsPrefix      = "KHELM_REPO_"
+	envRepoUsernameSuffix         = "_USERNAME"
+	envRepoPasswordSuffix         = "_PASSWORD"
+	credentialHelperNotFoundError = "credentials not found"
+	// identityTokenUsername is the username a credential helper returns along with an identity token as secret
+	identityTokenUsername = "<token>"
+)
+
+var nonAlphanumericRegex = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// credentialHelperOutput is the output of a docker-compatible credential helper's get command
+type credentialHelperOutput struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// setCredentials sets the credentials of the given repository entry when it does not specify any.
+// The credentials are looked up within the environment variables first and the credential helper (if any) afterwards.
+// The given URL is the one the repository is accessed with (which may be a mirror's URL).
+// Returns true if credentials have been set.
+// An identity token the credential helper returns is not set on the entry but returned
+// since it must be sent as bearer token (see identityTokenGetters).
+func setCredentials(ctx context.Context, entry *repo.Entry, repoURL, credentialHelper string) (set bool, identityToken string, err error) {
+	if entry.Username != "" || entry.Password != "" {
+		return false, "", nil
+	}
+	username, password, found := envCredentials(repoURL)
+	if !found && credentialHelper != "" {
+		username, password, found, err = helperCredentials(ctx, repoURL, credentialHelper)
+		if err != nil {
+			return false, "", err
+		}
+		if found && username == identityTokenUsername {
+			return false, password, nil
+		}
+	}
+	if !found {
+		return false, "", nil
+	}
+	entry.Username = username
+	entry.Password = password
+	return true, "", nil
+}
+
+// envCredentials looks up the credentials of the given repository URL within the environment variables
+// KHELM_REPO_<KEY>_USERNAME and KHELM_REPO_<KEY>_PASSWORD.
+// The key is derived from the URL's host and path, e.g. CHARTS_EXAMPLE_ORG_STABLE for https://charts.example.org/stable.
+// When no variable is set for the URL its parent paths are looked up.
+func envCredentials(repoURL string) (username, password string, found bool) {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return "", "", false
+	}
+	for p := path.Clean("/" + u.Path); ; p = path.Dir(p) {
+		key := credentialsEnvKey(u.Host + p)
+		username, hasUsername := os.LookupEnv(envRepoCredentialsPrefix + key + envRepoUsernameSuffix)
+		password, hasPassword := os.LookupEnv(envRepoCredentialsPrefix + key + envRepoPasswordSuffix)
+		if hasUsername || hasPassword {
+			return username, password, true
+		}
+		if p == "/" {
+			return "", "", false
+		}
+	}
+}
+
+// credentialsEnvKey maps the given host and path to an environment variable name segment
+func credentialsEnvKey(hostPath string) string {
+	return strings.Trim(nonAlphanumericRegex.ReplaceAllString(strings.ToUpper(hostPath), "_"), "_")
+}
+
+// helperCredentials obtains the credentials of the given repository URL from a docker-compatible credential helper.
+// The helper is called with the argument get and the URL on stdin and must print a JSON object with the Username and Secret on stdout.
+func helperCredentials(ctx context.Context, repoURL, credentialHelper string) (username, password string, found bool, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, credentialHelper, "get")
+	cmd.Stdin = strings.NewReader(repoURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if _, isExitErr := err.(*exec.ExitError); isExitErr && strings.Contains(stdout.String(), credentialHelperNotFoundError) {
+			return "", "", false, nil
+		}
+		msg := strings.TrimSpace(stderr.String() + stdout.String())
+		if msg != "" {
+			err = errors.Errorf("%s: %s", err, msg)
+		}
+		return "", "", false, errors.Wrapf(err, "get credentials for %s from credential helper %s", repoURL, credentialHelper)
+	}
+	var creds credentialHelperOutput
+	if err = json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", false, errors.Wrapf(err, "read credentials for %s from credential helper %s", repoURL, credentialHelper)
+	}
+	if creds.Username == "" && creds.Secret == "" {
+		return "", "", false, nil
+	}
+	return creds.Username, creds.Secret, true, nil
+}
@@ -0,0 +1,374 @@
+package helm
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/getter"
+	cli "k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+	"k8s.io/helm/pkg/renderutil"
+	"k8s.io/helm/pkg/resolver"
+)
+
+// UpdateDependencies resolves the latest versions of a local chart's dependencies (and of its local dependencies recursively)
+// that match their constraints, downloads them into the chart's charts directory and writes its lock file (requirements.lock or Chart.lock).
+// In contrast to rendering a chart this modifies the chart directories.
+func (h *Helm) UpdateDependencies(ctx context.Context, cfg *config.ChartConfig) error {
+	return h.writeDependencies(ctx, cfg, true)
+}
+
+// BuildDependencies downloads the dependencies listed within a local chart's lock file (and the ones of its local dependencies recursively)
+// into the chart's charts directory.
+// The dependencies of a chart without lock file are resolved and its lock file is written.
+// In contrast to rendering a chart this modifies the chart directories.
+func (h *Helm) BuildDependencies(ctx context.Context, cfg *config.ChartConfig) error {
+	return h.writeDependencies(ctx, cfg, false)
+}
+
+func (h *Helm) writeDependencies(ctx context.Context, cfg *config.ChartConfig, update bool) (err error) {
+	if cfg.BaseDir, err = absBaseDir(cfg.BaseDir); err != nil {
+		return err
+	}
+	chartPath := absPath(cfg.Chart, cfg.BaseDir)
+	if fi, e := os.Stat(chartPath); cfg.Repository != "" || e != nil || !fi.IsDir() {
+		return errors.Errorf("chart %s is not a local chart directory", cfg.Chart)
+	}
+	depCfg := *cfg
+	depCfg.Refresh = cfg.Refresh || update
+	localCharts, repos, unlock, err := h.prepareLocalCharts(ctx, &depCfg, chartPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer repos.Close()
+	settings := h.Settings
+	settings.Home = repos.HelmHome()
+	if update {
+		for i := range localCharts {
+			localCharts[i].RequirementsLock = nil
+		}
+	}
+	overlayDir, err := ioutil.TempDir("", "khelm-chart-build-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(overlayDir)
+	_, err = buildLocalCharts(ctx, localCharts, overlayDir, &depCfg.LoaderConfig, nil, repos, &settings, h.getters(cfg), true)
+	return errors.Wrapf(err, "chart %s", cfg.Chart)
+}
+
+// chartValues returns the values of the given chart coalesced with the given values
+func chartValues(ch *chart.Chart, values chartutil.Values) (chartutil.Values, error) {
+	y, err := values.YAML()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cvals, err := chartutil.CoalesceValues(ch, &chart.Config{Raw: y})
+	return cvals, errors.Wrap(err, "coalesce values")
+}
+
+// subchartValues returns the values the parent chart's values specify for the given dependency
+func subchartValues(cvals chartutil.Values, dep *chartutil.Dependency) chartutil.Values {
+	key := dep.Name
+	if dep.Alias != "" {
+		key = dep.Alias
+	}
+	values, err := cvals.Table(key)
+	if err != nil {
+		return chartutil.Values{}
+	}
+	return values
+}
+
+// disabledDependencies evaluates the conditions and tags of the given dependencies the same way helm does when rendering a chart.
+// Conditions are evaluated against the chart's coalesced values, tags against the ones of the requested chart.
+// The returned list specifies for each dependency whether it is disabled.
+func disabledDependencies(deps []*chartutil.Dependency, cvals, topValues chartutil.Values) []bool {
+	// Copy the dependencies since helm modifies them and the Enabled field changes their digest
+	req := &chartutil.Requirements{Dependencies: copyDependencies(deps)}
+	for _, d := range req.Dependencies {
+		d.Enabled = true
+	}
+	chartutil.ProcessRequirementsTags(req, topValues)
+	chartutil.ProcessRequirementsConditions(req, cvals, "")
+	disabled := make([]bool, len(deps))
+	for i, d := range req.Dependencies {
+		disabled[i] = !d.Enabled
+	}
+	return disabled
+}
+
+// removeMissingDisabledDependencies removes the dependencies that are disabled by the given values
+// and missing within the charts directory from the chart's requirements
+// since helm refuses to render a chart with missing dependencies.
+func removeMissingDisabledDependencies(ch *chart.Chart, values *chart.Config) error {
+	req, err := chartutil.LoadRequirements(ch)
+	if err != nil || renderutil.CheckDependencies(ch, req) == nil {
+		return nil
+	}
+	cvals, err := chartutil.CoalesceValues(ch, values)
+	if err != nil {
+		return errors.Wrap(err, "coalesce values")
+	}
+	disabled := disabledDependencies(req.Dependencies, cvals, cvals)
+	deps := make([]*chartutil.Dependency, 0, len(req.Dependencies))
+	for i, d := range req.Dependencies {
+		if !disabled[i] || renderutil.CheckDependencies(ch, &chartutil.Requirements{Dependencies: []*chartutil.Dependency{d}}) == nil {
+			deps = append(deps, d)
+		}
+	}
+	b, err := yaml.Marshal(&chartutil.Requirements{Dependencies: deps})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, f := range ch.Files {
+		if f.TypeUrl == requirementsFileName {
+			f.Value = b
+		}
+	}
+	return nil
+}
+
+// enabledDependencies returns the given requirements' (or lock's) dependencies without the ones that are disabled
+func (ch *localChart) enabledDependencies(deps []*chartutil.Dependency) []*chartutil.Dependency {
+	if !ch.hasDisabledDependencies() || len(deps) != len(ch.Disabled) {
+		return deps
+	}
+	enabled := make([]*chartutil.Dependency, 0, len(deps))
+	for i, d := range deps {
+		if !ch.Disabled[i] {
+			enabled = append(enabled, d)
+		}
+	}
+	return enabled
+}
+
+func (ch *localChart) hasDisabledDependencies() bool {
+	for _, disabled := range ch.Disabled {
+		if disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// buildChartOverlay builds the dependencies of a local chart that has been copied into an overlay directory.
+// Within the overlay directory the chart's requirements are reduced to the enabled dependencies
+// and its local dependencies refer to the overlay directories of their built copies.
+// Without a requirements.lock one is derived from the fetched dependencies
+// to prevent Helm from resolving the versions again.
+func buildChartOverlay(ctx context.Context, ch localChart, overlayDir string, builtCharts map[string]string, fetched []*fetchedDependency, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) error {
+	req := &chartutil.Requirements{Dependencies: copyDependencies(ch.enabledDependencies(ch.Requirements.Dependencies))}
+	var lock *chartutil.RequirementsLock
+	if ch.RequirementsLock != nil {
+		lock = &chartutil.RequirementsLock{
+			Generated:    ch.RequirementsLock.Generated,
+			Dependencies: copyDependencies(ch.enabledDependencies(ch.RequirementsLock.Dependencies)),
+		}
+	} else {
+		var err error
+		if lock, err = resolvedRequirementsLock(ch, req.Dependencies, fetched, builtCharts); err != nil {
+			return err
+		}
+	}
+	for _, d := range req.Dependencies {
+		if !strings.HasPrefix(d.Repository, localRepositoryPrefix) {
+			continue
+		}
+		origRepo := d.Repository
+		depPath := absPath(strings.TrimPrefix(origRepo, localRepositoryPrefix), ch.Path)
+		builtPath, ok := builtCharts[depPath]
+		if !ok {
+			return errors.Errorf("dependency %s has not been built", d.Name)
+		}
+		localRepo := localRepositoryPrefix + filepath.ToSlash(builtPath)
+		setDependencyRepository(req.Dependencies, origRepo, localRepo)
+		if lock != nil {
+			setDependencyRepository(lock.Dependencies, origRepo, localRepo)
+		}
+	}
+	lockFile := filepath.Join(overlayDir, requirementsLockFileName)
+	if lock != nil {
+		var err error
+		if lock.Digest, err = resolver.HashReq(req); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = writeYAMLFile(lockFile, lock); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(lockFile); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeYAMLFile(filepath.Join(overlayDir, requirementsFileName), req); err != nil {
+		return err
+	}
+	err := buildChartDependencies(ctx, overlayDir, cfg, repos, settings, cachedChartGetters(getters, fetchedArchives(fetched)))
+	if err != nil {
+		return err
+	}
+	return verifyBuiltDependencies(overlayDir, fetched)
+}
+
+// resolvedRequirementsLock returns a lock that pins the given dependencies to the fetched remote
+// and the built local dependency versions or nil if not every dependency's version is known.
+func resolvedRequirementsLock(ch localChart, deps []*chartutil.Dependency, fetched []*fetchedDependency, builtCharts map[string]string) (*chartutil.RequirementsLock, error) {
+	if len(deps) != len(fetched) {
+		return nil, nil
+	}
+	lock := &chartutil.RequirementsLock{
+		Generated:    time.Now(),
+		Dependencies: make([]*chartutil.Dependency, len(deps)),
+	}
+	for i, d := range deps {
+		version := ""
+		switch {
+		case fetched[i] != nil:
+			version = fetched[i].Version
+		case strings.HasPrefix(d.Repository, localRepositoryPrefix):
+			depPath := absPath(strings.TrimPrefix(d.Repository, localRepositoryPrefix), ch.Path)
+			builtPath, ok := builtCharts[depPath]
+			if !ok {
+				return nil, errors.Errorf("dependency %s has not been built", d.Name)
+			}
+			meta, err := chartutil.LoadChartfile(filepath.Join(builtPath, chartFileName))
+			if err != nil {
+				return nil, errors.Wrapf(err, "load dependency %s", d.Name)
+			}
+			version = meta.Version
+		default:
+			return nil, nil
+		}
+		lock.Dependencies[i] = &chartutil.Dependency{Name: d.Name, Version: version, Repository: d.Repository}
+	}
+	return lock, nil
+}
+
+// verifyBuiltDependencies fails if one of the fetched dependencies' archives is not among the built chart's dependencies
+// which ensures that the archives Helm put into the charts directory have been verified when fetching them.
+func verifyBuiltDependencies(chartDir string, fetched []*fetchedDependency) error {
+	archives, err := filepath.Glob(filepath.Join(chartDir, "charts", "*.tgz"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	digests := make(map[string]bool, len(archives))
+	for _, file := range archives {
+		digest, err := provenance.DigestFile(file)
+		if err != nil {
+			return errors.Wrap(err, "compute dependency digest")
+		}
+		digests[digest] = true
+	}
+	for _, d := range fetched {
+		if d != nil && !digests[d.Digest] {
+			return errors.Errorf("built dependencies do not contain the fetched chart %s (digest %s)", d.URL, d.Digest)
+		}
+	}
+	return nil
+}
+
+// writeBackDependencies replaces the chart's charts directory with the one that has been built within the overlay directory.
+// Unless the chart's lock file has been used to build the dependencies the resolved lock file is written as well
+// with local dependencies referring to their source directories.
+func writeBackDependencies(ch localChart, builtDir string) error {
+	chartsDir := filepath.Join(ch.Path, "charts")
+	if err := os.RemoveAll(chartsDir); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := copyDir(filepath.Join(builtDir, "charts"), chartsDir); err != nil {
+		return err
+	}
+	if ch.RequirementsLock != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(builtDir, requirementsLockFileName))
+	if err != nil {
+		return errors.Wrap(err, "read resolved lock file")
+	}
+	lock := &chartutil.RequirementsLock{}
+	if err = yaml.Unmarshal(b, lock); err != nil {
+		return errors.Wrap(err, "read resolved lock file")
+	}
+	for _, d := range lock.Dependencies {
+		if !strings.HasPrefix(d.Repository, localRepositoryPrefix) {
+			continue
+		}
+		for _, req := range ch.Requirements.Dependencies {
+			if req.Name == d.Name {
+				d.Repository = req.Repository
+			}
+		}
+	}
+	lockFile := requirementsLockFileName
+	if ch.APIVersionV2 {
+		lockFile = chartLockFileName
+		lock.Digest, err = chartV2LockDigest(ch.Requirements.Dependencies, lock.Dependencies)
+	} else {
+		lock.Digest, err = resolver.HashReq(ch.Requirements)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("Writing %s", filepath.Join(ch.Path, lockFile))
+	return writeYAMLFile(filepath.Join(ch.Path, lockFile), lock)
+}
+
+func copyDependencies(deps []*chartutil.Dependency) []*chartutil.Dependency {
+	c := make([]*chartutil.Dependency, len(deps))
+	for i, d := range deps {
+		dep := *d
+		c[i] = &dep
+	}
+	return c
+}
+
+func setDependencyRepository(deps []*chartutil.Dependency, oldRepo, newRepo string) {
+	for _, d := range deps {
+		if d.Repository == oldRepo {
+			d.Repository = newRepo
+		}
+	}
+}
+
+func writeYAMLFile(file string, obj interface{}) error {
+	b, err := yaml.Marshal(obj)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, b, 0644))
+}
+
+// copyDir copies the regular files of the given directory recursively into another directory
+func copyDir(srcDir, destDir string) error {
+	return filepath.Walk(srcDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rel, err := filepath.Rel(srcDir, file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dest := filepath.Join(destDir, rel)
+		if fi.IsDir() {
+			return errors.WithStack(os.MkdirAll(dest, 0755))
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(ioutil.WriteFile(dest, b, fi.Mode().Perm()))
+	})
+}
@@ -0,0 +1,174 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/helm/helmpath"
+)
+
+const fileLockPollInterval = 100 * time.Millisecond
+
+// lockPath acquires an exclusive lock for the given file or directory path that is shared between processes.
+// The lock is held using a hidden file next to the path.
+// The returned function releases the lock.
+func lockPath(ctx context.Context, path string) (func(), error) {
+	return acquireFileLock(ctx, pathLockFile(path))
+}
+
+// pathLockFile returns the hidden lock file that is used to lock the given path
+func pathLockFile(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.lock", filepath.Base(path)))
+}
+
+// chartDirLockDir returns the directory that contains the lock files of the local chart directories
+func chartDirLockDir(home helmpath.Home) string {
+	return filepath.Join(home.String(), "cache", "khelm-locks")
+}
+
+// lockChartDirs acquires exclusive locks for the given local chart directories in a consistent order.
+// In order to not pollute the chart source directories the lock files are kept within the helm home directory.
+// The returned function releases the locks.
+func lockChartDirs(ctx context.Context, home helmpath.Home, chartPaths []string) (func(), error) {
+	lockDir := chartDirLockDir(home)
+	if err := os.MkdirAll(lockDir, 0750); err != nil {
+		if isReadOnly(err) {
+			// Allow to render charts using a read-only cache (offline)
+			log.Printf("WARNING: not locking chart directories since %s is not writeable", lockDir)
+			return func() {}, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	lockFiles := make([]string, 0, len(chartPaths))
+	seen := map[string]struct{}{}
+	for _, chartPath := range chartPaths {
+		realPath, err := filepath.EvalSymlinks(chartPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		key, err := urlToHash(realPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			lockFiles = append(lockFiles, filepath.Join(lockDir, fmt.Sprintf("chart-%s.lock", key)))
+		}
+	}
+	// Acquire the locks in the same order in all processes to avoid deadlocks
+	sort.Strings(lockFiles)
+	unlockFns := make([]func(), 0, len(lockFiles))
+	unlock := func() {
+		for i := len(unlockFns) - 1; i >= 0; i-- {
+			unlockFns[i]()
+		}
+	}
+	for _, file := range lockFiles {
+		unlockFn, err := acquireFileLock(ctx, file)
+		if err != nil {
+			unlock()
+			if isReadOnly(err) {
+				log.Printf("WARNING: not locking chart directories since %s is not writeable", lockDir)
+				return func() {}, nil
+			}
+			return nil, errors.Wrap(err, "lock chart directory")
+		}
+		unlockFns = append(unlockFns, unlockFn)
+		// Mark the lock file as used to keep it from being pruned (best effort)
+		now := time.Now()
+		_ = os.Chtimes(file, now, now)
+	}
+	return unlock, nil
+}
+
+// acquireFileLock waits until the exclusive lock for the given file has been acquired or the context is done.
+// Since the lock file may be removed by its holder (when pruning the cache)
+// the lock is acquired again if the locked file is not the one at the given path anymore.
+func acquireFileLock(ctx context.Context, lockFile string) (func(), error) {
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "open lock file")
+	}
+	unlock := func() {
+		_ = f.Close() // releases the lock
+	}
+	waiting := false
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			unlock()
+			return nil, errors.Wrapf(err, "lock %s", lockFile)
+		}
+		if locked {
+			if isLockFile(f, lockFile) {
+				return unlock, nil
+			}
+			unlock()
+			if f, err = os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0640); err != nil {
+				return nil, errors.Wrap(err, "open lock file")
+			}
+			continue
+		}
+		if !waiting {
+			waiting = true
+			log.Printf("Waiting for lock %s held by another process", lockFile)
+		}
+		select {
+		case <-ctx.Done():
+			unlock()
+			return nil, errors.Wrapf(ctx.Err(), "wait for lock %s", lockFile)
+		case <-time.After(fileLockPollInterval):
+		}
+	}
+}
+
+// isLockFile returns true if the given open file is (still) the file at the given path
+func isLockFile(f *os.File, lockFile string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(lockFile)
+	return err == nil && os.SameFile(fi, current)
+}
+
+// removeUnusedLockFile removes the given lock file unless it is held by another process.
+// Returns false if the lock file is in use.
+func removeUnusedLockFile(lockFile string) (bool, error) {
+	f, err := os.OpenFile(lockFile, os.O_RDWR, 0640)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, errors.Wrap(err, "open lock file")
+	}
+	defer f.Close()
+	locked, err := tryLockFile(f)
+	if err != nil || !locked {
+		return false, errors.Wrapf(err, "lock %s", lockFile)
+	}
+	if !isLockFile(f, lockFile) {
+		return true, nil // removed concurrently
+	}
+	return true, removeLockFile(lockFile)
+}
+
+// removeLockFile removes the lock file the caller holds.
+// Processes that wait for the lock acquire it again using a new lock file afterwards.
+func removeLockFile(lockFile string) error {
+	if err := os.Remove(lockFile); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func isReadOnly(err error) bool {
+	return os.IsPermission(err) || errors.Is(err, syscall.EROFS)
+}
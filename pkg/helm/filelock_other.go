@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package helm
+
+import "os"
+
+// tryLockFile is a no-op on platforms that don't support flock.
+// Concurrent khelm processes are not synchronized there.
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
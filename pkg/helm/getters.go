@@ -0,0 +1,60 @@
+package helm
+
+import (
+	"bytes"
+	"log"
+	"strings"
+
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/urlutil"
+)
+
+const provenanceFileSuffix = ".prov"
+
+// cachedChartGetters returns getters that serve the given chart URLs (and their provenance files) from the corresponding archives
+// that have been read from the cache.
+// Requests to other URLs are delegated to the original getters.
+func cachedChartGetters(providers getter.Providers, archives map[string]*cachedChartArchive) getter.Providers {
+	if len(archives) == 0 {
+		return providers
+	}
+	cached := make(getter.Providers, len(providers))
+	for i, p := range providers {
+		newGetter := p.New
+		cached[i] = getter.Provider{
+			Schemes: p.Schemes,
+			New: func(u, certFile, keyFile, caFile string) (getter.Getter, error) {
+				g, err := newGetter(u, certFile, keyFile, caFile)
+				if err != nil {
+					return nil, err
+				}
+				return &cachedChartGetter{Getter: g, archives: archives}, nil
+			},
+		}
+	}
+	return cached
+}
+
+type cachedChartGetter struct {
+	getter.Getter
+	archives map[string]*cachedChartArchive
+}
+
+func (g *cachedChartGetter) Get(u string) (*bytes.Buffer, error) {
+	isProvenance := strings.HasSuffix(u, provenanceFileSuffix)
+	chartURL := strings.TrimSuffix(u, provenanceFileSuffix)
+	for archiveURL, archive := range g.archives {
+		if !urlutil.Equal(archiveURL, chartURL) {
+			continue
+		}
+		data := archive.Data
+		if isProvenance {
+			data = archive.Provenance
+		}
+		if data != nil {
+			log.Printf("Using %s from cache at %s", u, archive.File)
+			return bytes.NewBuffer(data), nil
+		}
+	}
+	return g.Getter.Get(u)
+}
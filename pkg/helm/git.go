@@ -0,0 +1,204 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	cli "k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/helm/helmpath"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+const gitSchemePrefix = "git+"
+
+var commitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// isGitRepository returns true if the given repository refers to a git repository
+func isGitRepository(repository string) bool {
+	return strings.HasPrefix(repository, gitSchemePrefix)
+}
+
+// gitCacheDir returns the directory git repositories are cached within
+func gitCacheDir(home helmpath.Home) string {
+	return filepath.Join(home.String(), "cache", "khelm-git")
+}
+
+// checkoutGitChart checks out the chart from a git repository at the given ref if not present in cache and returns its path.
+// The repository's chart specifies the chart directory within the repository, its version the git ref (branch, tag or commit).
+// Refs other than commits are resolved using the cached repository unless it has been fetched longer than indexMaxAge ago.
+// The resolved commit is recorded within the lock file and a locked commit is used instead of resolving the ref.
+func checkoutGitChart(ctx context.Context, cfg *config.LoaderConfig, lock *lockFile, trustAnyRepo *bool, trustPolicy *TrustPolicy, settings *cli.EnvSettings) (string, error) {
+	repoURL := strings.TrimPrefix(cfg.Repository, gitSchemePrefix)
+	if repoURL == "" {
+		return "", errors.Errorf("no git URL specified within repository %q", cfg.Repository)
+	}
+	// Prevent the URL and ref from being interpreted as git options (e.g. --upload-pack)
+	if strings.HasPrefix(repoURL, "-") {
+		return "", errors.Errorf("invalid git URL %q within repository %q", repoURL, cfg.Repository)
+	}
+	if strings.HasPrefix(cfg.Version, "-") {
+		return "", errors.Errorf("invalid git ref %q", cfg.Version)
+	}
+	allowed, err := trustPolicy.check(cfg.Repository)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(settings.Home.RepositoryFile())
+	if !allowed && !isUnknownRepositoryTrusted(trustAnyRepo, err == nil, trustPolicy) {
+		err = errors.Errorf("usage of untrusted git repository %q is disabled", repoURL)
+		return "", &untrustedRepoError{err}
+	}
+	chartPath := filepath.Clean(filepath.FromSlash(cfg.Chart))
+	if filepath.IsAbs(chartPath) || chartPath == ".." || strings.HasPrefix(chartPath, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("chart path %q points outside the git repository", cfg.Chart)
+	}
+	urlHash, err := urlToHash(repoURL)
+	if err != nil {
+		return "", err
+	}
+	repoCacheDir := filepath.Join(gitCacheDir(settings.Home), urlHash)
+	ref := cfg.Version
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if locked := lock.Get(cfg.Repository, cfg.Chart, cfg.Version); locked != nil {
+		if !commitRegex.MatchString(locked.Version) {
+			return "", errors.Errorf("git repository %s ref %q is locked with invalid commit %q within %s", repoURL, ref, locked.Version, lock.path)
+		}
+		ref = locked.Version
+	}
+	maxAge := cfg.IndexMaxAge
+	if cfg.Refresh || lock != nil && lock.update {
+		maxAge = 0
+	}
+
+	// Clone or update the mirrored repository unless the commit is known already
+	mirrorDir := filepath.Join(repoCacheDir, "repo.git")
+	if cfg.Offline {
+		if _, err = os.Stat(mirrorDir); err != nil {
+			return "", newNotCachedError(fmt.Sprintf("git repository %s (%s)", repoURL, mirrorDir))
+		}
+	} else if _, err = os.Stat(mirrorDir); err != nil {
+		log.Printf("Cloning git repository %s", repoURL)
+		err = downloadToCache(ctx, mirrorDir, func(tmpDir string) error {
+			_, err := git(ctx, "", "clone", "--mirror", "--quiet", "--", repoURL, tmpDir)
+			return errors.Wrapf(err, "clone %s", repoURL)
+		})
+		if err != nil {
+			return "", err
+		}
+	} else if needsGitFetch(ctx, mirrorDir, ref, repoURL, maxAge) {
+		unlock, err := lockPath(ctx, mirrorDir)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("Fetching git repository %s", repoURL)
+		_, err = git(ctx, mirrorDir, "fetch", "--quiet", "--prune", "origin")
+		if err == nil {
+			// Record the fetch time for needsGitFetch
+			now := time.Now()
+			err = errors.WithStack(os.Chtimes(mirrorDir, now, now))
+		}
+		unlock()
+		if err != nil {
+			return "", errors.Wrapf(err, "fetch %s", repoURL)
+		}
+	}
+	commit, err := git(ctx, mirrorDir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		if cfg.Offline {
+			return "", newNotCachedError(fmt.Sprintf("git repository %s ref %q (%s)", repoURL, ref, mirrorDir))
+		}
+		return "", errors.Errorf("ref %q not found in git repository %s", ref, repoURL)
+	}
+	cv := &repo.ChartVersion{Metadata: &chart.Metadata{Name: cfg.Chart, Version: commit}, Digest: commit}
+	if err = lock.Lock(cfg.Repository, cfg.Version, cv, repoURL); err != nil {
+		return "", err
+	}
+
+	// Check out the commit
+	checkoutDir := filepath.Join(repoCacheDir, commit)
+	if _, err = os.Stat(checkoutDir); err == nil {
+		log.Printf("Using git repository %s commit %s from cache at %s", repoURL, commit, checkoutDir)
+	} else {
+		log.Printf("Checking out git repository %s commit %s", repoURL, commit)
+		err = downloadToCache(ctx, checkoutDir, func(tmpDir string) error {
+			if _, err := git(ctx, "", "clone", "--quiet", "--no-checkout", "--", mirrorDir, tmpDir); err != nil {
+				return errors.Wrapf(err, "clone %s", mirrorDir)
+			}
+			workTreeDir := filepath.Join(tmpDir, ".git")
+			if _, err := git(ctx, workTreeDir, "--work-tree", tmpDir, "checkout", "--quiet", "--detach", commit); err != nil {
+				return errors.Wrapf(err, "check out commit %s", commit)
+			}
+			return os.RemoveAll(workTreeDir)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	chartDir := filepath.Join(checkoutDir, chartPath)
+	if _, err = os.Stat(chartDir); err != nil {
+		return "", errors.Errorf("chart directory %q not found in git repository %s at ref %q", cfg.Chart, repoURL, ref)
+	}
+	return chartDir, nil
+}
+
+// needsGitFetch returns true if the mirrored repository must be fetched in order to resolve the given ref.
+// A commit is only fetched when it is missing, other refs when the last fetch is older than the given max age.
+func needsGitFetch(ctx context.Context, mirrorDir, ref, repoURL string, maxAge time.Duration) bool {
+	if commitRegex.MatchString(ref) {
+		return !hasGitCommit(ctx, mirrorDir, ref)
+	}
+	if maxAge <= 0 {
+		return true
+	}
+	fi, err := os.Stat(mirrorDir)
+	if err != nil {
+		return true
+	}
+	age := time.Since(fi.ModTime())
+	if age > maxAge || !hasGitCommit(ctx, mirrorDir, ref) {
+		return true
+	}
+	log.Printf("Using cached git repository %s fetched %s ago", repoURL, age.Round(time.Second))
+	return false
+}
+
+func hasGitCommit(ctx context.Context, gitDir, commit string) bool {
+	_, err := git(ctx, gitDir, "cat-file", "-e", commit+"^{commit}")
+	return err == nil
+}
+
+// git runs a git command (within the given git dir) and returns its trimmed output
+func git(ctx context.Context, gitDir string, args ...string) (string, error) {
+	cmdArgs := args
+	if gitDir != "" {
+		cmdArgs = append([]string{"--git-dir", gitDir}, args...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", cmdArgs...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.Errorf("git %s: %s", strings.Join(args, " "), msg)
+		}
+		return "", errors.Wrap(err, "git")
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -2,7 +2,9 @@ package helm
 
 import (
 	"os"
+	"path/filepath"
 
+	"k8s.io/client-go/util/homedir"
 	"k8s.io/helm/pkg/getter"
 	"k8s.io/helm/pkg/helm/environment"
 	"k8s.io/helm/pkg/helm/helmpath"
@@ -13,6 +15,16 @@ type Helm struct {
 	TrustAnyRepository *bool
 	Settings           environment.EnvSettings
 	Getters            getter.Providers
+	RegistryConfig     string
+	// Mirrors specifies the mirrors chart repositories are accessed with
+	Mirrors Mirrors
+	// CredentialHelper specifies a docker-compatible credential helper executable
+	// that provides the credentials of repositories that have none configured
+	CredentialHelper string
+	// TrustPolicy specifies the repositories that may be used in addition to (or in spite of) repositories.yaml
+	TrustPolicy *TrustPolicy
+	// Retry specifies how failed repository index and chart downloads are retried
+	Retry RetryOptions
 }
 
 // NewHelm creates a new helm environment
@@ -25,5 +37,16 @@ func NewHelm() *Helm {
 		Home: helmpath.Home(helmHome),
 	}}
 	h.Getters = getter.All(h.Settings)
+	h.RegistryConfig = defaultRegistryConfig()
+	h.Retry = DefaultRetryOptions()
 	return h
 }
+
+// defaultRegistryConfig returns the docker config file path that provides the OCI registry credentials
+func defaultRegistryConfig() string {
+	dockerConfigDir := os.Getenv("DOCKER_CONFIG")
+	if dockerConfigDir == "" {
+		dockerConfigDir = filepath.Join(homedir.HomeDir(), ".docker")
+	}
+	return filepath.Join(dockerConfigDir, dockerConfigFileName)
+}
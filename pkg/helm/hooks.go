@@ -0,0 +1,248 @@
+package helm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	annotationHelmHook             = "helm.sh/hook"
+	annotationHelmHookWeight       = "helm.sh/hook-weight"
+	annotationHelmHookDeletePolicy = "helm.sh/hook-delete-policy"
+	annotationArgoCDHook           = "argocd.argoproj.io/hook"
+	annotationArgoCDHookDelete     = "argocd.argoproj.io/hook-delete-policy"
+	annotationArgoCDSyncWave       = "argocd.argoproj.io/sync-wave"
+	annotationKptDependsOn         = "config.kubernetes.io/depends-on"
+)
+
+// hookPhase specifies when a hook is applied relative to the chart's regular resources
+type hookPhase int
+
+const (
+	hookPhaseNone hookPhase = iota
+	hookPhaseCRD
+	hookPhasePre
+	hookPhasePost
+)
+
+// argoCDCRDSyncWave is the sync wave of the CRDs that are installed using the crd-install hook.
+// A negative wave makes Argo CD apply them before the chart's other resources.
+const argoCDCRDSyncWave = "-1"
+
+var argoCDHookDeletePolicies = map[string]string{
+	"hook-succeeded":       "HookSucceeded",
+	"hook-failed":          "HookFailed",
+	"before-hook-creation": "BeforeHookCreation",
+}
+
+type hookResource struct {
+	*yaml.RNode
+	meta   yaml.ResourceMeta
+	phase  hookPhase
+	weight int
+}
+
+// convertHooks rewrites the chart hooks into the equivalents of the given mode.
+// Since only installation and upgrade hooks have an equivalent
+// delete, rollback and test hooks are removed.
+// The namespace is used to refer to namespaced resources that don't specify one
+// and should be empty unless the namespace is forced.
+func convertHooks(resources []*yaml.RNode, mode string, stripDeletePolicy bool, namespace string) ([]*yaml.RNode, error) {
+	if !convertsHooks(mode) && !stripDeletePolicy {
+		return resources, nil
+	}
+	r := make([]*hookResource, 0, len(resources))
+	var dropped []string
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		res := &hookResource{RNode: o, meta: meta}
+		if stripDeletePolicy {
+			if err = o.PipeE(yaml.ClearAnnotation(annotationHelmHookDeletePolicy)); err != nil {
+				return nil, err
+			}
+		}
+		hooks := meta.Annotations[annotationHelmHook]
+		if hooks == "" || !convertsHooks(mode) {
+			r = append(r, res)
+			continue
+		}
+		res.phase = parseHookPhase(hooks)
+		if res.phase == hookPhaseNone {
+			dropped = append(dropped, fmt.Sprintf("%s %s (%s)", meta.Kind, meta.Name, hooks))
+			continue
+		}
+		// Like Helm ignore invalid weights
+		res.weight, _ = strconv.Atoi(strings.TrimSpace(meta.Annotations[annotationHelmHookWeight]))
+		if err = o.PipeE(yaml.ClearAnnotation(annotationHelmHook)); err != nil {
+			return nil, err
+		}
+		if err = o.PipeE(yaml.ClearAnnotation(annotationHelmHookWeight)); err != nil {
+			return nil, err
+		}
+		if err = o.PipeE(yaml.ClearAnnotation(annotationHelmHookDeletePolicy)); err != nil {
+			return nil, err
+		}
+		r = append(r, res)
+	}
+	if len(dropped) > 0 {
+		log.Printf("WARNING: Removed the following hooks since they have no %s equivalent:\n * %s", mode, strings.Join(dropped, "\n * "))
+	}
+	var err error
+	switch mode {
+	case config.HookModeArgoCD:
+		err = setArgoCDHookAnnotations(r, stripDeletePolicy)
+	case config.HookModeKpt:
+		sortHooks(r)
+		err = setKptDependencies(r, namespace)
+	case config.HookModePlain:
+		sortHooks(r)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "convert hooks (%s)", mode)
+	}
+	converted := make([]*yaml.RNode, len(r))
+	for i, o := range r {
+		if err = yaml.ClearEmptyAnnotations(o.RNode); err != nil {
+			return nil, err
+		}
+		converted[i] = o.RNode
+	}
+	return converted, nil
+}
+
+// convertsHooks returns true if the given mode converts the hooks into another form
+func convertsHooks(mode string) bool {
+	return mode != "" && mode != config.HookModeKeep
+}
+
+// parseHookPhase maps the hooks of a resource to the phase it should be applied within
+func parseHookPhase(hooks string) (phase hookPhase) {
+	for _, hook := range strings.Split(hooks, ",") {
+		switch strings.TrimSpace(hook) {
+		case "crd-install":
+			return hookPhaseCRD
+		case "pre-install", "pre-upgrade":
+			phase = hookPhasePre
+		case "post-install", "post-upgrade":
+			if phase == hookPhaseNone {
+				phase = hookPhasePost
+			}
+		}
+	}
+	return
+}
+
+// sortHooks orders the resources by phase and the hooks within a phase by weight
+func sortHooks(r []*hookResource) {
+	sort.SliceStable(r, func(i, j int) bool {
+		if r[i].phase != r[j].phase {
+			return phaseOrder(r[i].phase) < phaseOrder(r[j].phase)
+		}
+		return r[i].weight < r[j].weight
+	})
+}
+
+func phaseOrder(p hookPhase) int {
+	switch p {
+	case hookPhaseCRD:
+		return 0
+	case hookPhasePre:
+		return 1
+	case hookPhaseNone:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// setArgoCDHookAnnotations maps the hooks to Argo CD hooks.
+// Since Argo CD has no CRD hook CRDs are converted into regular resources of a negative sync wave.
+func setArgoCDHookAnnotations(r []*hookResource, stripDeletePolicy bool) error {
+	for _, o := range r {
+		if o.phase == hookPhaseNone {
+			continue
+		}
+		if o.phase == hookPhaseCRD {
+			err := setStringFields(o.RNode, map[string]string{annotationArgoCDSyncWave: argoCDCRDSyncWave}, yaml.MetadataField, yaml.AnnotationsField)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		annotations := map[string]string{
+			annotationArgoCDHook:     "PreSync",
+			annotationArgoCDSyncWave: strconv.Itoa(o.weight),
+		}
+		if o.phase == hookPhasePost {
+			annotations[annotationArgoCDHook] = "PostSync"
+		}
+		if policies := o.meta.Annotations[annotationHelmHookDeletePolicy]; policies != "" && !stripDeletePolicy {
+			var argoPolicies []string
+			for _, policy := range strings.Split(policies, ",") {
+				if p, ok := argoCDHookDeletePolicies[strings.TrimSpace(policy)]; ok {
+					argoPolicies = append(argoPolicies, p)
+				}
+			}
+			if len(argoPolicies) > 0 {
+				annotations[annotationArgoCDHookDelete] = strings.Join(argoPolicies, ",")
+			}
+		}
+		if err := setStringFields(o.RNode, annotations, yaml.MetadataField, yaml.AnnotationsField); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setKptDependencies makes every resource depend on the resources of the previous stage
+// where a stage is a hook weight within a phase or the chart's regular resources.
+// The resources must be sorted by stage.
+func setKptDependencies(r []*hookResource, namespace string) error {
+	var previous, current []string
+	for i, o := range r {
+		if i > 0 && (o.phase != r[i-1].phase || o.weight != r[i-1].weight) {
+			previous, current = current, nil
+		}
+		current = append(current, kptObjectReference(&o.meta, namespace))
+		if len(previous) == 0 {
+			continue
+		}
+		deps := previous
+		if existing := o.meta.Annotations[annotationKptDependsOn]; existing != "" {
+			deps = append([]string{existing}, deps...)
+		}
+		err := setStringFields(o.RNode, map[string]string{annotationKptDependsOn: strings.Join(deps, ",")}, yaml.MetadataField, yaml.AnnotationsField)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kptObjectReference returns the reference of a resource as it is used within kpt's depends-on annotation
+func kptObjectReference(meta *yaml.ResourceMeta, namespace string) string {
+	group := ""
+	if i := strings.Index(meta.APIVersion, "/"); i >= 0 {
+		group = meta.APIVersion[:i]
+	}
+	namespaced, knownKind := openapi.IsNamespaceScoped(meta.TypeMeta)
+	if !namespaced && knownKind {
+		return fmt.Sprintf("%s/%s/%s", group, meta.Kind, meta.Name)
+	}
+	ns := meta.Namespace
+	if ns == "" {
+		ns = namespace
+	}
+	return fmt.Sprintf("%s/namespaces/%s/%s/%s", group, ns, meta.Kind, meta.Name)
+}
@@ -0,0 +1,143 @@
+package helm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// podSpecPaths maps the supported workload kinds to the path of their pod spec
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+var containerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// transformImages rewrites the container images of the given workloads' pod templates.
+// Like kustomize, an image override that doesn't match any container is ignored.
+func transformImages(resources []*yaml.RNode, images []config.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return err
+		}
+		path, ok := podSpecPaths[meta.Kind]
+		if !ok {
+			continue
+		}
+		podSpec, err := o.Pipe(yaml.Lookup(path...))
+		if err != nil {
+			return errors.Wrapf(err, "%s %s", meta.Kind, meta.Name)
+		}
+		if podSpec == nil {
+			continue
+		}
+		for _, field := range containerFields {
+			containers, err := podSpec.Pipe(yaml.Lookup(field))
+			if err != nil {
+				return errors.Wrapf(err, "%s %s: %s", meta.Kind, meta.Name, field)
+			}
+			if containers == nil {
+				continue
+			}
+			elements, err := containers.Elements()
+			if err != nil {
+				return errors.Wrapf(err, "%s %s: %s", meta.Kind, meta.Name, field)
+			}
+			for _, c := range elements {
+				image := c.Field("image")
+				if image == nil || image.Value.YNode().Kind != yaml.ScalarNode {
+					continue
+				}
+				for _, img := range images {
+					if newImage, ok := rewriteImage(image.Value.YNode().Value, &img); ok {
+						image.Value.YNode().Value = newImage
+						break
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteImage returns the rewritten image reference if its name matches the given override
+func rewriteImage(image string, override *config.Image) (string, bool) {
+	name, tag, digest := parseImage(image)
+	if normalizeImageName(name) != normalizeImageName(override.Name) {
+		return "", false
+	}
+	if override.NewName != "" {
+		name = override.NewName
+	}
+	if override.NewRegistry != "" {
+		name = fmt.Sprintf("%s/%s", override.NewRegistry, imagePath(name))
+	}
+	if override.NewTag != "" {
+		tag = override.NewTag
+		digest = ""
+	}
+	if override.Digest != "" {
+		tag = ""
+		digest = override.Digest
+	}
+	if tag != "" {
+		name += ":" + tag
+	}
+	if digest != "" {
+		name += "@" + digest
+	}
+	return name, true
+}
+
+// parseImage splits an image reference into its name, tag and digest
+func parseImage(image string) (name, tag, digest string) {
+	name = image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	return
+}
+
+// normalizeImageName returns the short form of a Docker Hub image name
+// so that e.g. nginx matches docker.io/library/nginx.
+func normalizeImageName(name string) string {
+	for _, prefix := range []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"} {
+		if strings.HasPrefix(name, prefix) {
+			name = name[len(prefix):]
+			if p := strings.TrimPrefix(name, "library/"); !strings.Contains(p, "/") {
+				name = p
+			}
+			return name
+		}
+	}
+	return name
+}
+
+// imagePath returns the image name without its registry
+func imagePath(name string) string {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return name
+	}
+	registry := name[:i]
+	if strings.ContainsAny(registry, ".:") || registry == "localhost" {
+		return name[i+1:]
+	}
+	return name
+}
@@ -3,9 +3,11 @@ package helm
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Masterminds/semver/v3"
@@ -15,34 +17,94 @@ import (
 	"k8s.io/helm/pkg/downloader"
 	"k8s.io/helm/pkg/getter"
 	cli "k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/helm/helmpath"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/renderutil"
 	"k8s.io/helm/pkg/resolver"
 )
 
 // loadChart loads chart from local or remote location
-func (h *Helm) loadChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
+func (h *Helm) loadChart(ctx context.Context, cfg *config.ChartConfig, lock *lockFile) (*chart.Chart, error) {
+	chartPath, err := h.localChartPath(ctx, cfg, lock)
+	if err != nil {
+		return nil, err
+	}
+	if chartPath != "" {
+		if isChartArchive(chartPath) {
+			return loadChartArchive(&cfg.LoaderConfig, chartPath)
+		}
+		return h.buildAndLoadLocalChart(ctx, cfg, chartPath, lock)
+	}
+	return h.loadRemoteChart(ctx, cfg, lock)
+}
+
+// localChartPath returns the path of the local chart directory or archive - checking it out from git if necessary.
+// It returns an empty string if the chart needs to be loaded from a chart repository, OCI registry or URL.
+func (h *Helm) localChartPath(ctx context.Context, cfg *config.ChartConfig, lock *lockFile) (string, error) {
 	if cfg.Chart == "" {
-		return nil, errors.New("no chart specified")
+		return "", errors.New("no chart specified")
 	}
-	_, err := os.Stat(absPath(cfg.Chart, cfg.BaseDir))
-	fileExists := err == nil
-	if cfg.Repository == "" {
-		if fileExists {
-			return h.buildAndLoadLocalChart(ctx, cfg)
+	if isGitRepository(cfg.Repository) {
+		return checkoutGitChart(ctx, &cfg.LoaderConfig, lock, h.TrustAnyRepository, h.TrustPolicy, &h.Settings)
+	}
+	if cfg.Repository == "" && !isChartURL(cfg.Chart) {
+		chartPath := absPath(cfg.Chart, cfg.BaseDir)
+		if _, err := os.Stat(chartPath); err == nil {
+			return chartPath, nil
 		} else if l := strings.Split(cfg.Chart, "/"); len(l) == 2 && l[0] != "" && l[1] != "" && l[0] != ".." && l[0] != "." {
 			cfg.Repository = "@" + l[0]
 			cfg.Chart = l[1]
 		} else {
-			return nil, errors.Errorf("chart directory %q not found and no repository specified", cfg.Chart)
+			return "", errors.Errorf("chart directory %q not found and no repository specified", cfg.Chart)
 		}
 	}
-	return h.loadRemoteChart(ctx, cfg)
+	return "", nil
+}
+
+// repositoryOptions returns the repository options for the given chart
+func (h *Helm) repositoryOptions(cfg *config.LoaderConfig) *repositoryOptions {
+	opts := &repositoryOptions{
+		TrustAnyRepository: h.TrustAnyRepository,
+		Offline:            cfg.Offline,
+		IndexMaxAge:        cfg.IndexMaxAge,
+		Mirrors:            h.Mirrors,
+		CredentialHelper:   h.CredentialHelper,
+		TrustPolicy:        h.TrustPolicy,
+		Retry:              h.Retry,
+	}
+	if cfg.Refresh {
+		opts.IndexMaxAge = 0
+	}
+	return opts
+}
+
+// getters returns the getters for the given chart.
+// In offline mode the returned getters never access the network.
+func (h *Helm) getters(cfg *config.ChartConfig) getter.Providers {
+	if cfg.Offline {
+		return offlineGetters(h.Getters)
+	}
+	return repositoryAuthGetters(h.Getters, cfg.RepositoryAuth, cfg.BaseDir)
 }
 
-func (h *Helm) loadRemoteChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
+func (h *Helm) loadRemoteChart(ctx context.Context, cfg *config.ChartConfig, lock *lockFile) (*chart.Chart, error) {
+	if isOCIRepository(cfg.Repository) {
+		archive, err := locateOCIChart(ctx, &cfg.LoaderConfig, lock, h.TrustAnyRepository, h.TrustPolicy, h.RegistryConfig, h.Retry, &h.Settings)
+		if err != nil {
+			return nil, err
+		}
+		return loadChartArchiveData(archive.Data, archive.File)
+	}
+	getters := h.getters(cfg)
+	if cfg.Repository == "" {
+		archive, err := locateChartURL(ctx, &cfg.LoaderConfig, lock, h.repositoryOptions(&cfg.LoaderConfig), &h.Settings, getters)
+		if err != nil {
+			return nil, err
+		}
+		return loadChartArchiveData(archive.Data, archive.File)
+	}
 	repoURLs := map[string]struct{}{cfg.Repository: {}}
-	repos, err := reposForURLs(repoURLs, h.TrustAnyRepository, &h.Settings, h.Getters)
+	repos, err := reposForURLs(ctx, repoURLs, h.repositoryOptions(&cfg.LoaderConfig), &h.Settings, getters)
 	if err != nil {
 		return nil, err
 	}
@@ -59,69 +121,135 @@ func (h *Helm) loadRemoteChart(ctx context.Context, cfg *config.ChartConfig) (*c
 	if err != nil {
 		return nil, err
 	}
-	if isRange {
+	repoEntry, err := repos.Get(cfg.Repository)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Refresh || isRange && lock.Get(repoEntry.URL, cfg.Chart, cfg.Version) == nil {
 		if err = repos.UpdateIndex(ctx); err != nil {
 			return nil, err
 		}
 	}
-	chartPath, err := locateChart(ctx, &cfg.LoaderConfig, repos, &settings, h.Getters)
+	archive, _, err := locateChart(ctx, &cfg.LoaderConfig, lock, repos, &settings, getters)
 	if err != nil {
 		return nil, err
 	}
-	return chartutil.Load(chartPath)
+	return loadChartArchiveData(archive.Data, archive.File)
 }
 
-func (h *Helm) buildAndLoadLocalChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
-	chartPath := absPath(cfg.Chart, cfg.BaseDir)
-	chartRequested, err := chartutil.Load(chartPath)
+func (h *Helm) buildAndLoadLocalChart(ctx context.Context, cfg *config.ChartConfig, chartPath string, lock *lockFile) (*chart.Chart, error) {
+	localCharts, repos, unlock, err := h.prepareLocalCharts(ctx, cfg, chartPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer repos.Close()
+	settings := h.Settings
+	settings.Home = repos.HelmHome()
+
+	// Build local charts recursively within a temporary overlay directory
+	overlayDir, err := ioutil.TempDir("", "khelm-chart-build-")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	defer os.RemoveAll(overlayDir)
+	builtChartPath, err := buildLocalCharts(ctx, localCharts, overlayDir, &cfg.LoaderConfig, lock, repos, &settings, h.getters(cfg), false)
+	if err != nil {
+		return nil, errors.Wrap(err, "build/fetch dependencies")
+	}
+	chartRequested := localCharts[len(localCharts)-1].Chart
+	if builtChartPath != chartPath {
+		chartRequested, err = loadChartPath(builtChartPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed loading chart %s after dependency download", cfg.Chart)
+		}
+	}
+	return chartRequested, nil
+}
 
-	localCharts := make([]localChart, 0, 1)
-	dependencies := make([]*chartutil.Dependency, 0)
-	needsRepoIndexUpdate, err := collectCharts(chartRequested, chartPath, cfg, &localCharts, &dependencies, 0)
+// prepareLocalCharts loads the given chart and its local dependencies recursively
+// and provides the repositories (with their index files) their remote dependencies refer to.
+// The requested chart is the last one within the returned list.
+// Dependencies that are disabled by the configured values are skipped unless includeDisabled is true.
+// The chart directories are locked until the returned function is called so that they are not modified concurrently.
+// The caller must close the returned repositories and release the locks.
+func (h *Helm) prepareLocalCharts(ctx context.Context, cfg *config.ChartConfig, chartPath string, includeDisabled bool) ([]localChart, repositoryConfig, func(), error) {
+	localCharts, dependencies, needsRepoIndexUpdate, unlock, err := collectLockedCharts(ctx, chartPath, cfg, includeDisabled, h.Settings.Home, h.getters(cfg))
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// Create (temporary) repository configuration that includes all dependencies
-	repos, err := reposForDependencies(dependencies, h.TrustAnyRepository, &h.Settings, h.Getters)
+	repos, err := reposForDependencies(ctx, dependencies, h.repositoryOptions(&cfg.LoaderConfig), &h.Settings, h.getters(cfg))
 	if err != nil {
-		return nil, errors.Wrap(err, "init temp repositories.yaml")
+		unlock()
+		return nil, nil, nil, errors.Wrap(err, "init temp repositories.yaml")
 	}
 	repos.RequireTempHelmHome(len(localCharts) > 1)
 	repos, err = repos.Apply()
 	if err != nil {
-		return nil, err
+		unlock()
+		return nil, nil, nil, err
 	}
-	defer repos.Close()
-	settings := h.Settings
-	settings.Home = repos.HelmHome()
 
 	// Download/update repo indices
-	if needsRepoIndexUpdate {
+	if needsRepoIndexUpdate || cfg.Refresh {
 		err = repos.UpdateIndex(ctx)
 	} else {
 		err = repos.DownloadIndexFilesIfNotExist(ctx)
 	}
 	if err != nil {
-		return nil, err
+		_ = repos.Close()
+		unlock()
+		return nil, nil, nil, err
 	}
+	return localCharts, repos, unlock, nil
+}
 
-	// Build local charts recursively
-	needsReload, err := buildLocalCharts(ctx, localCharts, &cfg.LoaderConfig, repos, &settings, h.Getters)
-	if err != nil {
-		return nil, errors.Wrap(err, "build/fetch dependencies")
-	}
-	// Reload the chart with the updated Chart.lock file
-	if needsReload {
-		chartRequested, err = chartutil.Load(chartPath)
+// collectLockedCharts loads the chart and its local dependencies recursively while holding the locks of their directories.
+// Since the local dependencies are only known after the chart has been loaded
+// the charts are loaded again when further directories had to be locked.
+// The configured values are loaded in order to skip dependencies that are disabled by their condition or tags.
+func collectLockedCharts(ctx context.Context, chartPath string, cfg *config.ChartConfig, includeDisabled bool, home helmpath.Home, getters getter.Providers) (localCharts []localChart, deps []*chartutil.Dependency, needsRepoIndexUpdate bool, unlock func(), err error) {
+	lockedPaths := map[string]struct{}{chartPath: {}}
+	for {
+		paths := make([]string, 0, len(lockedPaths))
+		for p := range lockedPaths {
+			paths = append(paths, p)
+		}
+		unlock, err = lockChartDirs(ctx, home, paths)
+		if err != nil {
+			return nil, nil, false, nil, err
+		}
+		chartRequested, err := loadChartPath(chartPath)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed reloading chart %s after dependency download", cfg.Chart)
+			unlock()
+			return nil, nil, false, nil, errors.WithStack(err)
 		}
+		values, err := configuredValues(chartRequested, cfg, getters)
+		if err != nil {
+			unlock()
+			return nil, nil, false, nil, err
+		}
+		localCharts = make([]localChart, 0, 1)
+		deps = make([]*chartutil.Dependency, 0)
+		needsRepoIndexUpdate, err = collectCharts(chartRequested, chartPath, cfg, values, nil, includeDisabled, &localCharts, &deps, 0)
+		if err != nil {
+			unlock()
+			return nil, nil, false, nil, err
+		}
+		allLocked := true
+		for _, ch := range localCharts {
+			if _, ok := lockedPaths[ch.Path]; !ok {
+				lockedPaths[ch.Path] = struct{}{}
+				allLocked = false
+			}
+		}
+		if allLocked {
+			return localCharts, deps, needsRepoIndexUpdate, unlock, nil
+		}
+		unlock()
 	}
-	return chartRequested, nil
 }
 
 func isVersionRange(version string) (bool, error) {
@@ -145,9 +273,27 @@ type localChart struct {
 	LocalDependencies bool
 	Requirements      *chartutil.Requirements
 	RequirementsLock  *chartutil.RequirementsLock
+	// APIVersionV2 is true if the chart declares its dependencies within Chart.yaml and Chart.lock (helm 3)
+	APIVersionV2 bool
+	// Disabled specifies for each of the requirements' dependencies whether it is disabled by its condition or tags
+	Disabled []bool
 }
 
-func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.ChartConfig, localCharts *[]localChart, deps *[]*chartutil.Dependency, depth int) (needsRepoIndexUpdate bool, err error) {
+// configuredValues loads the values that are configured for the requested chart
+func configuredValues(chartRequested *chart.Chart, cfg *config.ChartConfig, getters getter.Providers) (chartutil.Values, error) {
+	rawVals, err := vals(chartRequested, cfg.ValueFiles, cfg.Values, cfg.BaseDir, getters)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load values for chart %s", chartRequested.Metadata.Name)
+	}
+	values, err := chartutil.ReadValues(rawVals)
+	return values, errors.Wrapf(err, "load values for chart %s", chartRequested.Metadata.Name)
+}
+
+// collectCharts collects the given local chart and its local dependencies recursively
+// as well as their enabled remote dependencies.
+// The given values are the ones passed to the chart, the top values the coalesced values of the requested chart (nil for the requested chart itself).
+// When includeDisabled is true the dependencies' conditions and tags are ignored.
+func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.ChartConfig, values, topValues chartutil.Values, includeDisabled bool, localCharts *[]localChart, deps *[]*chartutil.Dependency, depth int) (needsRepoIndexUpdate bool, err error) {
 	if depth > 20 {
 		return false, errors.New("collect local charts recursively: max depth of 20 reached - cyclic dependency?")
 	}
@@ -156,6 +302,10 @@ func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.Ch
 		return false, errors.Errorf("chart %s has no metadata", chartPath)
 	}
 	name := fmt.Sprintf("%s %s", meta.Name, meta.Version)
+	isV2, err := isChartAPIVersionV2(chartPath)
+	if err != nil {
+		return false, err
+	}
 	lock, err := chartutil.LoadRequirementsLock(chartRequested)
 	if err != nil && err != chartutil.ErrLockfileNotFound {
 		return false, errors.WithStack(err)
@@ -168,24 +318,39 @@ func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.Ch
 	if req != nil && req.Dependencies != nil {
 		reqDeps = req.Dependencies
 	}
+	cvals, err := chartValues(chartRequested, values)
+	if err != nil {
+		return false, errors.Wrapf(err, "chart %s", name)
+	}
+	if topValues == nil {
+		topValues = cvals
+	}
+	disabled := make([]bool, len(reqDeps))
+	if !includeDisabled {
+		disabled = disabledDependencies(reqDeps, cvals, topValues)
+	}
 	hasLocalDependencies := false
-	for _, dep := range reqDeps {
+	for i, dep := range reqDeps {
+		if disabled[i] {
+			log.Printf("Skipping chart %s dependency %s since it is disabled", name, dep.Name)
+			continue
+		}
 		if strings.HasPrefix(dep.Repository, "file://") {
 			hasLocalDependencies = true
 			depChartPath := strings.TrimPrefix(dep.Repository, "file://")
 			depChartPath = absPath(depChartPath, chartPath)
-			depChart, err := chartutil.LoadDir(depChartPath)
+			depChart, err := loadChartPath(depChartPath)
 			if err != nil {
 				return false, errors.Wrapf(err, "load chart %s dependency %s from dir %s", name, dep.Name, depChartPath)
 			}
-			needsUpdate, err := collectCharts(depChart, depChartPath, cfg, localCharts, deps, depth+1)
+			needsUpdate, err := collectCharts(depChart, depChartPath, cfg, subchartValues(cvals, dep), topValues, includeDisabled, localCharts, deps, depth+1)
 			if err != nil {
 				return false, errors.WithStack(err)
 			}
 			if needsUpdate {
 				needsRepoIndexUpdate = true
 			}
-		} else if strings.HasPrefix(dep.Repository, "https://") || strings.HasPrefix(dep.Repository, "http://") {
+		} else if isRemoteDependency(dep) {
 			*deps = append(*deps, dep)
 			if lock == nil {
 				// Update repo index when remote dependencies present but no lock file
@@ -199,62 +364,161 @@ func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.Ch
 		LocalDependencies: hasLocalDependencies,
 		Requirements:      req,
 		RequirementsLock:  lock,
+		APIVersionV2:      isV2,
+		Disabled:          disabled,
 	})
 	return needsRepoIndexUpdate, nil
 }
 
-func buildLocalCharts(ctx context.Context, localCharts []localChart, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) (needsReload bool, err error) {
-	for _, ch := range localCharts {
-		if ch.Requirements == nil {
+// buildLocalCharts builds the dependencies of the local charts within the given overlay directory
+// so that the source chart directories are never modified.
+// Every local chart that needs to be built or is a dependency of another local chart
+// is copied (converted to apiVersion v1) into its own directory within the overlay directory.
+// When writeBack is true every local chart's dependencies are built and written back into its
+// charts directory together with its lock file (as an explicit dependency update or build does).
+// Returns the path of the requested chart within the overlay directory
+// or its source path if it did not need to be built.
+func buildLocalCharts(ctx context.Context, localCharts []localChart, overlayDir string, cfg *config.LoaderConfig, lock *lockFile, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers, writeBack bool) (string, error) {
+	builtCharts := map[string]string{}
+	for i, ch := range localCharts {
+		isRequested := i == len(localCharts)-1
+		needsBuild := false
+		if ch.Requirements != nil {
+			enabledReq := &chartutil.Requirements{Dependencies: ch.enabledDependencies(ch.Requirements.Dependencies)}
+			needsBuild = writeBack || renderutil.CheckDependencies(ch.Chart, enabledReq) != nil || ch.LocalDependencies
+		}
+		if !needsBuild && isRequested {
+			return ch.Path, nil
+		}
+		chartOverlayDir := filepath.Join(overlayDir, strconv.Itoa(i))
+		if err := writeConvertedChart(ch.Path, chartOverlayDir); err != nil {
+			return "", errors.Wrapf(err, "copy chart %s into overlay dir", ch.Path)
+		}
+		builtCharts[ch.Path] = chartOverlayDir
+		if !needsBuild {
 			continue
 		}
-		if err = renderutil.CheckDependencies(ch.Chart, ch.Requirements); err != nil || ch.LocalDependencies {
-			needsReload = true
-			meta := ch.Chart.Metadata
-			if meta == nil {
-				return false, errors.Errorf("chart %s has no metadata", ch.Path)
-			}
-			name := fmt.Sprintf("%s %s", meta.Name, meta.Version)
-			log.Printf("Building/fetching chart %s dependencies", name)
-			if lock := ch.RequirementsLock; lock != nil {
-				if sum, err := resolver.HashReq(ch.Requirements); err != nil || sum != lock.Digest {
-					errMsg := fmt.Sprintf("chart %s requirements.lock is out of sync with requirements.yaml", meta.Name)
-					if !cfg.ReplaceLockFile {
-						return false, errors.Errorf("%s (enable replaceLockFile to ignore this error)", errMsg)
-					}
-					log.Printf("WARNING: %s - removing it and reloading dependencies", errMsg)
-					ch.RequirementsLock = nil
-					if err = os.RemoveAll(filepath.Join(ch.Path, "charts")); err != nil {
-						return false, errors.WithStack(err)
-					}
-					if err = os.RemoveAll(filepath.Join(ch.Path, "tmpcharts")); err != nil {
-						return false, errors.WithStack(err)
-					}
-					if err = os.Remove(filepath.Join(ch.Path, "requirements.lock")); err != nil {
-						return false, errors.WithStack(err)
+		meta := ch.Chart.Metadata
+		if meta == nil {
+			return "", errors.Errorf("chart %s has no metadata", ch.Path)
+		}
+		name := fmt.Sprintf("%s %s", meta.Name, meta.Version)
+		log.Printf("Building/fetching chart %s dependencies", name)
+		reqFile, lockFile := requirementsFileName, requirementsLockFileName
+		if ch.APIVersionV2 {
+			reqFile, lockFile = chartFileName, chartLockFileName
+		}
+		if lock := ch.RequirementsLock; lock != nil {
+			if sum, err := resolver.HashReq(ch.Requirements); err != nil || sum != lock.Digest {
+				errMsg := fmt.Sprintf("chart %s %s is out of sync with %s", meta.Name, lockFile, reqFile)
+				if !cfg.ReplaceLockFile {
+					hint := "enable replaceLockFile to ignore this error"
+					if writeBack {
+						hint = "run `khelm dep update` to update it"
 					}
+					return "", errors.Errorf("%s (%s)", errMsg, hint)
+				}
+				log.Printf("WARNING: %s - ignoring it and reloading dependencies", errMsg)
+				ch.RequirementsLock = nil
+				if err = os.RemoveAll(filepath.Join(chartOverlayDir, "charts")); err != nil {
+					return "", errors.WithStack(err)
 				}
 			}
-			if err = buildChartDependencies(ctx, ch.Chart, ch.Path, cfg, repos, settings, getters); err != nil {
-				return false, errors.Wrapf(err, "build chart %s", name)
+		}
+		fetched, err := fetchDependencies(ctx, ch, cfg, lock, repos, settings, getters)
+		if err != nil {
+			return "", errors.Wrapf(err, "build chart %s", name)
+		}
+		err = buildChartOverlay(ctx, ch, chartOverlayDir, builtCharts, fetched, cfg, repos, settings, getters)
+		if err != nil {
+			return "", errors.Wrapf(err, "build chart %s", name)
+		}
+		if writeBack {
+			if err = writeBackDependencies(ch, chartOverlayDir); err != nil {
+				return "", errors.Wrapf(err, "write chart %s dependencies", name)
+			}
+		}
+		if isRequested {
+			return chartOverlayDir, nil
+		}
+	}
+	return "", errors.New("no local chart to build")
+}
+
+func isRemoteDependency(d *chartutil.Dependency) bool {
+	return strings.HasPrefix(d.Repository, "https://") || strings.HasPrefix(d.Repository, "http://")
+}
+
+// fetchedDependency is a remote dependency that has been fetched into the cache
+type fetchedDependency struct {
+	Version string
+	Digest  string
+	URL     string
+	Archive *cachedChartArchive
+}
+
+// fetchDependencies downloads the chart's remote dependencies into the cache unless they are cached already.
+// Returns the fetched dependencies aligned with the chart's enabled dependencies (nil for a local dependency).
+// The dependencies listed within requirements.lock are used if it is in sync with requirements.yaml.
+func fetchDependencies(ctx context.Context, ch localChart, cfg *config.LoaderConfig, lock *lockFile, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) ([]*fetchedDependency, error) {
+	if ch.Requirements == nil {
+		return nil, nil
+	}
+	deps := ch.Requirements.Dependencies
+	if lock := ch.RequirementsLock; lock != nil {
+		if sum, err := resolver.HashReq(ch.Requirements); err == nil && sum == lock.Digest {
+			deps = lock.Dependencies
+		}
+	}
+	deps = ch.enabledDependencies(deps)
+	fetched := make([]*fetchedDependency, len(deps))
+	missing := []string{}
+	for i, d := range deps {
+		if !isRemoteDependency(d) {
+			continue
+		}
+		depCfg := *cfg
+		depCfg.Repository = d.Repository
+		depCfg.Chart = d.Name
+		depCfg.Version = d.Version
+		archive, chartURL, err := locateChart(ctx, &depCfg, lock, repos, settings, getters)
+		if err != nil {
+			if e, ok := errors.Cause(err).(*notCachedError); ok {
+				missing = append(missing, e.artifacts...)
+				continue
 			}
+			return nil, errors.Wrapf(err, "fetch dependency %s", d.Name)
+		}
+		cv, err := chartArchiveVersion(archive)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetch dependency %s", d.Name)
 		}
+		fetched[i] = &fetchedDependency{Version: cv.Version, Digest: cv.Digest, URL: chartURL, Archive: archive}
 	}
-	return needsReload, nil
+	if len(missing) > 0 {
+		return nil, newNotCachedError(missing...)
+	}
+	return fetched, nil
 }
 
-func dependencyFilePath(chartPath string, d *chartutil.Dependency) string {
-	name := fmt.Sprintf("%s-%s.tgz", d.Name, d.Version)
-	return filepath.Join(chartPath, "charts", name)
+// fetchedArchives maps the fetched dependencies' chart URLs to their archives
+func fetchedArchives(fetched []*fetchedDependency) map[string]*cachedChartArchive {
+	archives := map[string]*cachedChartArchive{}
+	for _, d := range fetched {
+		if d != nil {
+			archives[d.URL] = d.Archive
+		}
+	}
+	return archives
 }
 
-func buildChartDependencies(ctx context.Context, chartRequested *chart.Chart, chartPath string, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) error {
+func buildChartDependencies(ctx context.Context, chartPath string, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) error {
 	man := &downloader.Manager{
 		Out:        log.Writer(),
 		ChartPath:  chartPath,
 		Keyring:    cfg.Keyring,
 		SkipUpdate: true,
-		Getters:    getters,
+		Getters:    repos.IdentityTokenGetters(getters),
 		HelmHome:   settings.Home,
 		Debug:      settings.Debug,
 	}
@@ -1,8 +1,10 @@
 package helm
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
@@ -15,64 +17,86 @@ import (
 	"k8s.io/helm/pkg/downloader"
 	"k8s.io/helm/pkg/getter"
 	cli "k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/provenance"
 	"k8s.io/helm/pkg/repo"
 )
 
-// locateChart fetches the chart if not present in cache and returns its path.
+// cachedChartArchive is a chart archive (and its provenance file) that has been read from the cache
+type cachedChartArchive struct {
+	File       string
+	Data       []byte
+	Provenance []byte
+}
+
+// locateChart fetches the chart if not present in cache and returns it together with its URL.
+// The chart version is resolved using the lock file (if any) and recorded within it.
 // (derived from https://github.com/helm/helm/blob/fc9b46067f8f24a90b52eba31e09b31e69011e93/pkg/action/install.go#L621 -
 // with efficient caching)
-func locateChart(ctx context.Context, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) (string, error) {
+func locateChart(ctx context.Context, cfg *config.LoaderConfig, lock *lockFile, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) (*cachedChartArchive, string, error) {
 	name := cfg.Chart
 
 	if filepath.IsAbs(name) || strings.HasPrefix(name, ".") {
-		return name, errors.Errorf("path %q not found", name)
+		return nil, "", errors.Errorf("path %q not found", name)
 	}
 
 	repoEntry, err := repos.Get(cfg.Repository)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
-	cv, err := repos.ResolveChartVersion(ctx, name, cfg.Version, repoEntry.URL)
+	version := cfg.Version
+	if locked := lock.Get(repoEntry.URL, name, cfg.Version); locked != nil {
+		version = locked.Version
+	}
+	cv, err := repos.ResolveChartVersion(ctx, name, version, repoEntry.URL)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
 	chartURL, err := repo.ResolveReferenceURL(repoEntry.URL, cv.URLs[0])
 	if err != nil {
-		return "", errors.Wrap(err, "failed to make chart URL absolute")
+		return nil, "", errors.Wrap(err, "failed to make chart URL absolute")
+	}
+
+	if err = lock.Lock(repoEntry.URL, cfg.Version, cv, chartURL); err != nil {
+		return nil, "", err
 	}
 
-	chartCacheDir := filepath.Join(settings.Home.Archive(), "khelm")
-	cacheFile, err := cacheFilePath(chartURL, cv, chartCacheDir)
+	cacheFile, err := cacheFilePath(chartURL, cv, chartCacheDir(settings.Home))
 	if err != nil {
-		return "", errors.Wrap(err, "derive chart cache file")
+		return nil, "", errors.Wrap(err, "derive chart cache file")
 	}
 
 	if err = ctx.Err(); err != nil {
-		return "", err
+		return nil, "", err
 	}
 
-	if _, err = os.Stat(cacheFile); err == nil {
-		cacheFile, err = filepath.EvalSymlinks(cacheFile)
-		if err != nil {
-			return "", errors.Wrap(err, "normalize cached file path")
-		}
-		if cfg.Verify {
-			if _, err := downloader.VerifyChart(cacheFile, cfg.Keyring); err != nil {
-				return "", err
-			}
+	archive, err := readCachedChartOrDownload(ctx, cacheFile, cv.Digest, cfg, func() error {
+		if cfg.Offline {
+			return newNotCachedError(fmt.Sprintf("chart %s %s from %s (%s)", cfg.Chart, cv.Version, repoEntry.URL, cacheFile))
 		}
-		log.Printf("Using chart %s from cache at %s", cfg.Chart, cacheFile)
-		return cacheFile, nil
+		return downloadChart(ctx, cfg, cv, chartURL, cacheFile, repoEntry, repos, settings, getters)
+	})
+	if err != nil {
+		return nil, "", err
 	}
+	return archive, chartURL, nil
+}
 
-	log.Printf("Downloading chart %s %s from repo %s", cfg.Chart, cv.Version, repoEntry.URL)
+// downloadChart downloads the chart (and its provenance file if verification is requested) into the cache
+func downloadChart(ctx context.Context, cfg *config.LoaderConfig, cv *repo.ChartVersion, chartURL, cacheFile string, repoEntry *repo.Entry, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) error {
+	// The chart URL identifies the chart within the cache and lock file while it is downloaded from the mirror (if any)
+	downloadURL := repos.MirrorURL(chartURL)
+	if downloadURL != chartURL {
+		log.Printf("Downloading chart %s %s from repo %s via mirror %s", cfg.Chart, cv.Version, repoEntry.URL, downloadURL)
+	} else {
+		log.Printf("Downloading chart %s %s from repo %s", cfg.Chart, cv.Version, repoEntry.URL)
+	}
 
 	dl := downloader.ChartDownloader{
 		Out:      log.Writer(),
 		Keyring:  cfg.Keyring,
-		Getters:  getters,
+		Getters:  repos.IdentityTokenGetters(getters),
 		Username: repoEntry.Username,
 		Password: repoEntry.Password,
 		HelmHome: settings.Home,
@@ -81,14 +105,110 @@ func locateChart(ctx context.Context, cfg *config.LoaderConfig, repos repository
 		dl.Verify = downloader.VerifyAlways
 	}
 
-	destDir := filepath.Dir(cacheFile)
+	return downloadToCache(ctx, filepath.Dir(cacheFile), func(tmpDir string) error {
+		var file string
+		err := retry(ctx, repos.RetryOptions(), fmt.Sprintf("download chart %s %s", cfg.Chart, cv.Version), func() (err error) {
+			file, _, err = dl.DownloadTo(downloadURL, cv.Version, tmpDir)
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to download chart %q with version %q", cfg.Chart, cv.Version)
+		}
+		return errors.Wrapf(verifyChartDigest(file, cv.Digest), "chart %s %s downloaded from %s has been tampered with", cfg.Chart, cv.Version, downloadURL)
+	})
+}
+
+// readCachedChartOrDownload reads the chart from the cache, calling download if it is not cached.
+// Since a concurrent cache prune may remove the entry right after it has been downloaded the download is retried once.
+func readCachedChartOrDownload(ctx context.Context, cacheFile, digest string, cfg *config.LoaderConfig, download func() error) (*cachedChartArchive, error) {
+	archive, err := readCachedChart(ctx, cacheFile, digest, cfg)
+	for attempt := 0; err != nil && isNotExist(err) && attempt < 2; attempt++ {
+		if err = download(); err != nil {
+			return nil, err
+		}
+		archive, err = readCachedChart(ctx, cacheFile, digest, cfg)
+	}
+	return archive, err
+}
+
+// readCachedChart reads a chart archive (and its provenance file if verification is requested) from the cache,
+// verifies it and marks it as used while holding the cache entry's lock.
+// Holding the lock prevents a concurrent cache prune from removing the entry meanwhile
+// and keeping the archive in memory makes the caller independent of the entry's later removal.
+// Returns an error that satisfies isNotExist if the chart is not cached.
+func readCachedChart(ctx context.Context, file, digest string, cfg *config.LoaderConfig) (*cachedChartArchive, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dir := filepath.Dir(file)
+	unlock, err := lockPath(ctx, dir)
+	if err != nil {
+		if !isReadOnly(errors.Cause(err)) {
+			return nil, err
+		}
+		// Allow to render charts using a read-only cache (offline)
+		unlock = func() {}
+	}
+	defer unlock()
+	file, err = filepath.EvalSymlinks(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = verifyDigest(bytes.NewReader(data), file, digest); err != nil {
+		return nil, errors.Wrapf(err, "cached chart %s is corrupted (remove %s to download it again)", filepath.Base(file), dir)
+	}
+	archive := &cachedChartArchive{File: file, Data: data}
+	if cfg.Verify {
+		if _, err = downloader.VerifyChart(file, cfg.Keyring); err != nil {
+			return nil, err
+		}
+		if archive.Provenance, err = ioutil.ReadFile(file + provenanceFileSuffix); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	log.Printf("Using chart %s from cache at %s", filepath.Base(file), file)
+	touchCachedChart(file)
+	return archive, nil
+}
+
+// cacheEntryDigest returns the (abbreviated) digest the given cache file's directory name ends with
+func cacheEntryDigest(file string) string {
+	m := cacheDigestSuffixRegex.FindStringSubmatch(filepath.Base(filepath.Dir(file)))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// isNotExist returns true if the error's cause is that a file does not exist
+func isNotExist(err error) bool {
+	return os.IsNotExist(errors.Cause(err))
+}
+
+// downloadToCache calls the download func with a temporary directory
+// and moves it to destDir when the download succeeded.
+// Concurrent downloads of the same destDir are serialized: when destDir
+// has been populated by another process meanwhile the download is skipped.
+func downloadToCache(ctx context.Context, destDir string, download func(tmpDir string) error) error {
 	destParentDir := filepath.Dir(destDir)
-	if err = os.MkdirAll(destParentDir, 0750); err != nil {
-		return "", errors.WithStack(err)
+	if err := os.MkdirAll(destParentDir, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	unlock, err := lockPath(ctx, destDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err = os.Stat(destDir); err == nil {
+		return nil
 	}
 	tmpDestDir, err := ioutil.TempDir(destParentDir, fmt.Sprintf(".tmp-%s-", filepath.Base(destDir)))
 	if err != nil {
-		return "", errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
 	interrupt := ctx.Done()
@@ -101,26 +221,46 @@ func locateChart(ctx context.Context, cfg *config.LoaderConfig, repos repository
 				_ = os.RemoveAll(tmpDestDir)
 			}
 		}()
-		var chartFile string
-		chartFile, _, err = dl.DownloadTo(chartURL, cv.Version, tmpDestDir)
-		if err != nil {
-			return errors.Wrapf(err, "failed to download chart %q with version %q", cfg.Chart, cv.Version)
-		}
-		chartFile, err = filepath.Abs(chartFile)
-		if err != nil {
-			return errors.WithStack(err)
+		if err = download(tmpDestDir); err != nil {
+			return err
 		}
 		return os.Rename(tmpDestDir, destDir)
 	}()
 	select {
 	case err = <-done:
-		return cacheFile, err
+		return err
 	case <-interrupt:
 		_ = os.RemoveAll(tmpDestDir)
-		return "", ctx.Err()
+		return ctx.Err()
 	}
 }
 
+// verifyChartDigest returns an error if the file's SHA-256 digest does not match the given (hex encoded) digest.
+// The digest may be abbreviated to the 16 characters that are used within cache directory names.
+func verifyChartDigest(file, digest string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "compute chart digest")
+	}
+	defer f.Close()
+	return verifyDigest(f, file, digest)
+}
+
+func verifyDigest(r io.Reader, file, digest string) error {
+	expected := strings.ToLower(strings.TrimPrefix(digest, ociDigestPrefix))
+	if len(expected) < 16 {
+		return errors.Errorf("invalid chart digest %q", digest)
+	}
+	actual, err := provenance.Digest(r)
+	if err != nil {
+		return errors.Wrap(err, "compute chart digest")
+	}
+	if !strings.HasPrefix(actual, expected) {
+		return errors.Errorf("SHA-256 digest %s of file %s does not match the expected digest %s", actual, file, expected)
+	}
+	return nil
+}
+
 func cacheFilePath(chartURL string, cv *repo.ChartVersion, cacheDir string) (string, error) {
 	u, err := url.Parse(chartURL)
 	if err != nil {
@@ -138,7 +278,21 @@ func cacheFilePath(chartURL string, cv *repo.ChartVersion, cacheDir string) (str
 	if len(cv.Digest) < 16 {
 		return "", errors.Errorf("repo index entry for chart %q does not specify a digest", cv.Name)
 	}
-	hostSegment := strings.ReplaceAll(u.Host, ":", "_")
 	digestSegment := fmt.Sprintf("%s-%s-%s", cv.Name, cv.Version, cv.Digest[:16])
-	return filepath.Join(cacheDir, hostSegment, filepath.Dir(path), digestSegment, filepath.Base(path)), nil
+	return filepath.Join(cacheDir, cacheHostSegment(u.Host), filepath.Dir(path), digestSegment, filepath.Base(path)), nil
+}
+
+// cacheHostSegment returns the cache directory name of the given host.
+// The port separator and other special characters are escaped reversibly (see cacheHost).
+func cacheHostSegment(host string) string {
+	return url.QueryEscape(host)
+}
+
+// cacheHost returns the host the given cache directory name refers to
+func cacheHost(segment string) string {
+	host, err := url.QueryUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return host
 }
@@ -0,0 +1,184 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"k8s.io/helm/pkg/repo"
+)
+
+const lockFileKind = "ChartLock"
+
+// lockFile records the resolved version, URL and digest of the charts (and their remote dependencies) a generator config refers to.
+// Entries are identified by repository URL, chart name and requested version (constraint).
+// A nil lockFile neither locks nor records anything.
+type lockFile struct {
+	APIVersion string         `yaml:"apiVersion"`
+	Kind       string         `yaml:"kind"`
+	Charts     []*lockedChart `yaml:"charts"`
+	path       string
+	update     bool
+	changed    bool
+}
+
+type lockedChart struct {
+	Repository string `yaml:"repository"`
+	Chart      string `yaml:"chart"`
+	Constraint string `yaml:"constraint,omitempty"`
+	Version    string `yaml:"version"`
+	URL        string `yaml:"url"`
+	Digest     string `yaml:"digest"`
+}
+
+// loadLockFile loads the lock file the given config refers to or returns nil if none is configured.
+// When update is true existing entries are ignored and replaced with the latest resolved versions.
+func loadLockFile(cfg *config.ChartConfig, update bool) (*lockFile, error) {
+	if cfg.LockFile == "" {
+		if update {
+			return nil, errors.Errorf("no lock file specified for chart %s", cfg.Chart)
+		}
+		return nil, nil
+	}
+	l := &lockFile{
+		APIVersion: config.GeneratorAPIVersion,
+		Kind:       lockFileKind,
+		path:       absPath(cfg.LockFile, cfg.BaseDir),
+		update:     update,
+	}
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(l); err != nil {
+		return nil, errors.Wrapf(err, "read lock file %s", l.path)
+	}
+	if l.APIVersion != config.GeneratorAPIVersion || l.Kind != lockFileKind {
+		return nil, errors.Errorf("read lock file %s: expected apiVersion %s and kind %s but was %s %s", l.path, config.GeneratorAPIVersion, lockFileKind, l.APIVersion, l.Kind)
+	}
+	return l, nil
+}
+
+// Get returns the locked chart or nil if the chart is not locked.
+func (l *lockFile) Get(repoURL, chart, constraint string) *lockedChart {
+	if l == nil || l.update {
+		return nil
+	}
+	return l.find(repoURL, chart, constraint)
+}
+
+// GetURL returns the locked chart that has been loaded from the given chart URL or nil if it is not locked.
+func (l *lockFile) GetURL(chartURL, constraint string) *lockedChart {
+	if l == nil || l.update {
+		return nil
+	}
+	for _, c := range l.Charts {
+		if c.Repository == chartURL && c.URL == chartURL && c.Constraint == constraint {
+			return c
+		}
+	}
+	return nil
+}
+
+func (l *lockFile) find(repoURL, chart, constraint string) *lockedChart {
+	for _, c := range l.Charts {
+		if c.Repository == repoURL && c.Chart == chart && c.Constraint == constraint {
+			return c
+		}
+	}
+	return nil
+}
+
+// Lock records the resolved chart version.
+// It fails if the chart is locked with another version or digest already (unless the lock file is being updated).
+func (l *lockFile) Lock(repoURL, constraint string, cv *repo.ChartVersion, chartURL string) error {
+	if l == nil {
+		return nil
+	}
+	resolved := &lockedChart{
+		Repository: repoURL,
+		Chart:      cv.Name,
+		Constraint: constraint,
+		Version:    cv.Version,
+		URL:        chartURL,
+		Digest:     cv.Digest,
+	}
+	if locked := l.find(repoURL, cv.Name, constraint); locked != nil {
+		if *locked == *resolved {
+			return nil
+		}
+		if !l.update {
+			if locked.Version != resolved.Version {
+				return errors.Errorf("chart %s resolved to version %s but %s is locked within %s", cv.Name, cv.Version, locked.Version, l.path)
+			}
+			if locked.Digest != resolved.Digest {
+				return errors.Errorf("chart %s %s from %s has digest %s but the digest %s is locked within %s - the chart has been republished or tampered with (run `khelm lock update` if the change is expected)", cv.Name, cv.Version, repoURL, cv.Digest, locked.Digest, l.path)
+			}
+		}
+		*locked = *resolved
+	} else {
+		l.Charts = append(l.Charts, resolved)
+	}
+	l.changed = true
+	return nil
+}
+
+// Save writes the lock file if it has changed
+func (l *lockFile) Save() error {
+	if l == nil || !l.changed {
+		return nil
+	}
+	sort.Slice(l.Charts, func(i, j int) bool {
+		a, b := l.Charts[i], l.Charts[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		if a.Chart != b.Chart {
+			return a.Chart < b.Chart
+		}
+		return a.Constraint < b.Constraint
+	})
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(l); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := enc.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("Writing lock file %s", l.path)
+	dir := filepath.Dir(l.path)
+	tmpFile, err := ioutil.TempFile(dir, fmt.Sprintf(".tmp-%s-", filepath.Base(l.path)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tmpFile.Write(buf.Bytes())
+	if e := tmpFile.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), l.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return errors.Wrapf(err, "write lock file %s", l.path)
+	}
+	l.changed = false
+	return nil
+}
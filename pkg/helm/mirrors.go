@@ -0,0 +1,60 @@
+package helm
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mirrors maps repository URLs to the URLs of their mirrors.
+// A mirror applies to all URLs that start with the repository URL.
+type Mirrors map[string]string
+
+// ParseMirrors parses mirror rules of the form <repository URL>=<mirror URL>.
+// Empty rules are ignored.
+func ParseMirrors(rules []string) (Mirrors, error) {
+	m := Mirrors{}
+	for _, rule := range rules {
+		if err := m.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Add adds a mirror rule of the form <repository URL>=<mirror URL>.
+func (m Mirrors) Add(rule string) error {
+	rule = strings.TrimSpace(rule)
+	if rule == "" {
+		return nil
+	}
+	kv := strings.SplitN(rule, "=", 2)
+	if len(kv) != 2 {
+		return errors.Errorf("invalid mirror %q: expected <repository URL>=<mirror URL>", rule)
+	}
+	repoURL := strings.TrimSuffix(strings.TrimSpace(kv[0]), "/")
+	mirrorURL := strings.TrimSuffix(strings.TrimSpace(kv[1]), "/")
+	for _, u := range []string{repoURL, mirrorURL} {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return errors.Errorf("invalid mirror %q: %q is not an absolute URL", rule, u)
+		}
+	}
+	m[repoURL] = mirrorURL
+	return nil
+}
+
+// Rewrite returns the mirror URL of the given URL or the URL itself if it is not mirrored.
+// When multiple mirrors match the one with the longest repository URL is used.
+func (m Mirrors) Rewrite(u string) string {
+	match := ""
+	for repoURL := range m {
+		if len(repoURL) > len(match) && (u == repoURL || strings.HasPrefix(u, repoURL+"/")) {
+			match = repoURL
+		}
+	}
+	if match == "" {
+		return u
+	}
+	return m[match] + u[len(match):]
+}
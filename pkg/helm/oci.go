@@ -0,0 +1,629 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	cli "k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+const (
+	ociScheme                 = "oci://"
+	ociManifestMediaType      = "application/vnd.oci.image.manifest.v1+json"
+	ociChartLayerMediaType    = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	ociLegacyChartMediaType   = "application/tar+gzip"
+	ociChartConfigMediaType   = "application/vnd.cncf.helm.config.v1+json"
+	ociDigestPrefix           = "sha256:"
+	dockerConfigFileName      = "config.json"
+	dockerDefaultRegistryHost = "index.docker.io"
+)
+
+var authParamRegex = regexp.MustCompile(`([a-zA-Z]+)="([^"]*)"`)
+
+// isOCIRepository returns true if the given repository refers to an OCI registry
+func isOCIRepository(repository string) bool {
+	return strings.HasPrefix(repository, ociScheme)
+}
+
+// locateOCIChart fetches the chart from an OCI registry if not present in cache and returns it.
+// The chart version is resolved using the lock file (if any) and recorded within it together with the chart layer's digest.
+func locateOCIChart(ctx context.Context, cfg *config.LoaderConfig, lock *lockFile, trustAnyRepo *bool, trustPolicy *TrustPolicy, registryConfigFile string, retryOpts RetryOptions, settings *cli.EnvSettings) (*cachedChartArchive, error) {
+	if cfg.Verify {
+		return nil, errors.Errorf("chart verification is not supported for OCI registry %s", cfg.Repository)
+	}
+	u, err := url.Parse(cfg.Repository)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse OCI repository URL %q", cfg.Repository)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("OCI repository URL %q does not specify a host", cfg.Repository)
+	}
+	auths, err := loadDockerConfig(registryConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := trustPolicy.check(cfg.Repository)
+	if err != nil {
+		return nil, err
+	}
+	// The credentials are looked up by the normalized host like they are mapped (docker.io refers to index.docker.io)
+	auth, hasAuth := auths[registryHost(u.Host)]
+	if !hasAuth && !allowed {
+		_, e := os.Stat(settings.Home.RepositoryFile())
+		if !isUnknownRepositoryTrusted(trustAnyRepo, e == nil, trustPolicy) {
+			err = errors.Errorf("OCI registry %q has no credentials configured within %s and usage of untrusted repositories is disabled", u.Host, registryConfigFile)
+			return nil, &untrustedRepoError{err}
+		}
+	}
+	name := strings.Trim(path.Join(u.Path, cfg.Chart), "/")
+	cacheDir := chartCacheDir(settings.Home)
+	version := cfg.Version
+	locked := lock.Get(cfg.Repository, cfg.Chart, cfg.Version)
+	if locked != nil {
+		version = locked.Version
+	}
+	if cfg.Offline {
+		lockedCfg := *cfg
+		lockedCfg.Version = version
+		cacheFile, digest, err := locateCachedOCIChart(&lockedCfg, u.Host, name, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		archive, err := readCachedChart(ctx, cacheFile, digest, cfg)
+		if err != nil {
+			if isNotExist(err) {
+				err = newNotCachedError(fmt.Sprintf("chart %s %s from %s", cfg.Chart, version, cfg.Repository))
+			}
+			return nil, err
+		}
+		if locked != nil {
+			if err = verifyDigest(bytes.NewReader(archive.Data), cacheFile, locked.Digest); err != nil {
+				return nil, errors.Wrapf(err, "cached chart %s %s does not match the digest locked within %s", cfg.Chart, version, lock.path)
+			}
+		}
+		return archive, nil
+	}
+	registry := newOCIRegistry(u.Host, auth, retryOpts)
+
+	reference, err := registry.ResolveReference(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+	cv, manifestDigest, err := registry.ChartVersion(ctx, name, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	chartURL := fmt.Sprintf("%s%s/%s/%s-%s.tgz", ociScheme, u.Host, name, cv.Name, cv.Version)
+	// The chart is locked by the name it is referenced with (which may differ from its metadata name)
+	lockedVersion := *cv
+	lockedVersion.Metadata = &chart.Metadata{Name: cfg.Chart, Version: cv.Version}
+	if err = lock.Lock(cfg.Repository, cfg.Version, &lockedVersion, chartURL); err != nil {
+		return nil, err
+	}
+	cacheFile, err := cacheFilePath(chartURL, cv, cacheDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive chart cache file")
+	}
+
+	archive, err := readCachedChartOrDownload(ctx, cacheFile, cv.Digest, cfg, func() error {
+		log.Printf("Pulling chart %s %s from OCI registry %s", cfg.Chart, cv.Version, u.Host)
+		return downloadToCache(ctx, filepath.Dir(cacheFile), func(tmpDir string) error {
+			tmpFile := filepath.Join(tmpDir, filepath.Base(cacheFile))
+			err := registry.DownloadBlob(ctx, name, ociDigestPrefix+cv.Digest, tmpFile)
+			return errors.Wrapf(err, "pull chart %q with version %q", cfg.Chart, cv.Version)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = recordOCIManifestDigest(ctx, cacheFile, manifestDigest, cv.Digest); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// ociManifestDigestFile returns the file within a cache entry directory
+// that maps the digest of a manifest the chart has been pulled with to the chart layer digest.
+func ociManifestDigestFile(entryDir, manifestDigest string) string {
+	return filepath.Join(entryDir, "manifest-"+strings.TrimPrefix(manifestDigest, ociDigestPrefix))
+}
+
+// recordOCIManifestDigest records the manifest digest the cached chart has been pulled with within its cache entry
+// so that a chart that is referenced by its manifest digest can be located in offline mode.
+func recordOCIManifestDigest(ctx context.Context, cacheFile, manifestDigest, layerDigest string) error {
+	dir := filepath.Dir(cacheFile)
+	file := ociManifestDigestFile(dir, manifestDigest)
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	unlock, err := lockPath(ctx, dir)
+	if err != nil {
+		if isReadOnly(errors.Cause(err)) {
+			return nil
+		}
+		return err
+	}
+	defer unlock()
+	if _, err = os.Stat(cacheFile); err != nil {
+		if os.IsNotExist(err) {
+			return nil // removed concurrently
+		}
+		return errors.WithStack(err)
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-manifest-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString(ociDigestPrefix + layerDigest + "\n")
+	if e := tmpFile.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return errors.Wrap(err, "write manifest digest")
+	}
+	return errors.Wrap(os.Rename(tmpFile.Name(), file), "write manifest digest")
+}
+
+// locateCachedOCIChart returns the path and digest of the latest cached chart that matches the given version (range)
+// or manifest digest without accessing the registry.
+func locateCachedOCIChart(cfg *config.LoaderConfig, host, name, cacheDir string) (string, string, error) {
+	errMsg := fmt.Sprintf("chart %s", cfg.Chart)
+	if cfg.Version != "" {
+		errMsg = fmt.Sprintf("%s %s", errMsg, cfg.Version)
+	}
+	notCachedErr := newNotCachedError(fmt.Sprintf("%s from %s", errMsg, cfg.Repository))
+	chartName := path.Base(name)
+	dir := filepath.Join(cacheDir, cacheHostSegment(host), filepath.FromSlash(name))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", errors.WithStack(err)
+	}
+	if strings.HasPrefix(cfg.Version, ociDigestPrefix) {
+		for _, f := range files {
+			if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			entryDir := filepath.Join(dir, f.Name())
+			b, err := ioutil.ReadFile(ociManifestDigestFile(entryDir, cfg.Version))
+			if err != nil {
+				continue
+			}
+			layerDigest := strings.TrimSpace(string(b))
+			archives, err := filepath.Glob(filepath.Join(entryDir, "*.tgz"))
+			if err == nil && len(archives) == 1 && strings.HasPrefix(layerDigest, ociDigestPrefix) {
+				return archives[0], layerDigest, nil
+			}
+		}
+		return "", "", notCachedErr
+	}
+	constraint := "*"
+	if cfg.Version != "" {
+		constraint = cfg.Version
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return "", "", errors.Wrap(err, "chart version")
+	}
+	var latest *semver.Version
+	latestFile := ""
+	for _, f := range files {
+		// Parse <name>-<version>-<digest> directory name
+		dirName := f.Name()
+		if !f.IsDir() || !strings.HasPrefix(dirName, chartName+"-") || len(dirName) < len(chartName)+18 {
+			continue
+		}
+		version := dirName[len(chartName)+1 : len(dirName)-17]
+		v, err := semver.NewVersion(version)
+		if err != nil || !c.Check(v) || latest != nil && !v.GreaterThan(latest) {
+			continue
+		}
+		file := filepath.Join(dir, dirName, fmt.Sprintf("%s-%s.tgz", chartName, version))
+		if _, err = os.Stat(file); err == nil {
+			latest = v
+			latestFile = file
+		}
+	}
+	if latestFile == "" {
+		return "", "", notCachedErr
+	}
+	return latestFile, cacheEntryDigest(latestFile), nil
+}
+
+type dockerConfig struct {
+	Auths map[string]dockerAuthConfig `json:"auths"`
+}
+
+type dockerAuthConfig struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// loadDockerConfig loads the credentials from a docker config file and maps them by registry host.
+func loadDockerConfig(file string) (map[string]dockerAuthConfig, error) {
+	auths := map[string]dockerAuthConfig{}
+	if file == "" {
+		return auths, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return auths, nil
+		}
+		return nil, errors.Wrap(err, "read registry config")
+	}
+	var cfg dockerConfig
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "parse registry config %s", file)
+	}
+	for key, auth := range cfg.Auths {
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode auth of registry %q in %s", key, file)
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return nil, errors.Errorf("invalid auth of registry %q in %s", key, file)
+			}
+			auth.Username, auth.Password = userPass[0], userPass[1]
+		}
+		auths[registryHost(key)] = auth
+	}
+	return auths, nil
+}
+
+// registryHost normalizes a docker config auths key to a registry host name
+func registryHost(key string) string {
+	host := key
+	if strings.Contains(host, "://") {
+		if u, err := url.Parse(host); err == nil {
+			host = u.Host
+		}
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		host = dockerDefaultRegistryHost
+	}
+	return host
+}
+
+type ociRegistry struct {
+	host   string
+	scheme string
+	auth   dockerAuthConfig
+	token  string
+	retry  RetryOptions
+	client *http.Client
+}
+
+func newOCIRegistry(host string, auth dockerAuthConfig, retryOpts RetryOptions) *ociRegistry {
+	scheme := "https"
+	if isLocalHost(host) {
+		scheme = "http"
+	}
+	return &ociRegistry{
+		host:   host,
+		scheme: scheme,
+		auth:   auth,
+		token:  auth.RegistryToken,
+		retry:  retryOpts,
+		client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+	}
+}
+
+// isLocalHost returns true if the host refers to the loopback interface.
+// Like docker khelm talks plain HTTP to a registry on localhost.
+func isLocalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ResolveReference maps the given version (range) or digest to a registry reference
+func (r *ociRegistry) ResolveReference(ctx context.Context, name, version string) (string, error) {
+	if strings.HasPrefix(version, ociDigestPrefix) {
+		return version, nil
+	}
+	isRange, err := isVersionRange(version)
+	if err != nil {
+		return "", err
+	}
+	if !isRange {
+		return ociTag(version), nil
+	}
+	constraint := "*"
+	if version != "" {
+		constraint = version
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return "", errors.Wrap(err, "chart version")
+	}
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if err = r.getJSON(ctx, fmt.Sprintf("/v2/%s/tags/list", name), "application/json", &tags); err != nil {
+		return "", errors.Wrapf(err, "list tags of %s", name)
+	}
+	var latest *semver.Version
+	for _, tag := range tags.Tags {
+		v, err := semver.NewVersion(strings.ReplaceAll(tag, "_", "+"))
+		if err != nil || !c.Check(v) {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+		}
+	}
+	if latest == nil {
+		return "", errors.Errorf("chart %q version %q not found in OCI registry %s", name, version, r.host)
+	}
+	return ociTag(latest.Original()), nil
+}
+
+// ociTag maps a chart version to an OCI tag since tags must not contain "+"
+func ociTag(version string) string {
+	return strings.ReplaceAll(version, "+", "_")
+}
+
+// ChartVersion returns the metadata of the chart with the given reference and the digest of its manifest.
+// The returned chart version's digest refers to the chart archive layer.
+func (r *ociRegistry) ChartVersion(ctx context.Context, name, reference string) (*repo.ChartVersion, string, error) {
+	manifest, manifestDigest, err := r.manifest(ctx, name, reference)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "get manifest %s:%s", name, reference)
+	}
+	var layer *ociDescriptor
+	for i, l := range manifest.Layers {
+		if l.MediaType == ociChartLayerMediaType || l.MediaType == ociLegacyChartMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, "", errors.Errorf("manifest %s:%s does not contain a chart layer", name, reference)
+	}
+	if !strings.HasPrefix(layer.Digest, ociDigestPrefix) {
+		return nil, "", errors.Errorf("unsupported chart layer digest %q within manifest %s:%s", layer.Digest, name, reference)
+	}
+	if manifest.Config.MediaType != ociChartConfigMediaType {
+		return nil, "", errors.Errorf("unexpected config media type %q within manifest %s:%s", manifest.Config.MediaType, name, reference)
+	}
+	meta := &chart.Metadata{}
+	err = r.getJSON(ctx, fmt.Sprintf("/v2/%s/blobs/%s", name, manifest.Config.Digest), ociChartConfigMediaType, meta)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "get chart metadata of %s:%s", name, reference)
+	}
+	if meta.Name == "" || meta.Version == "" {
+		return nil, "", errors.Errorf("chart metadata of %s:%s does not specify name and version", name, reference)
+	}
+	cv := &repo.ChartVersion{
+		Metadata: meta,
+		Digest:   strings.TrimPrefix(layer.Digest, ociDigestPrefix),
+		URLs:     []string{fmt.Sprintf("%s://%s/v2/%s/blobs/%s", r.scheme, r.host, name, layer.Digest)},
+	}
+	return cv, manifestDigest, nil
+}
+
+// manifest returns the manifest with the given reference and its digest.
+// When the reference is a digest the manifest is verified against it.
+func (r *ociRegistry) manifest(ctx context.Context, name, reference string) (*ociManifest, string, error) {
+	resp, err := r.get(ctx, fmt.Sprintf("/v2/%s/manifests/%s", name, reference), ociManifestMediaType)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	digest := fmt.Sprintf("%s%x", ociDigestPrefix, sha256.Sum256(b))
+	if strings.HasPrefix(reference, ociDigestPrefix) && reference != digest {
+		return nil, "", errors.Errorf("digest %s of the received manifest does not match the requested digest - it has been tampered with", digest)
+	}
+	var manifest ociManifest
+	if err = json.Unmarshal(b, &manifest); err != nil {
+		return nil, "", errors.Wrap(err, "decode manifest")
+	}
+	return &manifest, digest, nil
+}
+
+// DownloadBlob downloads a blob into the given file and verifies its digest
+func (r *ociRegistry) DownloadBlob(ctx context.Context, name, digest, destFile string) (err error) {
+	resp, err := r.get(ctx, fmt.Sprintf("/v2/%s/blobs/%s", name, digest), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = errors.WithStack(e)
+		}
+	}()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, hash), resp.Body); err != nil {
+		return errors.Wrapf(err, "download blob %s", digest)
+	}
+	if actual := ociDigestPrefix + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return errors.Errorf("digest %s of downloaded blob does not match the expected digest %s - it has been tampered with", actual, digest)
+	}
+	return nil
+}
+
+func (r *ociRegistry) getJSON(ctx context.Context, path, accept string, v interface{}) error {
+	resp, err := r.get(ctx, path, accept)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "decode %s response", path)
+}
+
+// get sends a GET request to the registry and authenticates when challenged.
+// Transient failures are retried.
+func (r *ociRegistry) get(ctx context.Context, path, accept string) (resp *http.Response, err error) {
+	u := fmt.Sprintf("%s://%s%s", r.scheme, r.host, path)
+	err = retry(ctx, r.retry, fmt.Sprintf("GET %s", u), func() (err error) {
+		resp, err = r.getOnce(ctx, u, accept)
+		return err
+	})
+	return resp, err
+}
+
+func (r *ociRegistry) getOnce(ctx context.Context, u, accept string) (*http.Response, error) {
+	resp, err := r.doGet(ctx, u, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+		if err = r.authenticate(ctx, challenge); err != nil {
+			return nil, errors.Wrapf(err, "authenticate to registry %s", r.host)
+		}
+		if resp, err = r.doGet(ctx, u, accept); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		// Formatted like helm's HttpGetter errors to be classified by isRetryable
+		return nil, errors.Errorf("failed to fetch %s : %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+func (r *ociRegistry) doGet(ctx context.Context, u, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	} else if r.auth.Username != "" {
+		req.SetBasicAuth(r.auth.Username, r.auth.Password)
+	}
+	resp, err := r.client.Do(req)
+	return resp, errors.WithStack(err)
+}
+
+// authenticate handles a registry's WWW-Authenticate challenge.
+// See https://docs.docker.com/registry/spec/auth/token/
+func (r *ociRegistry) authenticate(ctx context.Context, challenge string) error {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch scheme {
+	case "basic":
+		if r.auth.Username == "" {
+			return errors.New("no registry credentials configured")
+		}
+		return errors.New("registry rejected credentials")
+	case "bearer":
+	default:
+		return errors.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := map[string]string{}
+	for _, m := range authParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return errors.Errorf("invalid realm within authentication challenge %q", challenge)
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		q.Set("scope", scope)
+	}
+	var req *http.Request
+	if r.auth.IdentityToken != "" {
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", r.auth.IdentityToken)
+		q.Set("client_id", "khelm")
+		req, err = http.NewRequest(http.MethodPost, realm.String(), strings.NewReader(q.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		realm.RawQuery = q.Encode()
+		req, err = http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err == nil && r.auth.Username != "" {
+			req.SetBasicAuth(r.auth.Username, r.auth.Password)
+		}
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "request token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request token: %s %s: %s", req.Method, realm.Host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return errors.Wrap(err, "decode token response")
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return errors.New("token response does not contain a token")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/getter"
+)
+
+type notCachedError struct {
+	artifacts []string
+}
+
+func newNotCachedError(artifacts ...string) error {
+	return errors.WithStack(&notCachedError{artifacts})
+}
+
+func (e *notCachedError) Error() string {
+	artifacts := make([]string, len(e.artifacts))
+	copy(artifacts, e.artifacts)
+	sort.Strings(artifacts)
+	return fmt.Sprintf("offline mode: the following artifacts are not cached:\n * %s", strings.Join(artifacts, "\n * "))
+}
+
+// IsNotCached returns true if the provided error is caused by an artifact that is not cached while running in offline mode
+func IsNotCached(err error) bool {
+	_, ok := errors.Cause(err).(*notCachedError)
+	return ok
+}
+
+// offlineGetters returns getters that never access the network but fail with a not cached error
+func offlineGetters(providers getter.Providers) getter.Providers {
+	offline := make(getter.Providers, len(providers))
+	for i, p := range providers {
+		offline[i] = getter.Provider{
+			Schemes: p.Schemes,
+			New: func(_, _, _, _ string) (getter.Getter, error) {
+				return offlineGetter{}, nil
+			},
+		}
+	}
+	return offline
+}
+
+type offlineGetter struct{}
+
+func (g offlineGetter) Get(url string) (*bytes.Buffer, error) {
+	return nil, newNotCachedError(url)
+}
@@ -0,0 +1,120 @@
+package helm
+
+import (
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/mgoltzsche/khelm/internal/matcher"
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
+)
+
+// applyPatches applies the configured patches in order to the resources their targets select.
+// A resource is removed when a strategic merge patch deletes it.
+func applyPatches(resources []*yaml.RNode, patches []config.Patch) ([]*yaml.RNode, error) {
+	for i, p := range patches {
+		var err error
+		resources, err = applyPatch(resources, &p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "patches[%d]", i)
+		}
+	}
+	return resources, nil
+}
+
+func applyPatch(resources []*yaml.RNode, p *config.Patch) ([]*yaml.RNode, error) {
+	var smp *yaml.RNode
+	if len(p.StrategicMerge) > 0 {
+		var err error
+		if smp, err = yaml.FromMap(p.StrategicMerge); err != nil {
+			return nil, errors.Wrap(err, "strategicMerge")
+		}
+	}
+	target := p.Target
+	if target == nil {
+		target = smpTarget(smp)
+	}
+	targets := matcher.FromResourceSelectors([]config.ResourceSelector{*target})
+	r := make([]*yaml.RNode, 0, len(resources))
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if !targets.Match(&meta) {
+			r = append(r, o)
+			continue
+		}
+		if smp != nil {
+			if o, err = applyStrategicMergePatch(o, smp, &meta); err != nil {
+				return nil, errors.Wrapf(err, "strategicMerge patch %s %s", meta.Kind, meta.Name)
+			}
+			if o == nil {
+				continue
+			}
+		} else if err = applyJSONPatch(o, p.JSON6902); err != nil {
+			return nil, errors.Wrapf(err, "json6902 patch %s %s", meta.Kind, meta.Name)
+		}
+		r = append(r, o)
+	}
+	if err := targets.RequireAllMatched(); err != nil {
+		return nil, errors.Wrap(err, "patch target")
+	}
+	return r, nil
+}
+
+// smpTarget derives the target from the strategic merge patch's own type and object metadata
+func smpTarget(smp *yaml.RNode) *config.ResourceSelector {
+	meta, _ := smp.GetMeta()
+	return &config.ResourceSelector{
+		APIVersion: meta.APIVersion,
+		Kind:       meta.Kind,
+		Namespace:  meta.Namespace,
+		Name:       meta.Name,
+	}
+}
+
+func applyStrategicMergePatch(o, smp *yaml.RNode, meta *yaml.ResourceMeta) (*yaml.RNode, error) {
+	patch := smp.Copy()
+	// The resource type is required to look up the merge keys of lists
+	if err := patch.PipeE(yaml.SetField(yaml.APIVersionField, yaml.NewScalarRNode(meta.APIVersion))); err != nil {
+		return nil, err
+	}
+	if err := patch.PipeE(yaml.SetField(yaml.KindField, yaml.NewScalarRNode(meta.Kind))); err != nil {
+		return nil, err
+	}
+	return merge2.Merge(patch, o, yaml.MergeOptions{})
+}
+
+// applyJSONPatch applies JSON 6902 patch operations to the given resource in place (like kustomize's patchJson6902)
+func applyJSONPatch(o *yaml.RNode, ops []config.JSONPatchOperation) error {
+	rawOps := make([]map[string]interface{}, len(ops))
+	for i, op := range ops {
+		rawOp := map[string]interface{}{"op": op.Op, "path": op.Path}
+		switch op.Op {
+		case "move", "copy":
+			rawOp["from"] = op.From
+		case "add", "replace", "test":
+			rawOp["value"] = op.Value
+		}
+		rawOps[i] = rawOp
+	}
+	b, err := json.Marshal(rawOps)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	patch, err := jsonpatch.DecodePatch(b)
+	if err != nil {
+		return errors.Wrap(err, "decode patch")
+	}
+	doc, err := o.MarshalJSON()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if doc, err = patch.Apply(doc); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(o.UnmarshalJSON(doc))
+}
@@ -1,9 +1,24 @@
 package helm
 
 import (
+	"os"
 	"path/filepath"
+
+	"github.com/pkg/errors"
 )
 
+// absBaseDir returns the absolute base directory - the working directory if none specified
+func absBaseDir(baseDir string) (string, error) {
+	if baseDir != "" && filepath.IsAbs(baseDir) {
+		return baseDir, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(wd, baseDir), nil
+}
+
 func absPaths(paths []string, baseDir string) []string {
 	abs := make([]string, len(paths))
 	for i, path := range paths {
@@ -0,0 +1,74 @@
+package helm
+
+import (
+	"context"
+	"log"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// Prefetch downloads the chart, its transitive remote dependencies and the repository index files they refer to into the cache
+// without rendering the chart.
+// This allows to render the chart in offline mode afterwards.
+func (h *Helm) Prefetch(ctx context.Context, req *config.ChartConfig) error {
+	return h.prefetch(ctx, req, false)
+}
+
+// UpdateLock resolves the latest chart and remote dependency versions matching the configured constraints,
+// records them within the configured lock file and downloads them into the cache.
+func (h *Helm) UpdateLock(ctx context.Context, req *config.ChartConfig) error {
+	return h.prefetch(ctx, req, true)
+}
+
+func (h *Helm) prefetch(ctx context.Context, req *config.ChartConfig, updateLock bool) (err error) {
+	if req.BaseDir, err = absBaseDir(req.BaseDir); err != nil {
+		return err
+	}
+	if err = h.checkValueFiles(req); err != nil {
+		return err
+	}
+	for _, filePath := range req.ValueFiles {
+		if isRemoteValueFile(filePath) {
+			log.Printf("WARNING: remote values file %s is not prefetched and cannot be used in offline mode", filePath)
+		}
+	}
+	lock, err := loadLockFile(req, updateLock)
+	if err != nil {
+		return err
+	}
+	chartPath, err := h.localChartPath(ctx, req, lock)
+	if err != nil {
+		return errors.Wrapf(err, "prefetch chart %s", req.Chart)
+	}
+	if chartPath == "" {
+		if _, err = h.loadRemoteChart(ctx, req, lock); err != nil {
+			return errors.Wrapf(err, "prefetch chart %s", req.Chart)
+		}
+	} else if !isChartArchive(chartPath) { // a packaged chart contains its dependencies already
+		if err = h.prefetchDependencies(ctx, req, chartPath, lock); err != nil {
+			return errors.Wrapf(err, "prefetch chart %s dependencies", req.Chart)
+		}
+	}
+	return lock.Save()
+}
+
+// prefetchDependencies downloads the remote dependencies of the local chart and its local dependencies into the cache.
+// In contrast to the dependency build the chart directory is not modified.
+func (h *Helm) prefetchDependencies(ctx context.Context, cfg *config.ChartConfig, chartPath string, lock *lockFile) error {
+	localCharts, repos, unlock, err := h.prepareLocalCharts(ctx, cfg, chartPath, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer repos.Close()
+	settings := h.Settings
+	settings.Home = repos.HelmHome()
+	getters := h.getters(cfg)
+	for _, ch := range localCharts {
+		if _, err = fetchDependencies(ctx, ch, &cfg.LoaderConfig, lock, repos, &settings, getters); err != nil {
+			return err
+		}
+	}
+	return nil
+}
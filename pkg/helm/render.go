@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"log"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -27,26 +26,30 @@ func (h *Helm) Render(ctx context.Context, req *config.ChartConfig) (r []*yaml.R
 	if errs := req.Validate(); len(errs) > 0 {
 		return nil, errors.Errorf("invalid chart renderer config:\n * %s", strings.Join(errs, "\n * "))
 	}
-	wd, err := os.Getwd()
-	if err != nil {
-		return nil, errors.WithStack(err)
+	if req.BaseDir, err = absBaseDir(req.BaseDir); err != nil {
+		return nil, err
 	}
-	if req.BaseDir == "" {
-		req.BaseDir = wd
-	} else if !filepath.IsAbs(req.BaseDir) {
-		req.BaseDir = filepath.Join(wd, req.BaseDir)
+	if err = h.checkValueFiles(req); err != nil {
+		return nil, err
 	}
 
-	chartRequested, err := h.loadChart(ctx, req)
+	lock, err := loadLockFile(req, false)
+	if err != nil {
+		return nil, err
+	}
+	chartRequested, err := h.loadChart(ctx, req, lock)
 	if err != nil {
 		return nil, errors.Wrapf(err, "load chart %s", req.Chart)
 	}
+	if err = lock.Save(); err != nil {
+		return nil, err
+	}
 
 	log.Printf("Rendering chart %s %s with name %q and namespace %q", chartRequested.Metadata.Name, chartRequested.Metadata.Version, req.Name, req.Namespace)
 
 	ch := make(chan struct{}, 1)
 	go func() {
-		r, err = renderChart(chartRequested, req, h.Getters)
+		r, err = renderChart(chartRequested, req, h.getters(req))
 		ch <- struct{}{}
 	}()
 	select {
@@ -72,11 +75,14 @@ func renderChart(chrt *chart.Chart, req *config.ChartConfig, getters getter.Prov
 	if len(req.APIVersions) > 0 {
 		renderOpts.APIVersions = append(req.APIVersions, "v1")
 	}
-	rawVals, err := vals(chrt, req.ValueFiles, req.Values, req.BaseDir, getters, "", "", "")
+	rawVals, err := vals(chrt, req.ValueFiles, req.Values, req.BaseDir, getters)
 	if err != nil {
 		return nil, errors.Wrapf(err, "load values for chart %s", chrt.Metadata.Name)
 	}
 	config := &chart.Config{Raw: string(rawVals), Values: map[string]*chart.Value{}}
+	if err = removeMissingDisabledDependencies(chrt, config); err != nil {
+		return nil, errors.Wrapf(err, "chart %s", chrt.Metadata.Name)
+	}
 
 	renderedTemplates, err := renderutil.Render(chrt, config, renderOpts)
 	if err != nil {
@@ -95,10 +101,14 @@ func renderChart(chrt *chart.Chart, req *config.ChartConfig, getters getter.Prov
 	}
 
 	transformer := manifestTransformer{
-		ForceNamespace: req.ForceNamespace,
-		Includes:       inclusions,
-		Excludes:       matcher.FromResourceSelectors(req.Exclude),
-		NamespacedOnly: req.NamespacedOnly,
+		ForceNamespace:           req.ForceNamespace,
+		Includes:                 inclusions,
+		Excludes:                 matcher.FromResourceSelectors(req.Exclude),
+		NamespacedOnly:           req.NamespacedOnly,
+		CommonLabels:             req.CommonLabels,
+		CommonLabelSelectors:     req.CommonLabelSelectors,
+		CommonLabelsPodTemplates: req.CommonLabelsPodTemplates,
+		CommonAnnotations:        req.CommonAnnotations,
 	}
 	chartHookMatcher := matcher.NewChartHookMatcher(transformer.Excludes, !req.ExcludeHooks)
 	transformer.Excludes = chartHookMatcher
@@ -124,11 +134,29 @@ func renderChart(chrt *chart.Chart, req *config.ChartConfig, getters getter.Prov
 		return nil, errors.Wrap(err, "resource exclusion")
 	}
 
+	if req.StripHelmMetadata {
+		if err = stripHelmMetadata(r, req.ManagedBy); err != nil {
+			return nil, errors.Wrap(err, "strip helm metadata")
+		}
+	}
+
+	if r, err = convertHooks(r, req.HookMode, req.StripHookDeletePolicy, req.ForceNamespace); err != nil {
+		return nil, err
+	}
+
+	if err = transformImages(r, req.Images); err != nil {
+		return nil, errors.Wrap(err, "images")
+	}
+
+	if r, err = applyPatches(r, req.Patches); err != nil {
+		return nil, err
+	}
+
 	if len(r) == 0 {
 		return nil, errors.Errorf("no output since all resources were excluded")
 	}
 
-	if hooks := chartHookMatcher.FoundHooks(); !req.ExcludeHooks && len(hooks) > 0 {
+	if hooks := chartHookMatcher.FoundHooks(); !req.ExcludeHooks && !convertsHooks(req.HookMode) && len(hooks) > 0 {
 		log.Printf("WARNING: The chart output contains the following hooks: %s", strings.Join(hooks, ", "))
 	}
 
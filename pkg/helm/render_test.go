@@ -1,29 +1,53 @@
 package helm
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	helmyaml "github.com/ghodss/yaml"
 	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
 	"gopkg.in/yaml.v3"
+	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/getter"
 	cli "k8s.io/helm/pkg/helm/environment"
 	"k8s.io/helm/pkg/helm/helmpath"
 	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
 	"k8s.io/helm/pkg/repo"
+	"k8s.io/helm/pkg/resolver"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 var rootDir = func() string {
@@ -55,6 +79,9 @@ func TestRender(t *testing.T) {
 		{"release-name", "example/release-name/generator.yaml", []string{}, "  name: my-release-name-config", nil},
 		{"exclude", "example/exclude/generator.yaml", []string{"cluster-role-binding-ns"}, "  key: b", nil},
 		{"include", "example/include/generator.yaml", []string{}, "  key: b", nil},
+		{"patches", "example/patches/generator.yaml", []string{"myns"}, "  key: patched-b", nil},
+		{"images", "example/images/generator.yaml", []string{}, "image: mirror.example.org/example/app@sha256:", nil},
+		{"common-labels", "example/common-labels/generator.yaml", []string{}, "    team: myteam\n", nil},
 		{"local-chart-with-local-dependency-and-transitive-remote", "example/localrefref/generator.yaml", []string{}, "rook-ceph-v0.9.3", nil},
 		{"local-chart-with-remote-dependency", "example/localref/generator.yaml", []string{}, "rook-ceph-v0.9.3", nil},
 		{"values-inheritance", "example/values-inheritance/generator.yaml", []string{}, " inherited: inherited value\n  fileoverwrite: overwritten by file\n  valueoverwrite: overwritten by generator config", nil},
@@ -163,6 +190,338 @@ func TestRenderExclusionNoMatchError(t *testing.T) {
 	require.Error(t, err, "render %s", file)
 }
 
+func TestRenderPatches(t *testing.T) {
+	file := filepath.Join(rootDir, "example/patches/generator.yaml")
+	buf := bytes.Buffer{}
+	err := renderFile(t, file, true, rootDir, &buf)
+	require.NoError(t, err, "render %s", file)
+	rendered := buf.String()
+	require.Contains(t, rendered, "\n    patched: strategic-merge\n", "strategic merge patch")
+	require.Contains(t, rendered, "  key: patched-a\n", "strategic merge patch")
+	require.Contains(t, rendered, "\n    example.org/patched: json6902\n", "json6902 patch")
+	require.Contains(t, rendered, "  key: patched-b\n", "json6902 patch")
+	require.NotContains(t, rendered, "  key: a\n", "unpatched")
+}
+
+func TestRenderPatchNoMatchError(t *testing.T) {
+	file := filepath.Join(rootDir, "example/patches-nomatch/generator.yaml")
+	err := renderFile(t, file, true, rootDir, &bytes.Buffer{})
+	require.Error(t, err, "render %s", file)
+}
+
+func TestRenderJSONPatchErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		op   config.JSONPatchOperation
+	}{
+		{"invalid op", config.JSONPatchOperation{Op: "invalid", Path: "/data"}},
+		{"move into own child", config.JSONPatchOperation{Op: "move", From: "/data", Path: "/data/moved"}},
+		{"failed test", config.JSONPatchOperation{Op: "test", Path: "/data/key", Value: "unexpected"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.NewChartConfig()
+			cfg.Chart = filepath.Join(rootDir, "example/namespace")
+			cfg.Name = "myrelease"
+			cfg.Patches = []config.Patch{{
+				Target:   &config.ResourceSelector{Kind: "ConfigMap", Name: "myconfigb"},
+				JSON6902: []config.JSONPatchOperation{c.op},
+			}}
+			err := render(t, *cfg, false, &bytes.Buffer{})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRenderImages(t *testing.T) {
+	file := filepath.Join(rootDir, "example/images/generator.yaml")
+	buf := bytes.Buffer{}
+	err := renderFile(t, file, true, rootDir, &buf)
+	require.NoError(t, err, "render %s", file)
+	rendered := buf.String()
+	require.Equal(t, 2, strings.Count(rendered, " image: busybox:1.33\n"), "init container and cron job image")
+	require.Contains(t, rendered, " image: mirror.example.org/example/app@sha256:1111111111111111111111111111111111111111111111111111111111111111\n", "registry and digest")
+	require.Contains(t, rendered, " image: example/sidecar:2.0.0\n", "name and tag")
+
+	cfg, err := config.ReadGeneratorConfig(strings.NewReader("apiVersion: khelm.mgoltzsche.github.com/v1\nkind: ChartRenderer\nmetadata:\n  name: myrelease\n  namespace: myns\nchart: example/images\nimages:\n- name: nginx\n  newTag: 1.19\n- name: docker.io/library/busybox\n  newTag: 1.34\n"))
+	require.NoError(t, err)
+	cfg.BaseDir = rootDir
+	buf.Reset()
+	err = render(t, cfg.ChartConfig, false, &buf)
+	require.NoError(t, err, "render with unmatched image")
+	rendered = buf.String()
+	require.Equal(t, 2, strings.Count(rendered, " image: busybox:1.34\n"), "normalized Docker Hub image name")
+	require.Contains(t, rendered, " image: docker.io/example/app:1.0.0\n", "unchanged image")
+}
+
+func TestRenderCommonLabels(t *testing.T) {
+	file := filepath.Join(rootDir, "example/common-labels/generator.yaml")
+	for _, c := range []struct {
+		selectors    bool
+		podTemplates bool
+	}{{true, false}, {false, true}, {false, false}} {
+		selectors := c.selectors
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		cfg, err := config.ReadGeneratorConfig(f)
+		f.Close()
+		require.NoError(t, err)
+		cfg.BaseDir = filepath.Dir(file)
+		cfg.CommonLabelSelectors = selectors
+		cfg.CommonLabelsPodTemplates = c.podTemplates
+		buf := bytes.Buffer{}
+		err = render(t, cfg.ChartConfig, false, &buf)
+		require.NoError(t, err, "render %s", file)
+		resources := map[string]map[string]interface{}{}
+		dec := yaml.NewDecoder(&buf)
+		for {
+			o := map[string]interface{}{}
+			if err = dec.Decode(&o); err != nil {
+				require.Equal(t, io.EOF, err, "decode output")
+				break
+			}
+			resources[fmt.Sprintf("%s/%s", o["kind"], o["metadata"].(map[string]interface{})["name"])] = o
+		}
+		expectedLabels := map[string]interface{}{"team": "myteam", "cost-center": "1234"}
+		expectedAnnotations := map[string]interface{}{"example.org/owner": "myteam"}
+		for name, o := range resources {
+			meta := o["metadata"].(map[string]interface{})
+			require.Equal(t, expectedAnnotations, meta["annotations"], "%s annotations", name)
+			for k, v := range expectedLabels {
+				require.Equal(t, v, meta["labels"].(map[string]interface{})[k], "%s label %s", name, k)
+			}
+		}
+		lookup := func(name string, path ...string) interface{} {
+			var v interface{} = resources[name]
+			for _, k := range path {
+				m, ok := v.(map[string]interface{})
+				require.True(t, ok, "%s: %s is not an object", name, k)
+				v = m[k]
+			}
+			return v
+		}
+		expectedTplLabel := interface{}(nil)
+		if selectors || c.podTemplates {
+			expectedTplLabel = "myteam"
+		}
+		tplLabels := lookup("Deployment/myrelease-app", "spec", "template", "metadata", "labels").(map[string]interface{})
+		require.Equal(t, expectedTplLabel, tplLabels["team"], "Deployment pod template label (%+v)", c)
+		require.Equal(t, "myrelease-app", tplLabels["app"], "Deployment pod template label")
+		require.Equal(t, expectedAnnotations, lookup("Deployment/myrelease-app", "spec", "template", "metadata", "annotations"), "Deployment pod template annotations")
+		cronJobTplLabels, _ := lookup("CronJob/myrelease-job", "spec", "jobTemplate", "spec", "template", "metadata", "labels").(map[string]interface{})
+		require.Equal(t, expectedTplLabel, cronJobTplLabels["team"], "CronJob pod template label (%+v)", c)
+		require.Nil(t, lookup("Service/myrelease-external", "spec", "selector"), "Service without selector")
+		expectedSelectorLabel := interface{}(nil)
+		if selectors {
+			expectedSelectorLabel = "myteam"
+		}
+		require.Equal(t, expectedSelectorLabel, lookup("Deployment/myrelease-app", "spec", "selector", "matchLabels", "team"), "Deployment selector (selectors: %v)", selectors)
+		require.Equal(t, expectedSelectorLabel, lookup("Service/myrelease-app", "spec", "selector", "team"), "Service selector (selectors: %v)", selectors)
+	}
+}
+
+func TestRenderHookModes(t *testing.T) {
+	file := filepath.Join(rootDir, "example/chart-hooks/generator.yaml")
+	for _, c := range []struct {
+		mode               string
+		stripDeletePolicy  bool
+		expectedNames      []string
+		expectedAnnotation map[string]map[string]string
+	}{
+		{config.HookModePlain, true, []string{"chart-hooks-pre-install", "chart-hooks-pre-upgrade", "chart-hooks-myconfig", "chart-hooks-post-install", "chart-hooks-post-upgrade"}, map[string]map[string]string{
+			"chart-hooks-pre-install": nil,
+			"chart-hooks-myconfig":    nil,
+		}},
+		{config.HookModeArgoCD, false, []string{"chart-hooks-myconfig", "chart-hooks-post-install", "chart-hooks-post-upgrade", "chart-hooks-pre-install", "chart-hooks-pre-upgrade"}, map[string]map[string]string{
+			"chart-hooks-pre-install": {
+				"argocd.argoproj.io/hook":               "PreSync",
+				"argocd.argoproj.io/sync-wave":          "-5",
+				"argocd.argoproj.io/hook-delete-policy": "HookSucceeded",
+			},
+			"chart-hooks-post-upgrade": {
+				"argocd.argoproj.io/hook":               "PostSync",
+				"argocd.argoproj.io/sync-wave":          "-5",
+				"argocd.argoproj.io/hook-delete-policy": "HookSucceeded",
+			},
+			"chart-hooks-myconfig": nil,
+		}},
+		{config.HookModeKpt, true, []string{"chart-hooks-pre-install", "chart-hooks-pre-upgrade", "chart-hooks-myconfig", "chart-hooks-post-install", "chart-hooks-post-upgrade"}, map[string]map[string]string{
+			"chart-hooks-pre-install": nil,
+			"chart-hooks-myconfig": {
+				"config.kubernetes.io/depends-on": "batch/namespaces/default/Job/chart-hooks-pre-install,batch/namespaces/default/Job/chart-hooks-pre-upgrade",
+			},
+			"chart-hooks-post-install": {
+				"config.kubernetes.io/depends-on": "/namespaces/default/ConfigMap/chart-hooks-myconfig",
+			},
+		}},
+	} {
+		t.Run(c.mode, func(t *testing.T) {
+			f, err := os.Open(file)
+			require.NoError(t, err)
+			cfg, err := config.ReadGeneratorConfig(f)
+			f.Close()
+			require.NoError(t, err)
+			cfg.BaseDir = filepath.Dir(file)
+			cfg.HookMode = c.mode
+			cfg.StripHookDeletePolicy = c.stripDeletePolicy
+			buf := bytes.Buffer{}
+			err = render(t, cfg.ChartConfig, false, &buf)
+			require.NoError(t, err, "render %s", file)
+			names := []string{}
+			annotations := map[string]map[string]string{}
+			dec := yaml.NewDecoder(&buf)
+			for {
+				o := struct {
+					Metadata struct {
+						Name        string
+						Annotations map[string]string
+					}
+				}{}
+				if err = dec.Decode(&o); err != nil {
+					require.Equal(t, io.EOF, err, "decode output")
+					break
+				}
+				names = append(names, o.Metadata.Name)
+				annotations[o.Metadata.Name] = o.Metadata.Annotations
+			}
+			require.Equal(t, c.expectedNames, names, "resource names")
+			for name, expected := range c.expectedAnnotation {
+				require.Equal(t, expected, annotations[name], "%s annotations", name)
+			}
+		})
+	}
+
+	cfg := config.NewChartConfig()
+	cfg.Chart = filepath.Join(rootDir, "example/chart-hooks")
+	cfg.HookMode = "unsupported"
+	err := render(t, *cfg, false, &bytes.Buffer{})
+	require.Error(t, err, "unsupported hook mode")
+}
+
+func TestConvertHooksWeightOrder(t *testing.T) {
+	var resources []*kyaml.RNode
+	for _, o := range []string{
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n  namespace: myns",
+		"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: pre-b\n  annotations:\n    helm.sh/hook: pre-install\n    helm.sh/hook-weight: \"5\"",
+		"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: pre-a\n  annotations:\n    helm.sh/hook: pre-install,pre-upgrade\n    helm.sh/hook-weight: \"-1\"",
+		"apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: pre-c\n  annotations:\n    helm.sh/hook: pre-install\n    helm.sh/hook-weight: \"5\"",
+		"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: post\n  annotations:\n    helm.sh/hook: post-install\n    config.kubernetes.io/depends-on: /namespaces/other/Secret/mysecret",
+		"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: delete\n  annotations:\n    helm.sh/hook: pre-delete",
+	} {
+		resources = append(resources, kyaml.MustParse(o))
+	}
+	converted, err := convertHooks(resources, config.HookModeKpt, false, "default")
+	require.NoError(t, err)
+	names := make([]string, len(converted))
+	dependencies := map[string]string{}
+	for i, o := range converted {
+		meta, err := o.GetMeta()
+		require.NoError(t, err)
+		names[i] = meta.Name
+		dependencies[meta.Name] = meta.Annotations["config.kubernetes.io/depends-on"]
+		require.Empty(t, meta.Annotations["helm.sh/hook"], "%s hook annotation", meta.Name)
+	}
+	require.Equal(t, []string{"pre-a", "pre-b", "pre-c", "config", "post"}, names, "order")
+	require.Equal(t, map[string]string{
+		"pre-a":  "",
+		"pre-b":  "batch/namespaces/default/Job/pre-a",
+		"pre-c":  "batch/namespaces/default/Job/pre-a",
+		"config": "batch/namespaces/default/Job/pre-b,rbac.authorization.k8s.io/ClusterRole/pre-c",
+		"post":   "/namespaces/other/Secret/mysecret,/namespaces/myns/ConfigMap/config",
+	}, dependencies, "dependencies")
+}
+
+func TestConvertHooksArgoCDCRD(t *testing.T) {
+	var resources []*kyaml.RNode
+	for _, o := range []string{
+		"apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: mycrd\n  annotations:\n    helm.sh/hook: crd-install\n    helm.sh/hook-delete-policy: before-hook-creation",
+		"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: pre\n  annotations:\n    helm.sh/hook: pre-install\n    helm.sh/hook-delete-policy: before-hook-creation",
+	} {
+		resources = append(resources, kyaml.MustParse(o))
+	}
+	converted, err := convertHooks(resources, config.HookModeArgoCD, false, "")
+	require.NoError(t, err)
+	annotations := map[string]map[string]string{}
+	for _, o := range converted {
+		meta, err := o.GetMeta()
+		require.NoError(t, err)
+		annotations[meta.Name] = meta.Annotations
+	}
+	require.Equal(t, map[string]map[string]string{
+		"mycrd": {"argocd.argoproj.io/sync-wave": "-1"},
+		"pre": {
+			"argocd.argoproj.io/hook":               "PreSync",
+			"argocd.argoproj.io/sync-wave":          "0",
+			"argocd.argoproj.io/hook-delete-policy": "BeforeHookCreation",
+		},
+	}, annotations, "annotations")
+}
+
+func TestStripHelmMetadataMatchExpressions(t *testing.T) {
+	o := kyaml.MustParse(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    helm.sh/chart: mychart-0.1.0
+    heritage: Helm
+    app.kubernetes.io/managed-by: Helm
+spec:
+  selector:
+    matchExpressions:
+    - key: heritage
+      operator: In
+      values: [Tiller, Helm]
+    - key: helm.sh/chart
+      operator: Exists
+  template:
+    metadata:
+      labels:
+        helm.sh/chart: mychart-0.1.0
+        heritage: Helm
+        app.kubernetes.io/managed-by: Helm`)
+	err := stripHelmMetadata([]*kyaml.RNode{o}, "")
+	require.NoError(t, err)
+	meta, err := o.GetMeta()
+	require.NoError(t, err)
+	expected := map[string]string{"helm.sh/chart": "mychart-0.1.0", "heritage": "Helm"}
+	require.Equal(t, expected, meta.Labels, "labels")
+	tplLabels, err := o.Pipe(kyaml.Lookup("spec", "template", "metadata", "labels"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"helm.sh/chart": "mychart-0.1.0", "heritage": "Helm"}, tplLabels.Map(), "pod template labels")
+}
+
+func TestRenderStripHelmMetadata(t *testing.T) {
+	file := filepath.Join(rootDir, "example/strip-helm-metadata/generator.yaml")
+	for _, managedBy := range []string{"kpt", ""} {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		cfg, err := config.ReadGeneratorConfig(f)
+		f.Close()
+		require.NoError(t, err)
+		cfg.BaseDir = filepath.Dir(file)
+		cfg.ManagedBy = managedBy
+		buf := bytes.Buffer{}
+		err = render(t, cfg.ChartConfig, false, &buf)
+		require.NoError(t, err, "render %s", file)
+		l, err := readYaml(buf.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, 2, len(l), "resources")
+		expectedLabels := map[string]interface{}{"app": "myrelease-app", "heritage": "Tiller"}
+		if managedBy != "" {
+			expectedLabels["app.kubernetes.io/managed-by"] = managedBy
+		}
+		deployment, configMap := l[0], l[1]
+		if deployment["kind"] != "Deployment" {
+			deployment, configMap = configMap, deployment
+		}
+		spec := deployment["spec"].(map[string]interface{})
+		require.Equal(t, expectedLabels, deployment["metadata"].(map[string]interface{})["labels"], "labels (managedBy: %q)", managedBy)
+		require.Equal(t, expectedLabels, spec["template"].(map[string]interface{})["metadata"].(map[string]interface{})["labels"], "pod template labels (managedBy: %q)", managedBy)
+		require.Equal(t, map[string]interface{}{"app": "myrelease-app", "heritage": "Tiller"}, spec["selector"].(map[string]interface{})["matchLabels"], "selector")
+		require.Equal(t, map[string]interface{}{"name": "myrelease-config"}, configMap["metadata"], "ConfigMap metadata")
+	}
+}
+
 func TestRenderRebuildsLocalDependencies(t *testing.T) {
 	tplDir := filepath.Join(rootDir, "example/localref/intermediate-chart/templates")
 	tplFile := filepath.Join(tplDir, "changed.yaml")
@@ -188,13 +547,314 @@ func TestRenderRebuildsLocalDependencies(t *testing.T) {
 	require.Contains(t, rendered.String(), "changedField: changed-value", "local dependency changes should be reflected within the rendered output")
 }
 
+func TestRenderChartAPIVersionV2(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-chart-v2-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+
+	// Local chart of apiVersion v2 with remote, local and disabled dependencies
+	parentChartDir := filepath.Join(tmpDir, "parent")
+	childChartDir := filepath.Join(tmpDir, "child")
+	parentChartYAML := fmt.Sprintf(`apiVersion: v2
+name: parent
+version: 0.1.0
+type: application
+dependencies:
+- name: release-name
+  version: 0.1.x
+  repository: %[1]s
+- name: child
+  version: 0.1.0
+  repository: file://../child
+- name: namespace
+  version: 0.1.0
+  repository: %[1]s
+  condition: namespace.enabled
+`, chartRepo.URL)
+	for file, content := range map[string]string{
+		filepath.Join(parentChartDir, "Chart.yaml"):              parentChartYAML,
+		filepath.Join(parentChartDir, "values.yaml"):             "namespace:\n  enabled: false\n",
+		filepath.Join(childChartDir, "Chart.yaml"):               "apiVersion: v2\nname: child\nversion: 0.1.0\n",
+		filepath.Join(childChartDir, "templates", "config.yaml"): "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: child-config\n",
+	} {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(file, []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	cfg := config.NewChartConfig()
+	cfg.Chart = parentChartDir
+	cfg.Name = "myrelease"
+	var rendered bytes.Buffer
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render")
+	require.Contains(t, rendered.String(), "name: myrelease-config", "remote dependency output")
+	require.Contains(t, rendered.String(), "name: child-config", "local dependency output")
+	require.NotContains(t, rendered.String(), "name: myconfiga", "output of dependency disabled by condition")
+
+	// The chart directory should not be modified
+	for _, file := range []string{"charts", "Chart.lock", "requirements.yaml", "requirements.lock"} {
+		_, err = os.Stat(filepath.Join(parentChartDir, file))
+		require.True(t, os.IsNotExist(err), "chart dir should not contain %s", file)
+	}
+
+	// Render using a Chart.lock
+	req := chartutil.Requirements{}
+	err = helmyaml.Unmarshal([]byte(parentChartYAML), &req)
+	require.NoError(t, err)
+	lock := chartutil.RequirementsLock{Dependencies: copyDependencies(req.Dependencies)}
+	lock.Dependencies[0].Version = "0.1.0"
+	lock.Digest, err = chartV2LockDigest(req.Dependencies, lock.Dependencies)
+	require.NoError(t, err)
+	b, err := helmyaml.Marshal(&lock)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(parentChartDir, "Chart.lock"), b, 0644)
+	require.NoError(t, err)
+	rendered.Reset()
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render with Chart.lock")
+	require.Contains(t, rendered.String(), "name: myrelease-config", "remote dependency output")
+	require.Contains(t, rendered.String(), "name: child-config", "local dependency output")
+
+	// Chart.lock out of sync
+	err = ioutil.WriteFile(filepath.Join(parentChartDir, "Chart.yaml"), []byte(strings.Replace(parentChartYAML, "0.1.x", "0.1.0", 1)), 0644)
+	require.NoError(t, err)
+	err = render(t, *cfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render with Chart.lock out of sync")
+	require.Contains(t, err.Error(), "Chart.lock is out of sync with Chart.yaml")
+	replaceCfg := *cfg
+	replaceCfg.ReplaceLockFile = true
+	err = render(t, replaceCfg, true, &bytes.Buffer{})
+	require.NoError(t, err, "render with Chart.lock out of sync and replaceLockFile enabled")
+	b2, err := ioutil.ReadFile(filepath.Join(parentChartDir, "Chart.lock"))
+	require.NoError(t, err, "Chart.lock should not be removed")
+	require.Equal(t, string(b), string(b2), "Chart.lock should not be modified")
+
+	// Chart archive of apiVersion v2 that contains a subchart archive of apiVersion v2
+	subchartTgz := chartArchive(t, map[string]string{
+		"sub/Chart.yaml":             "apiVersion: v2\nname: sub\nversion: 0.2.0\n",
+		"sub/templates/config.yaml":  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: sub-config\n",
+		"sub/charts/.ignored/dummy":  "ignored",
+		"sub/templates/_helpers.tpl": "",
+	})
+	chartTgz := filepath.Join(tmpDir, "archived-0.1.0.tgz")
+	err = ioutil.WriteFile(chartTgz, chartArchive(t, map[string]string{
+		"archived/Chart.yaml":           "apiVersion: v2\nname: archived\nversion: 0.1.0\ndependencies:\n- name: sub\n  version: 0.2.0\n  repository: file://../sub\n  condition: sub.enabled\n",
+		"archived/charts/sub-0.2.0.tgz": string(subchartTgz),
+	}), 0644)
+	require.NoError(t, err)
+	ch, err := loadChartPath(chartTgz)
+	require.NoError(t, err, "load chart archive")
+	require.Equal(t, 1, len(ch.Dependencies), "subcharts")
+	require.Equal(t, "sub", ch.Dependencies[0].Metadata.Name, "subchart name")
+	archiveReq, err := chartutil.LoadRequirements(ch)
+	require.NoError(t, err, "requirements of loaded chart archive")
+	require.Equal(t, 1, len(archiveReq.Dependencies), "requirements of loaded chart archive")
+	require.Equal(t, "sub.enabled", archiveReq.Dependencies[0].Condition, "dependency condition")
+}
+
+func TestRenderSkipsDisabledDependencies(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-disabled-deps-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	slowRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"))
+	defer slowRepo.Close()
+
+	chartDir := filepath.Join(tmpDir, "conditional")
+	requirements := fmt.Sprintf(`dependencies:
+- name: release-name
+  version: 0.1.x
+  repository: %s
+  condition: release-name.enabled
+- name: namespace
+  version: 0.1.x
+  repository: %s
+  tags:
+  - ns
+`, chartRepo.URL, slowRepo.URL)
+	for file, content := range map[string]string{
+		"Chart.yaml":        "apiVersion: v1\nname: conditional\nversion: 0.1.0\n",
+		"requirements.yaml": requirements,
+		"values.yaml":       "release-name:\n  enabled: false\ntags:\n  ns: true\n",
+	} {
+		err = os.MkdirAll(chartDir, 0755)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(chartDir, file), []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	cfg := config.NewChartConfig()
+	cfg.Chart = chartDir
+	cfg.Name = "myrelease"
+	cfg.Values = map[string]interface{}{
+		"release-name": map[string]interface{}{"enabled": true},
+		"tags":         map[string]interface{}{"ns": false},
+	}
+	var rendered bytes.Buffer
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render")
+	require.Contains(t, rendered.String(), "name: myrelease-config", "output of dependency enabled by condition")
+	require.NotContains(t, rendered.String(), "name: myconfiga", "output of dependency disabled by tag")
+	require.Equal(t, 0, len(slowRepo.Requests()), "requests to the repository of the disabled dependency")
+	for _, file := range []string{"charts", "requirements.lock"} {
+		_, err = os.Stat(filepath.Join(chartDir, file))
+		require.True(t, os.IsNotExist(err), "chart dir should not contain %s", file)
+	}
+
+	// The disabled dependency should not be fetched when it is listed within the lock file
+	lock := fmt.Sprintf(`dependencies:
+- name: release-name
+  version: 0.1.0
+  repository: %s
+- name: namespace
+  version: 0.1.0
+  repository: %s
+`, chartRepo.URL, slowRepo.URL)
+	ch, err := loadChartPath(chartDir)
+	require.NoError(t, err)
+	req, err := chartutil.LoadRequirements(ch)
+	require.NoError(t, err)
+	digest, err := resolver.HashReq(req)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(chartDir, "requirements.lock"), []byte(lock+"digest: "+digest+"\n"), 0644)
+	require.NoError(t, err)
+	slowRepo.Close()
+	rendered.Reset()
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render with lock file while repository of disabled dependency is unavailable")
+	require.Contains(t, rendered.String(), "name: myrelease-config")
+}
+
+func TestUpdateAndBuildDependencies(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-dep-update-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+
+	// Local chart of apiVersion v2 with a remote dependency, a disabled one and a local one of apiVersion v1 with a remote dependency
+	parentChartDir := filepath.Join(tmpDir, "parent")
+	childChartDir := filepath.Join(tmpDir, "child")
+	parentChartYAML := fmt.Sprintf(`apiVersion: v2
+name: parent
+version: 0.1.0
+dependencies:
+- name: release-name
+  version: 0.1.x
+  repository: %[1]s
+- name: namespace
+  version: 0.1.x
+  repository: %[1]s
+  condition: namespace.enabled
+- name: child
+  version: 0.1.0
+  repository: file://../child
+`, chartRepo.URL)
+	for file, content := range map[string]string{
+		filepath.Join(parentChartDir, "Chart.yaml"):         parentChartYAML,
+		filepath.Join(parentChartDir, "values.yaml"):        "namespace:\n  enabled: false\n",
+		filepath.Join(childChartDir, "Chart.yaml"):          "apiVersion: v1\nname: child\nversion: 0.1.0\n",
+		filepath.Join(childChartDir, "requirements.yaml"):   fmt.Sprintf("dependencies:\n- name: namespace\n  version: 0.1.0\n  repository: %s\n", chartRepo.URL),
+		filepath.Join(childChartDir, "templates", "a.yaml"): "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: child-config\n",
+	} {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(file, []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	chartFiles := func(dir string) []string {
+		files, err := ioutil.ReadDir(filepath.Join(dir, "charts"))
+		require.NoError(t, err)
+		names := []string{}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+	h := NewHelm()
+	trust := true
+	h.TrustAnyRepository = &trust
+	cfg := config.NewChartConfig()
+	cfg.Chart = "parent"
+	cfg.BaseDir = tmpDir
+
+	// Update
+	err = h.UpdateDependencies(context.Background(), cfg)
+	require.NoError(t, err, "update dependencies")
+	require.Equal(t, []string{"child-0.1.0.tgz", "namespace-0.1.0.tgz", "release-name-0.1.0.tgz"}, chartFiles(parentChartDir), "parent chart's charts dir")
+	require.Equal(t, []string{"namespace-0.1.0.tgz"}, chartFiles(childChartDir), "child chart's charts dir")
+	_, err = os.Stat(filepath.Join(childChartDir, "requirements.lock"))
+	require.NoError(t, err, "child chart's requirements.lock")
+	b, err := ioutil.ReadFile(filepath.Join(parentChartDir, "Chart.lock"))
+	require.NoError(t, err, "read Chart.lock")
+	lock := chartutil.RequirementsLock{}
+	err = helmyaml.Unmarshal(b, &lock)
+	require.NoError(t, err, "unmarshal Chart.lock")
+	depVersions := map[string]string{}
+	for _, d := range lock.Dependencies {
+		depVersions[d.Name+" "+d.Repository] = d.Version
+	}
+	require.Equal(t, map[string]string{
+		"release-name " + chartRepo.URL: "0.1.0",
+		"namespace " + chartRepo.URL:    "0.1.0",
+		"child file://../child":         "0.1.0",
+	}, depVersions, "locked dependencies")
+	req := chartutil.Requirements{}
+	err = helmyaml.Unmarshal([]byte(parentChartYAML), &req)
+	require.NoError(t, err)
+	digest, err := chartV2LockDigest(req.Dependencies, lock.Dependencies)
+	require.NoError(t, err)
+	require.Equal(t, digest, lock.Digest, "Chart.lock digest")
+	_, err = os.Stat(filepath.Join(parentChartDir, "requirements.lock"))
+	require.True(t, os.IsNotExist(err), "chart dir should not contain requirements.lock")
+
+	// Build using the lock file
+	err = os.RemoveAll(filepath.Join(parentChartDir, "charts"))
+	require.NoError(t, err)
+	err = h.BuildDependencies(context.Background(), cfg)
+	require.NoError(t, err, "build dependencies")
+	require.Equal(t, []string{"child-0.1.0.tgz", "namespace-0.1.0.tgz", "release-name-0.1.0.tgz"}, chartFiles(parentChartDir), "parent chart's charts dir after build")
+	b2, err := ioutil.ReadFile(filepath.Join(parentChartDir, "Chart.lock"))
+	require.NoError(t, err)
+	require.Equal(t, string(b), string(b2), "build should not modify Chart.lock")
+	var rendered bytes.Buffer
+	renderCfg := *cfg
+	renderCfg.Name = "myrelease"
+	err = render(t, renderCfg, true, &rendered)
+	require.NoError(t, err, "render built chart")
+	require.Contains(t, rendered.String(), "name: child-config", "local dependency output")
+
+	// Build with lock file out of sync
+	err = ioutil.WriteFile(filepath.Join(parentChartDir, "Chart.yaml"), []byte(strings.Replace(parentChartYAML, "0.1.x", "0.1.0", 1)), 0644)
+	require.NoError(t, err)
+	err = h.BuildDependencies(context.Background(), cfg)
+	require.Error(t, err, "build dependencies with lock file out of sync")
+	require.Contains(t, err.Error(), "khelm dep update")
+
+	// Non-local chart
+	remoteCfg := config.NewChartConfig()
+	remoteCfg.Repository = chartRepo.URL
+	remoteCfg.Chart = "namespace"
+	err = h.UpdateDependencies(context.Background(), remoteCfg)
+	require.Error(t, err, "update dependencies of remote chart")
+}
+
 func TestRenderUpdateRepositoryIndexIfChartNotFound(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "khelm-test-")
 	defer os.RemoveAll(tmpDir)
 	settings := cli.EnvSettings{Home: helmpath.Home(tmpDir)}
 	repoURL := "https://charts.rook.io/stable"
 	trust := true
-	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, &trust, &settings, getter.All(settings))
+	repos, err := reposForURLs(context.Background(), map[string]struct{}{repoURL: {}}, &repositoryOptions{TrustAnyRepository: &trust}, &settings, getter.All(settings))
 	require.NoError(t, err, "use repo")
 	entry, err := repos.Get(repoURL)
 	require.NoError(t, err, "repos.EntryByURL()")
@@ -218,7 +878,7 @@ func TestRenderUpdateRepositoryIndexIfDependencyNotFound(t *testing.T) {
 	settings := cli.EnvSettings{Home: helmpath.Home(tmpDir)}
 	repoURL := "https://kubernetes-charts.storage.googleapis.com"
 	trust := true
-	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, &trust, &settings, getter.All(settings))
+	repos, err := reposForURLs(context.Background(), map[string]struct{}{repoURL: {}}, &repositoryOptions{TrustAnyRepository: &trust}, &settings, getter.All(settings))
 	require.NoError(t, err, "use repo")
 	entry, err := repos.Get(repoURL)
 	require.NoError(t, err, "repos.Get()")
@@ -292,6 +952,258 @@ func TestRenderRepositoryCredentials(t *testing.T) {
 	}
 }
 
+func TestRenderRepositoryCredentialsFromEnvAndHelper(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-credentials-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	chartRepo.Username = "fakeuser"
+	chartRepo.Password = "fakepassword"
+	u, err := url.Parse(chartRepo.URL)
+	require.NoError(t, err)
+	envKey := envRepoCredentialsPrefix + credentialsEnvKey(u.Host)
+
+	// Local chart with remote dependency
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", chartRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+
+	// Credential helpers
+	writeHelper := func(name, script string) string {
+		file := filepath.Join(tmpDir, name)
+		err := ioutil.WriteFile(file, []byte("#!/bin/sh\nread -r URL || true\n"+script), 0755)
+		require.NoError(t, err)
+		return file
+	}
+	helper := writeHelper("credential-helper", fmt.Sprintf(`[ "$1" = get ] && [ "$URL" = %q ] || { echo credentials not found in native keychain; exit 1; }
+echo '{"ServerURL":"%s","Username":"fakeuser","Secret":"fakepassword"}'`, chartRepo.URL, chartRepo.URL))
+	emptyHelper := writeHelper("empty-credential-helper", "echo credentials not found in native keychain; exit 1")
+	failingHelper := writeHelper("failing-credential-helper", "echo fake helper failure >&2; exit 2")
+
+	for _, c := range []struct {
+		name      string
+		env       map[string]string
+		helper    string
+		expectErr string
+	}{
+		{"env", map[string]string{envKey + envRepoUsernameSuffix: "fakeuser", envKey + envRepoPasswordSuffix: "fakepassword"}, emptyHelper, ""},
+		{"helper", nil, helper, ""},
+		{"env before helper", map[string]string{envKey + envRepoUsernameSuffix: "fakeuser", envKey + envRepoPasswordSuffix: "wrongpassword"}, helper, "401"},
+		{"failing helper", nil, failingHelper, "fake helper failure"},
+		{"no credentials", nil, emptyHelper, "401"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for k, v := range c.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			os.RemoveAll(filepath.Join(localChartDir, "charts"))
+			os.Remove(filepath.Join(localChartDir, "requirements.lock"))
+			helmHome, err := ioutil.TempDir(tmpDir, "helm-home-")
+			require.NoError(t, err)
+			h := NewHelm()
+			h.Settings.Home = helmpath.Home(helmHome)
+			h.CredentialHelper = c.helper
+			for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+				_, err = h.Render(context.Background(), cfg)
+				if c.expectErr != "" {
+					require.Error(t, err, "render %s", cfg.Chart)
+					require.Contains(t, err.Error(), c.expectErr, "render %s", cfg.Chart)
+				} else {
+					require.NoError(t, err, "render %s", cfg.Chart)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderRepositoryIdentityTokenFromHelper(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-identity-token-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	chartRepo.Token = "faketoken"
+
+	// Local chart with remote dependency
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", chartRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+	chartURLCfg := config.NewChartConfig()
+	chartURLCfg.Chart = chartRepo.URL + "/namespace-0.1.0.tgz"
+	chartURLCfg.Name = "myrelease"
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+
+	helper := filepath.Join(tmpDir, "credential-helper")
+	script := fmt.Sprintf("#!/bin/sh\necho '{\"ServerURL\":\"%s\",\"Username\":\"<token>\",\"Secret\":\"faketoken\"}'\n", chartRepo.URL)
+	err = ioutil.WriteFile(helper, []byte(script), 0755)
+	require.NoError(t, err)
+
+	helmHome, err := ioutil.TempDir(tmpDir, "helm-home-")
+	require.NoError(t, err)
+	h := NewHelm()
+	h.Settings.Home = helmpath.Home(helmHome)
+	h.CredentialHelper = helper
+	for _, cfg := range []*config.ChartConfig{remoteChartCfg, chartURLCfg, localChartCfg} {
+		_, err = h.Render(context.Background(), cfg)
+		require.NoError(t, err, "render %s", cfg.Chart)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	os.Setenv("KHELM_REPO_CHARTS_EXAMPLE_ORG_8443_USERNAME", "hostuser")
+	os.Setenv("KHELM_REPO_CHARTS_EXAMPLE_ORG_8443_PASSWORD", "hostpassword")
+	os.Setenv("KHELM_REPO_CHARTS_EXAMPLE_ORG_8443_PRIVATE_STABLE_PASSWORD", "token")
+	defer os.Unsetenv("KHELM_REPO_CHARTS_EXAMPLE_ORG_8443_USERNAME")
+	defer os.Unsetenv("KHELM_REPO_CHARTS_EXAMPLE_ORG_8443_PASSWORD")
+	defer os.Unsetenv("KHELM_REPO_CHARTS_EXAMPLE_ORG_8443_PRIVATE_STABLE_PASSWORD")
+	for _, c := range []struct {
+		url      string
+		username string
+		password string
+		found    bool
+	}{
+		{"https://charts.example.org:8443", "hostuser", "hostpassword", true},
+		{"https://charts.example.org:8443/other/", "hostuser", "hostpassword", true},
+		{"https://charts.example.org:8443/private/stable", "", "token", true},
+		{"https://charts.example.org:8443/private/stable/sub", "", "token", true},
+		{"https://charts.example.org", "", "", false},
+	} {
+		username, password, found := envCredentials(c.url)
+		require.Equal(t, c.found, found, "found credentials for %s", c.url)
+		require.Equal(t, c.username, username, "username of %s", c.url)
+		require.Equal(t, c.password, password, "password of %s", c.url)
+	}
+}
+
+func TestRenderRepositoryAuth(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-auth-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	writeFile := func(name string, b []byte) {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, name), b, 0600)
+		require.NoError(t, err)
+	}
+
+	// Create client certificate and HTTPS chart repository that requires it as well as a bearer token
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientCertTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "khelm-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	clientCertDER, err := x509.CreateCertificate(rand.Reader, clientCertTemplate, clientCertTemplate, &clientKey.PublicKey, clientKey)
+	require.NoError(t, err)
+	clientCert, err := x509.ParseCertificate(clientCertDER)
+	require.NoError(t, err)
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	require.NoError(t, err)
+	writeFile("client.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCertDER}))
+	writeFile("client-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: clientKeyDER}))
+	writeFile("token", []byte("faketoken\n"))
+	writeFile("wrong-token", []byte("wrongtoken"))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	chartRepo := newFakeTLSChartRepository(t, clientCAs, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	chartRepo.Token = "faketoken"
+	chartRepo.Files["/values.yaml"] = []byte("fakevalue: true\n")
+	writeFile("ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chartRepo.server.Certificate().Raw}))
+
+	// Local chart with remote dependency
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	writeFile("localchart/Chart.yaml", []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"))
+	writeFile("localchart/requirements.yaml", []byte(fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", chartRepo.URL)))
+
+	validAuth := config.RepositoryAuth{
+		URL:       chartRepo.URL,
+		CAFile:    "ca.pem",
+		CertFile:  "client.pem",
+		KeyFile:   "client-key.pem",
+		TokenFile: "token",
+	}
+	for _, c := range []struct {
+		name      string
+		auth      func(*config.RepositoryAuth)
+		expectErr string
+	}{
+		{"valid", func(a *config.RepositoryAuth) {}, ""},
+		{"no CA", func(a *config.RepositoryAuth) { a.CAFile = "" }, "certificate"},
+		{"no client certificate", func(a *config.RepositoryAuth) { a.CertFile, a.KeyFile = "", "" }, "certificate"},
+		{"no token", func(a *config.RepositoryAuth) { a.TokenFile = "" }, "401"},
+		{"wrong token", func(a *config.RepositoryAuth) { a.TokenFile = "wrong-token" }, "401"},
+		{"other repository", func(a *config.RepositoryAuth) { a.URL = chartRepo.URL + "/other" }, "certificate"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			auth := validAuth
+			c.auth(&auth)
+			remoteChartCfg := config.NewChartConfig()
+			remoteChartCfg.Repository = chartRepo.URL
+			remoteChartCfg.Chart = "namespace"
+			remoteChartCfg.Version = "0.1.x"
+			remoteChartCfg.Name = "myrelease"
+			remoteChartCfg.ValueFiles = []string{chartRepo.URL + "/values.yaml"}
+			remoteChartCfg.RepositoryAuth = []config.RepositoryAuth{auth}
+			remoteChartCfg.BaseDir = tmpDir
+			localChartCfg := config.NewChartConfig()
+			localChartCfg.Chart = "localchart"
+			localChartCfg.Name = "myrelease"
+			localChartCfg.RepositoryAuth = []config.RepositoryAuth{auth}
+			localChartCfg.BaseDir = tmpDir
+			os.RemoveAll(filepath.Join(localChartDir, "charts"))
+			os.Remove(filepath.Join(localChartDir, "requirements.lock"))
+			helmHome, err := ioutil.TempDir(tmpDir, "helm-home-")
+			require.NoError(t, err)
+			h := NewHelm()
+			h.Settings.Home = helmpath.Home(helmHome)
+			for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+				_, err = h.Render(context.Background(), cfg)
+				if c.expectErr != "" {
+					require.Error(t, err, "render %s", cfg.Chart)
+					require.Contains(t, err.Error(), c.expectErr, "render %s", cfg.Chart)
+				} else {
+					require.NoError(t, err, "render %s", cfg.Chart)
+				}
+			}
+		})
+	}
+	require.Contains(t, chartRepo.Requests(), "/values.yaml", "requests")
+}
+
 type fakePrivateChartServerHandler struct {
 	repo         *repo.Entry
 	config       *config.LoaderConfig
@@ -346,6 +1258,1636 @@ func (f *fakePrivateChartServerHandler) ServeHTTP(writer http.ResponseWriter, re
 	writer.WriteHeader(404)
 }
 
+func TestRenderOCIChart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-oci-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	helmHome := filepath.Join(tmpDir, "helm")
+	os.Setenv("HELM_HOME", helmHome)
+	defer os.Unsetenv("HELM_HOME")
+	os.Setenv("DOCKER_CONFIG", tmpDir)
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	// Package fake chart and run fake registry
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	chartTgz, err := chartutil.Save(ch, tmpDir)
+	require.NoError(t, err)
+	registry := newFakeOCIRegistry(t, "charts/namespace", ch.Metadata, chartTgz)
+	srv := httptest.NewServer(registry)
+	defer srv.Close()
+	registry.URL = srv.URL
+	host := srv.Listener.Addr().String()
+
+	// Write docker config
+	auth := base64.StdEncoding.EncodeToString([]byte("fakeuser:fakepassword"))
+	dockerCfg := fmt.Sprintf(`{"auths":{"https://%s":{"auth":%q}}}`, host, auth)
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "config.json"), []byte(dockerCfg), 0600)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name    string
+		version string
+	}{
+		{"tag", "0.1.0"},
+		{"range", "0.1.x"},
+		{"latest", ""},
+		{"digest", registry.ManifestDigest},
+		{"cached", "0.1.0"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.NewChartConfig()
+			cfg.Repository = "oci://" + host + "/charts"
+			cfg.Chart = "namespace"
+			cfg.Version = c.version
+			cfg.Name = "myrelease"
+			var rendered bytes.Buffer
+			err := render(t, *cfg, false, &rendered)
+			require.NoError(t, err, "render OCI chart")
+			require.Contains(t, rendered.String(), "myconfigb")
+		})
+	}
+	require.Equal(t, 1, registry.BlobDownloads, "chart blob downloads")
+	cached, err := filepath.Glob(filepath.Join(helmHome, "cache", "archive", "khelm", cacheHostSegment(host), "charts", "namespace", "namespace-0.1.0-*", "namespace-0.1.0.tgz"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cached), "cached chart")
+
+	// Render chart referenced by its manifest digest offline
+	for _, version := range []string{registry.ManifestDigest, ociDigestPrefix + strings.Repeat("0", 64)} {
+		offlineCfg := config.NewChartConfig()
+		offlineCfg.Repository = "oci://" + host + "/charts"
+		offlineCfg.Chart = "namespace"
+		offlineCfg.Version = version
+		offlineCfg.Name = "myrelease"
+		offlineCfg.Offline = true
+		var rendered bytes.Buffer
+		err = render(t, *offlineCfg, false, &rendered)
+		if version == registry.ManifestDigest {
+			require.NoError(t, err, "render OCI chart by manifest digest offline")
+			require.Contains(t, rendered.String(), "myconfigb")
+		} else {
+			require.Error(t, err, "render uncached OCI chart by manifest digest offline")
+			require.True(t, IsNotCached(err), "not cached error expected but was: %s", err)
+		}
+	}
+	require.Equal(t, 1, registry.BlobDownloads, "chart blob downloads after offline render")
+
+	// Retry transient registry failures
+	registry.Failures = map[string]int{"/v2/charts/namespace/tags/list": 2}
+	retryCfg := config.NewChartConfig()
+	retryCfg.Repository = "oci://" + host + "/charts"
+	retryCfg.Chart = "namespace"
+	retryCfg.Version = "0.1.x"
+	retryCfg.Name = "myrelease"
+	h := NewHelm()
+	h.Retry = RetryOptions{MaxRetries: 2, InitialBackoff: 10 * time.Millisecond}
+	_, err = h.Render(context.Background(), retryCfg)
+	require.NoError(t, err, "render OCI chart with transient registry failures")
+	require.Equal(t, 0, registry.Failures["/v2/charts/namespace/tags/list"], "remaining failures")
+
+	cfg := config.NewChartConfig()
+	cfg.Repository = "oci://" + host + "/charts"
+	cfg.Chart = "namespace"
+	cfg.Version = "0.1.0"
+	cfg.Name = "myrelease"
+
+	// Lock chart layer digest
+	lockedCfg := *cfg
+	lockedCfg.Version = "0.1.x"
+	lockedCfg.LockFile = "khelm.lock"
+	lockedCfg.BaseDir = tmpDir
+	err = render(t, lockedCfg, false, &bytes.Buffer{})
+	require.NoError(t, err, "render locked OCI chart")
+	lock, err := loadLockFile(&lockedCfg, false)
+	require.NoError(t, err)
+	locked := lock.Get(cfg.Repository, "namespace", "0.1.x")
+	require.NotNil(t, locked, "locked OCI chart")
+	require.Equal(t, "0.1.0", locked.Version, "locked version")
+	require.Equal(t, strings.TrimPrefix(registry.chartDigest, ociDigestPrefix), locked.Digest, "locked digest")
+	locked.Digest = strings.Repeat("0", 64)
+	lock.changed = true
+	err = lock.Save()
+	require.NoError(t, err)
+	for _, offline := range []bool{false, true} {
+		republishedCfg := lockedCfg
+		republishedCfg.Offline = offline
+		err = render(t, republishedCfg, false, &bytes.Buffer{})
+		require.Error(t, err, "render republished OCI chart (offline: %v)", offline)
+		require.Contains(t, err.Error(), "digest", "render republished OCI chart (offline: %v)", offline)
+	}
+
+	// Detect corrupted cache entry
+	err = ioutil.WriteFile(cached[0], []byte("corrupted"), 0644)
+	require.NoError(t, err)
+	for _, offline := range []bool{false, true} {
+		corruptedCfg := *cfg
+		corruptedCfg.Offline = offline
+		err = render(t, corruptedCfg, false, &bytes.Buffer{})
+		require.Error(t, err, "render corrupted cached chart (offline: %v)", offline)
+		require.Contains(t, err.Error(), "corrupted", "render corrupted cached chart (offline: %v)", offline)
+	}
+
+	os.Setenv("DOCKER_CONFIG", filepath.Join(tmpDir, "nonexisting"))
+	err = render(t, *cfg, false, &bytes.Buffer{})
+	require.Error(t, err, "render without credentials")
+	require.True(t, IsUntrustedRepository(err), "untrusted repository error expected but was: %s", err)
+}
+
+func TestLoadDockerConfigNormalizesRegistryHosts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-docker-config-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("fakeuser:fakepassword"))
+	err = ioutil.WriteFile(file, []byte(fmt.Sprintf(`{"auths":{"https://index.docker.io/v1/":{"auth":%q},"registry.example.org:5000":{"identitytoken":"faketoken"}}}`, auth)), 0600)
+	require.NoError(t, err)
+	auths, err := loadDockerConfig(file)
+	require.NoError(t, err)
+	for _, host := range []string{"docker.io", "index.docker.io", "registry-1.docker.io"} {
+		require.Equal(t, "fakeuser", auths[registryHost(host)].Username, "username of %s", host)
+	}
+	require.Equal(t, "faketoken", auths[registryHost("registry.example.org:5000")].IdentityToken, "identity token of host with port")
+}
+
+func TestRenderChartArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-archive-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	helmHome := filepath.Join(tmpDir, "helm")
+	os.Setenv("HELM_HOME", helmHome)
+	defer os.Unsetenv("HELM_HOME")
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	chartTgz, err := chartutil.Save(ch, tmpDir)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(chartTgz)
+	require.NoError(t, err)
+	chartRepo := newFakeChartRepository(t)
+	defer chartRepo.Close()
+	chartRepo.Files["/vendor/namespace-0.1.0.tgz"] = b
+	chartURL := chartRepo.URL + "/vendor/namespace-0.1.0.tgz"
+
+	// Local archive
+	cfg := config.NewChartConfig()
+	cfg.Chart = filepath.Base(chartTgz)
+	cfg.BaseDir = tmpDir
+	cfg.Name = "myrelease"
+	var rendered bytes.Buffer
+	err = render(t, *cfg, false, &rendered)
+	require.NoError(t, err, "render local chart archive")
+	require.Contains(t, rendered.String(), "myconfigb")
+
+	// Chart URL
+	cfg = config.NewChartConfig()
+	cfg.Chart = chartURL
+	cfg.Version = "0.1.x"
+	cfg.Name = "myrelease"
+	cfg.LockFile = "khelm.lock"
+	cfg.BaseDir = tmpDir
+	for _, offline := range []bool{false, false, true} {
+		offlineCfg := *cfg
+		offlineCfg.Offline = offline
+		rendered.Reset()
+		err = render(t, offlineCfg, true, &rendered)
+		require.NoError(t, err, "render chart URL (offline: %v)", offline)
+		require.Contains(t, rendered.String(), "myconfigb", "render chart URL (offline: %v)", offline)
+	}
+	require.Equal(t, []string{"/vendor/namespace-0.1.0.tgz"}, chartRepo.Requests(), "requests")
+	cached, err := filepath.Glob(filepath.Join(helmHome, "cache", "archive", "khelm", "*", "vendor", "namespace-0.1.0-*", "namespace-0.1.0.tgz"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cached), "cached chart")
+	lock, err := loadLockFile(cfg, false)
+	require.NoError(t, err)
+	locked := lock.GetURL(chartURL, "0.1.x")
+	require.NotNil(t, locked, "locked chart URL")
+	require.Equal(t, "namespace", locked.Chart, "locked chart name")
+	require.Equal(t, "0.1.0", locked.Version, "locked chart version")
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(b)), locked.Digest, "locked chart digest")
+
+	// Verify a chart URL that has been cached without its provenance file
+	entity, err := openpgp.NewEntity("khelm test", "", "khelm-test@example.org", nil)
+	require.NoError(t, err)
+	keyring := filepath.Join(tmpDir, "pubring.gpg")
+	f, err := os.Create(keyring)
+	require.NoError(t, err)
+	err = entity.Serialize(f)
+	f.Close()
+	require.NoError(t, err)
+	prov, err := (&provenance.Signatory{Entity: entity}).ClearSign(chartTgz)
+	require.NoError(t, err)
+	chartRepo.Files["/vendor/namespace-0.1.0.tgz.prov"] = []byte(prov)
+	verifyCfg := *cfg
+	verifyCfg.Verify = true
+	verifyCfg.Keyring = keyring
+	verifyCfg.LockFile = ""
+	for _, offline := range []bool{false, true} {
+		offlineCfg := verifyCfg
+		offlineCfg.Offline = offline
+		rendered.Reset()
+		err = render(t, offlineCfg, true, &rendered)
+		require.NoError(t, err, "render verified chart URL cached without provenance file (offline: %v)", offline)
+		require.Contains(t, rendered.String(), "myconfigb", "render verified chart URL (offline: %v)", offline)
+	}
+	require.Equal(t, []string{"/vendor/namespace-0.1.0.tgz", "/vendor/namespace-0.1.0.tgz.prov"}, chartRepo.Requests(), "requests")
+
+	// Version mismatch
+	mismatchCfg := *cfg
+	mismatchCfg.Version = "0.2.x"
+	mismatchCfg.LockFile = ""
+	err = render(t, mismatchCfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render chart URL with mismatching version")
+
+	// Republished archive
+	republished, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	republished.Metadata.Description = "republished"
+	republishedDir := filepath.Join(tmpDir, "republished")
+	require.NoError(t, os.Mkdir(republishedDir, 0755))
+	republishedTgz, err := chartutil.Save(republished, republishedDir)
+	require.NoError(t, err)
+	chartRepo.Files["/vendor/namespace-0.1.0.tgz"], err = ioutil.ReadFile(republishedTgz)
+	require.NoError(t, err)
+	refreshCfg := *cfg
+	refreshCfg.Refresh = true
+	err = render(t, refreshCfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render republished chart URL")
+	require.Contains(t, err.Error(), "republished", "render republished chart URL")
+
+	// Untrusted URL
+	require.NoError(t, os.MkdirAll(filepath.Join(helmHome, "repository"), 0755))
+	err = ioutil.WriteFile(filepath.Join(helmHome, "repository", "repositories.yaml"), []byte("apiVersion: v1\nrepositories: []\n"), 0644)
+	require.NoError(t, err)
+	untrustedCfg := *cfg
+	untrustedCfg.LockFile = ""
+	err = render(t, untrustedCfg, false, &bytes.Buffer{})
+	require.Error(t, err, "render untrusted chart URL")
+	require.True(t, IsUntrustedRepository(err), "untrusted repository error expected but was: %s", err)
+}
+
+func TestRenderGitChart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-git-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	helmHome := filepath.Join(tmpDir, "helm")
+	os.Setenv("HELM_HOME", helmHome)
+	defer os.Unsetenv("HELM_HOME")
+
+	// Create git repository containing charts
+	bareRepoDir := filepath.Join(tmpDir, "repo.git")
+	workDir := filepath.Join(tmpDir, "work")
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=khelm", "GIT_AUTHOR_EMAIL=khelm@example.org",
+			"GIT_COMMITTER_NAME=khelm", "GIT_COMMITTER_EMAIL=khelm@example.org")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, out)
+		return strings.TrimSpace(string(out))
+	}
+	runGit("init", "--quiet", "--bare", bareRepoDir)
+	runGit("init", "--quiet", workDir)
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example", "namespace"))
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(workDir, "charts"), 0755)
+	require.NoError(t, err)
+	err = chartutil.SaveDir(ch, filepath.Join(workDir, "charts"))
+	require.NoError(t, err)
+	parentChartDir := filepath.Join(workDir, "charts", "parent")
+	err = os.MkdirAll(parentChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(parentChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: parent\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(parentChartDir, "requirements.yaml"), []byte("dependencies:\n- name: namespace\n  version: 0.1.0\n  repository: file://../namespace\n"), 0644)
+	require.NoError(t, err)
+	runGit("-C", workDir, "add", "-A")
+	runGit("-C", workDir, "commit", "--quiet", "-m", "initial commit")
+	runGit("-C", workDir, "tag", "v1")
+	firstCommit := runGit("-C", workDir, "rev-parse", "HEAD")
+	err = os.RemoveAll(filepath.Join(workDir, "charts", "namespace", "templates", "configmap.yaml"))
+	require.NoError(t, err)
+	runGit("-C", workDir, "commit", "--quiet", "-am", "remove configmaps")
+	runGit("-C", workDir, "push", "--quiet", bareRepoDir, "HEAD:refs/heads/main", "v1")
+	runGit("--git-dir", bareRepoDir, "symbolic-ref", "HEAD", "refs/heads/main")
+
+	for _, c := range []struct {
+		name              string
+		chart             string
+		ref               string
+		expectedContained string
+		unexpected        string
+	}{
+		{"branch", "charts/namespace", "main", "kind: ClusterRoleBinding", "myconfigb"},
+		{"tag", "charts/namespace", "v1", "myconfigb", ""},
+		{"commit", "charts/namespace", firstCommit, "myconfigb", ""},
+		{"default branch", "charts/namespace", "", "kind: ClusterRoleBinding", "myconfigb"},
+		{"local dependency", "charts/parent", "v1", "myconfigb", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.NewChartConfig()
+			cfg.Repository = "git+file://" + bareRepoDir
+			cfg.Chart = c.chart
+			cfg.Version = c.ref
+			cfg.Name = "myrelease"
+			var rendered bytes.Buffer
+			err := render(t, *cfg, true, &rendered)
+			require.NoError(t, err, "render chart from git")
+			require.Contains(t, rendered.String(), c.expectedContained)
+			if c.unexpected != "" {
+				require.NotContains(t, rendered.String(), c.unexpected)
+			}
+		})
+	}
+
+	// Reuse the resolved branch within the index max age
+	cfg := config.NewChartConfig()
+	cfg.Repository = "git+file://" + bareRepoDir
+	cfg.Chart = "charts/namespace"
+	cfg.Version = "main"
+	cfg.Name = "myrelease"
+	cfg.IndexMaxAge = time.Hour
+	runGit("-C", workDir, "revert", "--no-edit", "HEAD")
+	runGit("-C", workDir, "push", "--quiet", bareRepoDir, "HEAD:refs/heads/main")
+	var rendered bytes.Buffer
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render branch within index max age")
+	require.NotContains(t, rendered.String(), "myconfigb", "branch should be resolved from cache within index max age")
+	cfg.Refresh = true
+	rendered.Reset()
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render refreshed branch")
+	require.Contains(t, rendered.String(), "myconfigb", "refreshed branch")
+
+	// Record the resolved commit within the lock file and use it subsequently
+	cfg.Refresh = false
+	cfg.IndexMaxAge = 0
+	cfg.LockFile = filepath.Join(tmpDir, "khelm.lock")
+	err = render(t, *cfg, true, &bytes.Buffer{})
+	require.NoError(t, err, "render branch with lock file")
+	lockContent, err := ioutil.ReadFile(cfg.LockFile)
+	require.NoError(t, err)
+	require.Contains(t, string(lockContent), "version: "+runGit("-C", workDir, "rev-parse", "HEAD")+"\n", "locked commit")
+	runGit("-C", workDir, "revert", "--no-edit", "HEAD")
+	runGit("-C", workDir, "push", "--quiet", bareRepoDir, "HEAD:refs/heads/main")
+	rendered.Reset()
+	err = render(t, *cfg, true, &rendered)
+	require.NoError(t, err, "render locked branch")
+	require.Contains(t, rendered.String(), "myconfigb", "locked commit should be rendered")
+
+	cfg = config.NewChartConfig()
+	cfg.Repository = "git+file://" + bareRepoDir
+	cfg.Chart = "charts/namespace"
+	cfg.Version = "nonexisting"
+	cfg.Name = "myrelease"
+	err = render(t, *cfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render nonexisting ref")
+	cfg.Version = "v1"
+	err = render(t, *cfg, false, &bytes.Buffer{})
+	require.Error(t, err, "render untrusted")
+	require.True(t, IsUntrustedRepository(err), "untrusted repository error expected but was: %s", err)
+
+	// Reject repository URLs and refs that git would interpret as options
+	injectedFile := filepath.Join(tmpDir, "injected")
+	for _, c := range []struct{ repo, ref string }{
+		{"git+--upload-pack=touch " + injectedFile, "v1"},
+		{"git+file://" + bareRepoDir, "--output=" + injectedFile},
+	} {
+		cfg = config.NewChartConfig()
+		cfg.Repository = c.repo
+		cfg.Chart = "charts/namespace"
+		cfg.Version = c.ref
+		cfg.Name = "myrelease"
+		err = render(t, *cfg, true, &bytes.Buffer{})
+		require.Error(t, err, "render repository %q ref %q", c.repo, c.ref)
+		require.Contains(t, err.Error(), "invalid git", "render repository %q ref %q", c.repo, c.ref)
+		_, err = os.Stat(injectedFile)
+		require.True(t, os.IsNotExist(err), "git option injected via repository %q ref %q", c.repo, c.ref)
+	}
+}
+
+func TestRenderOffline(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-offline-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+
+	// Local chart with remote dependency
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", chartRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+
+	for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+		// Fail when not cached
+		cfg.Offline = true
+		requestCount := len(chartRepo.Requests())
+		err = render(t, *cfg, true, &bytes.Buffer{})
+		require.Error(t, err, "render %s offline without cache", cfg.Chart)
+		require.True(t, IsNotCached(err), "not cached error expected but was: %s", err)
+		require.Equal(t, requestCount, len(chartRepo.Requests()), "requests sent in offline mode")
+
+		// Populate cache
+		cfg.Offline = false
+		err = render(t, *cfg, true, &bytes.Buffer{})
+		require.NoError(t, err, "render %s online", cfg.Chart)
+	}
+
+	// Use cache
+	chartRepo.Close()
+	for _, c := range []struct {
+		cfg         *config.ChartConfig
+		mustContain string
+	}{
+		{remoteChartCfg, "myconfigb"},
+		{localChartCfg, "myrelease-config"},
+	} {
+		c.cfg.Offline = true
+		var rendered bytes.Buffer
+		err = render(t, *c.cfg, true, &rendered)
+		require.NoError(t, err, "render %s offline", c.cfg.Chart)
+		require.Contains(t, rendered.String(), c.mustContain)
+	}
+
+	remoteChartCfg.Version = "0.2.0"
+	err = render(t, *remoteChartCfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render uncached version offline")
+	require.True(t, IsNotCached(err), "not cached error expected but was: %s", err)
+
+	// Reject remote values files
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.ValueFiles = []string{"https://example.org/values.yaml"}
+	err = render(t, *remoteChartCfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render with remote values file offline")
+	require.Contains(t, err.Error(), "https://example.org/values.yaml", "render with remote values file offline")
+}
+
+func TestPrefetch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-prefetch-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+
+	// Local chart with a remote dependency and a local dependency that has a remote dependency itself
+	parentChartDir := filepath.Join(tmpDir, "parent")
+	childChartDir := filepath.Join(tmpDir, "child")
+	for dir, requirements := range map[string]string{
+		parentChartDir: fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n- name: child\n  version: 0.1.0\n  repository: file://../child\n", chartRepo.URL),
+		childChartDir:  fmt.Sprintf("dependencies:\n- name: namespace\n  version: 0.1.0\n  repository: %s\n", chartRepo.URL),
+	} {
+		err = os.MkdirAll(dir, 0755)
+		require.NoError(t, err)
+		chartYAML := fmt.Sprintf("apiVersion: v1\nname: %s\nversion: 0.1.0\n", filepath.Base(dir))
+		err = ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(chartYAML), 0644)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(dir, "requirements.yaml"), []byte(requirements), 0644)
+		require.NoError(t, err)
+	}
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = parentChartDir
+	localChartCfg.Name = "myrelease"
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+
+	trust := true
+	h := NewHelm()
+	h.TrustAnyRepository = &trust
+	for _, cfg := range []*config.ChartConfig{localChartCfg, remoteChartCfg} {
+		c := *cfg
+		err = h.Prefetch(context.Background(), &c)
+		require.NoError(t, err, "prefetch %s", cfg.Chart)
+	}
+	for _, dir := range []string{parentChartDir, childChartDir} {
+		require.NoFileExists(t, filepath.Join(dir, "requirements.lock"), "prefetch should not modify the chart")
+		require.NoDirExists(t, filepath.Join(dir, "charts"), "prefetch should not modify the chart")
+	}
+
+	// Render offline
+	chartRepo.Close()
+	for _, c := range []struct {
+		cfg         *config.ChartConfig
+		mustContain []string
+	}{
+		{localChartCfg, []string{"myrelease-config", "myconfigb"}},
+		{remoteChartCfg, []string{"myconfigb"}},
+	} {
+		c.cfg.Offline = true
+		var rendered bytes.Buffer
+		err = render(t, *c.cfg, true, &rendered)
+		require.NoError(t, err, "render prefetched chart %s offline", c.cfg.Chart)
+		for _, s := range c.mustContain {
+			require.Contains(t, rendered.String(), s, "render prefetched chart %s offline", c.cfg.Chart)
+		}
+	}
+
+	err = h.Prefetch(context.Background(), &config.ChartConfig{})
+	require.Error(t, err, "prefetch without chart")
+}
+
+func TestLockFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-lock-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"))
+	defer chartRepo.Close()
+
+	// Local chart with remote dependency
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: namespace\n  version: \">=0.1.0\"\n  repository: %s\n", chartRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+	remoteChartCfg.LockFile = "khelm.lock"
+	remoteChartCfg.BaseDir = tmpDir
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+	localChartCfg.LockFile = "khelm.lock"
+	localChartCfg.BaseDir = tmpDir
+	lockFilePath := filepath.Join(tmpDir, "khelm.lock")
+	readLockFile := func() *lockFile {
+		lock, err := loadLockFile(remoteChartCfg, false)
+		require.NoError(t, err)
+		return lock
+	}
+
+	// Write lock file
+	for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+		err = render(t, *cfg, true, &bytes.Buffer{})
+		require.NoError(t, err, "render %s", cfg.Chart)
+	}
+	require.FileExists(t, lockFilePath)
+	lock := readLockFile()
+	require.Equal(t, 2, len(lock.Charts), "locked charts")
+	for _, c := range lock.Charts {
+		require.Equal(t, chartRepo.URL, c.Repository, "locked repository")
+		require.Equal(t, "namespace", c.Chart, "locked chart")
+		require.Equal(t, "0.1.0", c.Version, "locked version")
+		require.Equal(t, chartRepo.URL+"/namespace-0.1.0.tgz", c.URL, "locked URL")
+		require.Equal(t, chartRepo.Index.Entries["namespace"][0].Digest, c.Digest, "locked digest")
+	}
+	require.Equal(t, "0.1.0", lock.Get(chartRepo.URL, "namespace", "0.1.x").Version, "locked root chart version")
+	require.Equal(t, "0.1.0", lock.Get(chartRepo.URL, "namespace", ">=0.1.0").Version, "locked dependency version")
+
+	// Honour lock file when a newer version is available
+	newChartDir := filepath.Join(tmpDir, "namespace-0.1.1")
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	ch.Metadata.Version = "0.1.1"
+	err = chartutil.SaveDir(ch, tmpDir)
+	require.NoError(t, err)
+	err = os.Rename(filepath.Join(tmpDir, "namespace"), newChartDir)
+	require.NoError(t, err)
+	chartRepo.AddChart(t, newChartDir)
+	for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+		err = render(t, *cfg, true, &bytes.Buffer{})
+		require.NoError(t, err, "render locked chart %s", cfg.Chart)
+		require.NotContains(t, chartRepo.Requests(), "/namespace-0.1.1.tgz", "requests after rendering %s", cfg.Chart)
+	}
+	require.Equal(t, "0.1.0", readLockFile().Get(chartRepo.URL, "namespace", ">=0.1.0").Version, "locked dependency version after render")
+
+	// Update lock file
+	h := NewHelm()
+	trust := true
+	h.TrustAnyRepository = &trust
+	updateCfg := *remoteChartCfg
+	err = h.UpdateLock(context.Background(), &updateCfg)
+	require.NoError(t, err, "update lock")
+	require.Equal(t, "0.1.1", readLockFile().Get(chartRepo.URL, "namespace", "0.1.x").Version, "locked version after update")
+
+	// Fail when the locked chart has been republished with another digest
+	for _, cv := range chartRepo.Index.Entries["namespace"] {
+		cv.Digest = strings.Repeat("0", 64)
+	}
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm-fresh"))
+	err = render(t, *remoteChartCfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render republished chart")
+	require.Contains(t, err.Error(), "digest", "error message")
+
+	// Fail when no lock file is configured
+	updateCfg = *remoteChartCfg
+	updateCfg.LockFile = ""
+	err = h.UpdateLock(context.Background(), &updateCfg)
+	require.Error(t, err, "update lock without lock file")
+}
+
+func TestVerifyBuiltDependencies(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-built-deps-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	chartsDir := filepath.Join(tmpDir, "charts")
+	err = os.MkdirAll(chartsDir, 0755)
+	require.NoError(t, err)
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	file, err := chartutil.Save(ch, chartsDir)
+	require.NoError(t, err)
+	digest, err := provenance.DigestFile(file)
+	require.NoError(t, err)
+
+	fetched := []*fetchedDependency{nil, {Version: "0.1.0", Digest: digest, URL: "https://example.org/namespace-0.1.0.tgz"}}
+	err = verifyBuiltDependencies(tmpDir, fetched)
+	require.NoError(t, err, "verify built dependency")
+	fetched[1].Digest = strings.Repeat("0", 64)
+	err = verifyBuiltDependencies(tmpDir, fetched)
+	require.Error(t, err, "verify unexpected built dependency")
+}
+
+func TestRenderChartDigestVerification(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-digest-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	helmHome := filepath.Join(tmpDir, "helm")
+	os.Setenv("HELM_HOME", helmHome)
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	cfg := config.NewChartConfig()
+	cfg.Repository = chartRepo.URL
+	cfg.Chart = "namespace"
+	cfg.Version = "0.1.0"
+	cfg.Name = "myrelease"
+	cachedFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(helmHome, "cache", "archive", "khelm", "*", "namespace-0.1.0-*", "namespace-0.1.0.tgz"))
+		require.NoError(t, err)
+		return files
+	}
+
+	// Reject tampered download
+	originalChart := chartRepo.Files["/namespace-0.1.0.tgz"]
+	chartRepo.Files["/namespace-0.1.0.tgz"] = chartRepo.Files["/release-name-0.1.0.tgz"]
+	err = render(t, *cfg, true, &bytes.Buffer{})
+	require.Error(t, err, "render tampered chart")
+	require.Contains(t, err.Error(), "tampered", "render tampered chart")
+	require.Equal(t, 0, len(cachedFiles()), "tampered chart should not be cached")
+
+	// Download valid chart
+	chartRepo.Files["/namespace-0.1.0.tgz"] = originalChart
+	err = render(t, *cfg, true, &bytes.Buffer{})
+	require.NoError(t, err, "render valid chart")
+	cached := cachedFiles()
+	require.Equal(t, 1, len(cached), "cached chart")
+
+	// Detect corrupted cache entry
+	err = ioutil.WriteFile(cached[0], chartRepo.Files["/release-name-0.1.0.tgz"], 0644)
+	require.NoError(t, err)
+	for _, offline := range []bool{false, true} {
+		corruptedCfg := *cfg
+		corruptedCfg.Offline = offline
+		err = render(t, corruptedCfg, true, &bytes.Buffer{})
+		require.Error(t, err, "render corrupted cached chart (offline: %v)", offline)
+		require.Contains(t, err.Error(), "corrupted", "render corrupted cached chart (offline: %v)", offline)
+	}
+}
+
+func TestRenderIndexMaxAge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-index-max-age-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	indexDownloads := func() (n int) {
+		for _, p := range chartRepo.Requests() {
+			if p == "/index.yaml" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Local chart with remote dependency but without requirements.lock
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", chartRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+
+	for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+		for _, c := range []struct {
+			name        string
+			maxAge      time.Duration
+			refresh     bool
+			expired     bool
+			downloadIdx bool
+		}{
+			{"max age", time.Hour, false, false, false},
+			{"no max age", 0, false, false, true},
+			{"refresh", time.Hour, true, false, true},
+			{"expired", time.Hour, false, true, true},
+		} {
+			t.Run(fmt.Sprintf("%s %s", c.name, filepath.Base(cfg.Chart)), func(t *testing.T) {
+				// Populate cache
+				err := render(t, *cfg, true, &bytes.Buffer{})
+				require.NoError(t, err)
+				if c.expired {
+					indexFiles, err := NewHelm().CachedIndexFiles()
+					require.NoError(t, err)
+					require.Equal(t, 1, len(indexFiles), "cached index files")
+					past := time.Now().Add(-2 * c.maxAge)
+					err = os.Chtimes(indexFiles[0].File, past, past)
+					require.NoError(t, err)
+				}
+				// Let the local chart's remote dependencies require an index update
+				_ = os.Remove(filepath.Join(localChartDir, "requirements.lock"))
+				downloads := indexDownloads()
+
+				req := *cfg
+				req.IndexMaxAge = c.maxAge
+				req.Refresh = c.refresh
+				err = render(t, req, true, &bytes.Buffer{})
+				require.NoError(t, err)
+				if c.downloadIdx {
+					require.Equal(t, downloads+1, indexDownloads(), "index downloads")
+				} else {
+					require.Equal(t, downloads, indexDownloads(), "index downloads")
+				}
+			})
+		}
+	}
+}
+
+func TestRepositoriesDownloadIndexFilesConcurrently(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-index-download-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	settings := cli.EnvSettings{Home: helmpath.Home(filepath.Join(tmpDir, "helm"))}
+	getters := getter.All(settings)
+	trust := true
+	opts := &repositoryOptions{TrustAnyRepository: &trust}
+
+	// Repositories that only respond when all of them are requested concurrently
+	var barrier sync.WaitGroup
+	barrier.Add(3)
+	concurrentRepoURLs := map[string]struct{}{}
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			barrier.Done()
+			done := make(chan struct{})
+			go func() {
+				barrier.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				w.Write([]byte("apiVersion: v1\nentries: {}\n"))
+			case <-time.After(5 * time.Second):
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+		}))
+		defer srv.Close()
+		concurrentRepoURLs[srv.URL] = struct{}{}
+	}
+	repos, err := reposForURLs(context.Background(), concurrentRepoURLs, opts, &settings, getters)
+	require.NoError(t, err)
+	err = repos.UpdateIndex(context.Background())
+	require.NoError(t, err, "download index files concurrently")
+
+	// Report all errors
+	failingRepoURLs := map[string]struct{}{}
+	for i := 0; i < 2; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+		failingRepoURLs[srv.URL] = struct{}{}
+	}
+	allRepoURLs := map[string]struct{}{}
+	for _, m := range []map[string]struct{}{concurrentRepoURLs, failingRepoURLs} {
+		for u := range m {
+			allRepoURLs[u] = struct{}{}
+		}
+	}
+	repos, err = reposForURLs(context.Background(), allRepoURLs, opts, &settings, getters)
+	require.NoError(t, err)
+	err = repos.DownloadIndexFilesIfNotExist(context.Background())
+	require.Error(t, err, "download failing index files")
+	for u := range failingRepoURLs {
+		require.Contains(t, err.Error(), u, "error should report all failing repositories")
+	}
+
+	// Cancellation
+	repos, err = reposForURLs(context.Background(), failingRepoURLs, opts, &settings, getters)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = repos.UpdateIndex(ctx)
+	require.Error(t, err, "download index files with canceled context")
+}
+
+func TestRenderRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-retry-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"))
+	defer chartRepo.Close()
+	cfg := config.NewChartConfig()
+	cfg.Repository = chartRepo.URL
+	cfg.Chart = "namespace"
+	cfg.Version = "0.1.x"
+	cfg.Name = "myrelease"
+	countRequests := func(path string) int {
+		n := 0
+		for _, p := range chartRepo.Requests() {
+			if p == path {
+				n++
+			}
+		}
+		return n
+	}
+	newHelm := func(retry RetryOptions) *Helm {
+		helmHome, err := ioutil.TempDir(tmpDir, "helm-home-")
+		require.NoError(t, err)
+		h := NewHelm()
+		h.Settings.Home = helmpath.Home(helmHome)
+		h.Retry = retry
+		return h
+	}
+	retryOpts := RetryOptions{MaxRetries: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond}
+
+	// Succeed after transient failures
+	chartRepo.Failures = map[string]int{"/index.yaml": 2, "/namespace-0.1.0.tgz": 2}
+	_, err = newHelm(retryOpts).Render(context.Background(), cfg)
+	require.NoError(t, err, "render with transient failures")
+	require.Equal(t, 3, countRequests("/index.yaml"), "index requests")
+	require.Equal(t, 3, countRequests("/namespace-0.1.0.tgz"), "chart requests")
+
+	// Report every attempt's failure when the retries are exhausted
+	chartRepo.Failures = map[string]int{"/namespace-0.1.0.tgz": 3}
+	_, err = newHelm(retryOpts).Render(context.Background(), cfg)
+	require.Error(t, err, "render with persistent failures")
+	for i := 1; i <= 3; i++ {
+		require.Contains(t, err.Error(), fmt.Sprintf("attempt %d: ", i), "error")
+	}
+	require.Contains(t, err.Error(), "502", "error")
+	require.Equal(t, 6, countRequests("/namespace-0.1.0.tgz"), "chart requests")
+
+	// Do not retry permanent failures
+	chartRepo.Username = "fakeuser"
+	_, err = newHelm(retryOpts).Render(context.Background(), cfg)
+	chartRepo.Username = ""
+	require.Error(t, err, "render with permanent failure")
+	require.Equal(t, 5, countRequests("/index.yaml"), "index requests")
+
+	// Cancel immediately while waiting for the next attempt
+	chartRepo.Failures = map[string]int{"/index.yaml": 3}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = newHelm(RetryOptions{MaxRetries: 2, InitialBackoff: time.Minute}).Render(ctx, cfg)
+	require.Error(t, err, "render with cancelled context")
+	require.Less(t, int64(time.Since(start)), int64(10*time.Second), "duration until cancelled")
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err), "error cause")
+}
+
+func TestRenderTrustPolicy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-trust-policy-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	writeFile := func(name, content string) string {
+		file := filepath.Join(tmpDir, name)
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(file, []byte(content), 0644)
+		require.NoError(t, err)
+		return file
+	}
+	chartDirs := []string{filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name")}
+	allowedRepo := newFakeChartRepository(t, chartDirs...)
+	defer allowedRepo.Close()
+	allowedRepo.Files["/values.yaml"] = []byte("fakevalue: true\n")
+	registeredRepo := newFakeChartRepository(t, chartDirs...)
+	defer registeredRepo.Close()
+	registeredRepo.Files["/values.yaml"] = []byte("fakevalue: true\n")
+	unknownRepo := newFakeChartRepository(t, chartDirs...)
+	defer unknownRepo.Close()
+	deniedRepo := newFakeChartRepository(t, chartDirs...)
+	defer deniedRepo.Close()
+	helmHome := helmpath.Home(filepath.Join(tmpDir, "helm"))
+	repos := repo.NewRepoFile()
+	repos.Add(&repo.Entry{Name: "registered", URL: registeredRepo.URL}, &repo.Entry{Name: "denied", URL: deniedRepo.URL})
+	err = os.MkdirAll(helmHome.Repository(), 0755)
+	require.NoError(t, err)
+	err = repos.WriteFile(helmHome.RepositoryFile(), 0644)
+	require.NoError(t, err)
+	policy := fmt.Sprintf(`apiVersion: khelm.mgoltzsche.github.com/v1
+kind: TrustPolicy
+allow:
+- urlPrefix: %s/
+- scheme: oci
+  host: "*.example.org"
+deny:
+- urlPrefix: %s
+- host: "*.denied.example.org"
+`, allowedRepo.URL, deniedRepo.URL)
+	policyFile := writeFile("trust-policy.yaml", policy)
+	trustPolicy, err := LoadTrustPolicy(policyFile)
+	require.NoError(t, err)
+	httpsOnlyPolicyFile := writeFile("https-only-policy.yaml", "apiVersion: khelm.mgoltzsche.github.com/v1\nkind: TrustPolicy\ndeny:\n- scheme: http\n")
+	httpsOnlyPolicy, err := LoadTrustPolicy(httpsOnlyPolicyFile)
+	require.NoError(t, err)
+
+	remoteChart := func(repoURL string, valueFiles ...string) *config.ChartConfig {
+		cfg := config.NewChartConfig()
+		cfg.Repository = repoURL
+		cfg.Chart = "namespace"
+		cfg.Version = "0.1.x"
+		cfg.Name = "myrelease"
+		cfg.ValueFiles = valueFiles
+		return cfg
+	}
+	localChart := func(depRepoURL string) *config.ChartConfig {
+		dir := fmt.Sprintf("localchart-%x", sha256.Sum256([]byte(depRepoURL)))
+		writeFile(filepath.Join(dir, "Chart.yaml"), "apiVersion: v1\nname: localchart\nversion: 0.1.0\n")
+		writeFile(filepath.Join(dir, "requirements.yaml"), fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", depRepoURL))
+		cfg := config.NewChartConfig()
+		cfg.Chart = filepath.Join(tmpDir, dir)
+		cfg.Name = "myrelease"
+		return cfg
+	}
+	gitChart := config.NewChartConfig()
+	gitChart.Repository = "git+https://git.denied.example.org/charts.git"
+	gitChart.Chart = "mychart"
+	gitChart.Name = "myrelease"
+	ociChart := remoteChart("oci://registry.denied.example.org/charts")
+
+	for _, c := range []struct {
+		name      string
+		policy    *TrustPolicy
+		cfg       *config.ChartConfig
+		untrusted bool
+	}{
+		{"allowed repo", trustPolicy, remoteChart(allowedRepo.URL), false},
+		{"registered repo", trustPolicy, remoteChart(registeredRepo.URL), false},
+		{"unknown repo", trustPolicy, remoteChart(unknownRepo.URL), true},
+		{"denied registered repo", trustPolicy, remoteChart(deniedRepo.URL), true},
+		{"denied registered repo alias", trustPolicy, remoteChart("@denied"), true},
+		{"allowed dependency", trustPolicy, localChart(allowedRepo.URL), false},
+		{"unknown dependency", trustPolicy, localChart(unknownRepo.URL), true},
+		{"denied dependency", trustPolicy, localChart(deniedRepo.URL), true},
+		{"allowed value file", trustPolicy, remoteChart(allowedRepo.URL, allowedRepo.URL+"/values.yaml"), false},
+		{"unknown value file", trustPolicy, remoteChart(allowedRepo.URL, registeredRepo.URL+"/values.yaml"), true},
+		{"denied git repo", trustPolicy, gitChart, true},
+		{"denied OCI registry", trustPolicy, ociChart, true},
+		{"denied scheme", httpsOnlyPolicy, remoteChart(registeredRepo.URL), true},
+		{"denied dependency scheme", httpsOnlyPolicy, localChart(registeredRepo.URL), true},
+		{"denied value file scheme", httpsOnlyPolicy, remoteChart("oci://registry.example.org/charts", allowedRepo.URL+"/values.yaml"), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := NewHelm()
+			h.Settings.Home = helmHome
+			h.TrustPolicy = c.policy
+			_, err := h.Render(context.Background(), c.cfg)
+			if c.untrusted {
+				require.Error(t, err)
+				require.True(t, IsUntrustedRepository(err), "untrusted repository error expected but was: %s", err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		"apiVersion: khelm.mgoltzsche.github.com/v1\nkind: OtherKind\n",
+		"apiVersion: khelm.mgoltzsche.github.com/v1\nkind: TrustPolicy\nallow:\n- {}\n",
+		"apiVersion: khelm.mgoltzsche.github.com/v1\nkind: TrustPolicy\ndeny:\n- host: \"[\"\n",
+		"apiVersion: khelm.mgoltzsche.github.com/v1\nkind: TrustPolicy\ndeny:\n- hosts: example.org\n",
+	} {
+		_, err = LoadTrustPolicy(writeFile("invalid-policy.yaml", invalid))
+		require.Error(t, err, "load invalid policy:\n%s", invalid)
+	}
+}
+
+func TestRenderMirror(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-mirror-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	helmHome := helmpath.Home(filepath.Join(tmpDir, "helm"))
+	os.Setenv("HELM_HOME", helmHome.String())
+	defer os.Unsetenv("HELM_HOME")
+	chartDirs := []string{filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name")}
+	upstreamRepo := newFakeChartRepository(t, chartDirs...)
+	upstreamRepo.Close()
+	// The mirror serves the upstream index that refers to the upstream chart URLs
+	mirrorRepo := newFakeChartRepository(t, chartDirs...)
+	defer mirrorRepo.Close()
+	mirrorRepo.Index = upstreamRepo.Index
+
+	// Local chart with remote dependency
+	localChartDir := filepath.Join(tmpDir, "localchart")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: localchart\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n", upstreamRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = upstreamRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+
+	writeRepositoriesFile := func(repoURL string) {
+		repos := repo.NewRepoFile()
+		repos.Add(&repo.Entry{Name: "myrepo", URL: repoURL})
+		err := os.MkdirAll(helmHome.Repository(), 0755)
+		require.NoError(t, err)
+		err = repos.WriteFile(helmHome.RepositoryFile(), 0644)
+		require.NoError(t, err)
+	}
+	mirrors, err := ParseMirrors([]string{fmt.Sprintf("%s=%s", upstreamRepo.URL, mirrorRepo.URL)})
+	require.NoError(t, err)
+	trust := false
+	h := NewHelm()
+	h.TrustAnyRepository = &trust
+	h.Mirrors = mirrors
+
+	// Trust is derived from the mirror
+	writeRepositoriesFile(upstreamRepo.URL)
+	for _, cfg := range []*config.ChartConfig{remoteChartCfg, localChartCfg} {
+		_, err = h.Render(context.Background(), cfg)
+		require.Error(t, err, "render %s with untrusted mirror", cfg.Chart)
+		require.True(t, IsUntrustedRepository(err), "untrusted repository error expected but was: %s", err)
+	}
+	writeRepositoriesFile(mirrorRepo.URL)
+	for _, c := range []struct {
+		cfg         *config.ChartConfig
+		mustContain string
+	}{
+		{remoteChartCfg, "myconfigb"},
+		{localChartCfg, "myrelease-config"},
+	} {
+		resources, err := h.Render(context.Background(), c.cfg)
+		require.NoError(t, err, "render %s via mirror", c.cfg.Chart)
+		var rendered bytes.Buffer
+		enc := yaml.NewEncoder(&rendered)
+		for _, r := range resources {
+			enc.Encode(r.Document())
+		}
+		enc.Close()
+		require.Contains(t, rendered.String(), c.mustContain, "render %s via mirror", c.cfg.Chart)
+	}
+	require.Contains(t, mirrorRepo.Requests(), "/namespace-0.1.0.tgz", "mirror requests")
+	require.Contains(t, mirrorRepo.Requests(), "/release-name-0.1.0.tgz", "mirror requests")
+	require.Empty(t, upstreamRepo.Requests(), "upstream requests")
+}
+
+func TestMirrorsRewrite(t *testing.T) {
+	mirrors, err := ParseMirrors([]string{
+		"https://charts.example.org=https://mirror.example.org/charts/",
+		"https://charts.example.org/special = https://special.example.org",
+		"",
+	})
+	require.NoError(t, err)
+	for _, c := range []struct {
+		url      string
+		expected string
+	}{
+		{"https://charts.example.org", "https://mirror.example.org/charts"},
+		{"https://charts.example.org/stable/mychart-0.1.0.tgz", "https://mirror.example.org/charts/stable/mychart-0.1.0.tgz"},
+		{"https://charts.example.org/special/mychart-0.1.0.tgz", "https://special.example.org/mychart-0.1.0.tgz"},
+		{"https://charts.example.org.evil.com/mychart-0.1.0.tgz", "https://charts.example.org.evil.com/mychart-0.1.0.tgz"},
+		{"https://other.example.org/mychart-0.1.0.tgz", "https://other.example.org/mychart-0.1.0.tgz"},
+	} {
+		require.Equal(t, c.expected, mirrors.Rewrite(c.url), "rewrite %s", c.url)
+	}
+	for _, rule := range []string{"https://charts.example.org", "charts.example.org=https://mirror.example.org", "https://charts.example.org=/mirror"} {
+		_, err = ParseMirrors([]string{rule})
+		require.Error(t, err, "parse invalid mirror %q", rule)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-cache-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	ch.Metadata.Version = "0.2.0-rc.1"
+	err = chartutil.SaveDir(ch, tmpDir)
+	require.NoError(t, err)
+	chartRepo.AddChart(t, filepath.Join(tmpDir, "namespace"))
+
+	// Populate cache
+	for _, c := range []struct {
+		chart   string
+		version string
+	}{
+		{"namespace", "0.1.0"},
+		{"namespace", "0.2.0-rc.1"},
+		{"release-name", "0.1.0"},
+	} {
+		cfg := config.NewChartConfig()
+		cfg.Repository = chartRepo.URL
+		cfg.Chart = c.chart
+		cfg.Version = c.version
+		cfg.Name = "myrelease"
+		err = render(t, *cfg, true, &bytes.Buffer{})
+		require.NoError(t, err, "render %s %s", c.chart, c.version)
+	}
+
+	// List
+	h := NewHelm()
+	charts, err := h.CachedCharts()
+	require.NoError(t, err)
+	listed := make([]string, len(charts))
+	host := cacheHostSegment(strings.TrimPrefix(chartRepo.URL, "http://"))
+	for i, c := range charts {
+		require.Equal(t, strings.TrimPrefix(chartRepo.URL, "http://"), c.Host, "host of %s", c.File)
+		require.True(t, strings.Contains(c.File, host), "file path %s should contain host segment %s", c.File, host)
+		require.Equal(t, 16, len(c.Digest), "digest of %s", c.File)
+		listed[i] = fmt.Sprintf("%s-%s", c.Name, c.Version)
+	}
+	sort.Strings(listed)
+	require.Equal(t, []string{"namespace-0.1.0", "namespace-0.2.0-rc.1", "release-name-0.1.0"}, listed, "cached charts")
+	for _, hostName := range []string{"charts_example.org:8443", "[::1]:8080"} {
+		require.Equal(t, hostName, cacheHost(cacheHostSegment(hostName)), "host of cache dir %s", cacheHostSegment(hostName))
+	}
+	indexFiles, err := h.CachedIndexFiles()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(indexFiles), "cached index files")
+
+	// Verify
+	corrupted, err := h.VerifyCache()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(corrupted), "corrupted charts")
+	var releaseNameFile string
+	for _, c := range charts {
+		if c.Name == "release-name" {
+			releaseNameFile = c.File
+		}
+	}
+	err = ioutil.WriteFile(releaseNameFile, []byte("corrupted"), 0644)
+	require.NoError(t, err)
+	corrupted, err = h.VerifyCache()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(corrupted), "corrupted charts")
+	require.Equal(t, releaseNameFile, corrupted[0].File, "corrupted chart")
+
+	// Prune
+	_, err = h.PruneCache(context.Background(), CachePruneOptions{})
+	require.Error(t, err, "prune without options")
+	removed, err := h.PruneCache(context.Background(), CachePruneOptions{KeepLatest: 1, DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(removed), "dry-run removed files")
+	charts, err = h.CachedCharts()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(charts), "cached charts after dry-run")
+	removed, err = h.PruneCache(context.Background(), CachePruneOptions{KeepLatest: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(removed), "removed files")
+	require.Contains(t, removed[0], "namespace-0.1.0.tgz", "removed file")
+	require.NoFileExists(t, removed[0])
+	require.NoFileExists(t, pathLockFile(filepath.Dir(removed[0])), "lock file of removed chart")
+	require.FileExists(t, pathLockFile(filepath.Dir(releaseNameFile)), "lock file of kept chart")
+	home := helmpath.Home(filepath.Join(tmpDir, "helm"))
+	unusedChartDir, usedChartDir := filepath.Join(tmpDir, "unused"), filepath.Join(tmpDir, "used")
+	for _, dir := range []string{unusedChartDir, usedChartDir} {
+		err = os.Mkdir(dir, 0755)
+		require.NoError(t, err)
+		unlock, err := lockChartDirs(context.Background(), home, []string{dir})
+		require.NoError(t, err)
+		unlock()
+	}
+	unlock, err := lockChartDirs(context.Background(), home, []string{usedChartDir})
+	require.NoError(t, err)
+	defer unlock()
+	chartDirLockFiles, err := filepath.Glob(filepath.Join(chartDirLockDir(home), "chart-*.lock"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(chartDirLockFiles), "chart dir lock files")
+	past := time.Now().Add(-2 * time.Hour)
+	for _, file := range append(chartDirLockFiles, releaseNameFile, indexFiles[0].File) {
+		err = os.Chtimes(file, past, past)
+		require.NoError(t, err)
+	}
+	removed, err = h.PruneCache(context.Background(), CachePruneOptions{OlderThan: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, []string{releaseNameFile, indexFiles[0].File}, removed, "removed expired files")
+	require.NoFileExists(t, pathLockFile(filepath.Dir(releaseNameFile)), "lock file of expired chart")
+	require.NoFileExists(t, pathLockFile(indexFiles[0].File), "lock file of expired index file")
+	chartDirLockFiles, err = filepath.Glob(filepath.Join(chartDirLockDir(home), "chart-*.lock"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(chartDirLockFiles), "chart dir lock files after prune")
+	unlock, err = lockChartDirs(context.Background(), home, []string{unusedChartDir})
+	require.NoError(t, err, "lock chart dir after its lock file has been pruned")
+	unlock()
+	charts, err = h.CachedCharts()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(charts), "cached charts after prune")
+	require.Equal(t, "0.2.0-rc.1", charts[0].Version, "remaining chart")
+}
+
+func TestRenderConcurrently(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-concurrent-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"), filepath.Join(rootDir, "example/release-name"))
+	defer chartRepo.Close()
+
+	// Local chart with a local dependency (rebuilt on every render) and remote dependencies
+	parentChartDir := filepath.Join(tmpDir, "parent")
+	childChartDir := filepath.Join(tmpDir, "child")
+	for dir, requirements := range map[string]string{
+		parentChartDir: fmt.Sprintf("dependencies:\n- name: release-name\n  version: 0.1.x\n  repository: %s\n- name: child\n  version: 0.1.0\n  repository: file://../child\n", chartRepo.URL),
+		childChartDir:  fmt.Sprintf("dependencies:\n- name: namespace\n  version: 0.1.0\n  repository: %s\n", chartRepo.URL),
+	} {
+		err = os.MkdirAll(dir, 0755)
+		require.NoError(t, err)
+		chartYAML := fmt.Sprintf("apiVersion: v1\nname: %s\nversion: 0.1.0\n", filepath.Base(dir))
+		err = ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(chartYAML), 0644)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(dir, "requirements.yaml"), []byte(requirements), 0644)
+		require.NoError(t, err)
+	}
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = parentChartDir
+	localChartCfg.Name = "myrelease"
+	childChartCfg := config.NewChartConfig()
+	childChartCfg.Chart = childChartDir
+	childChartCfg.Name = "myrelease"
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.x"
+	remoteChartCfg.Name = "myrelease"
+
+	// Initialize kyaml's global openapi schema upfront since its lazy initialization is not thread-safe
+	_, _ = openapi.IsNamespaceScoped(kyaml.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 12)
+	for i := 0; i < 4; i++ {
+		for _, cfg := range []*config.ChartConfig{localChartCfg, childChartCfg, remoteChartCfg} {
+			wg.Add(1)
+			go func(cfg config.ChartConfig) {
+				defer wg.Done()
+				errs <- errors.Wrapf(render(t, cfg, true, &bytes.Buffer{}), "render %s", cfg.Chart)
+			}(*cfg)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err, "concurrent render")
+	}
+	indexFiles, err := NewHelm().CachedIndexFiles()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(indexFiles), "cached index files")
+
+	// Lock acquisition must be cancelable
+	unlock, err := lockChartDirs(context.Background(), helmpath.Home(filepath.Join(tmpDir, "helm")), []string{parentChartDir})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = lockChartDirs(ctx, helmpath.Home(filepath.Join(tmpDir, "helm")), []string{childChartDir, parentChartDir})
+	require.Error(t, err, "lock locked chart dir")
+	unlock()
+	unlock, err = lockChartDirs(context.Background(), helmpath.Home(filepath.Join(tmpDir, "helm")), []string{childChartDir, parentChartDir})
+	require.NoError(t, err, "lock released chart dir")
+	unlock()
+}
+
+func TestRenderWhilePruningCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-prune-concurrently-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	os.Setenv("HELM_HOME", filepath.Join(tmpDir, "helm"))
+	defer os.Unsetenv("HELM_HOME")
+	chartRepo := newFakeChartRepository(t, filepath.Join(rootDir, "example/namespace"))
+	defer chartRepo.Close()
+	ch, err := chartutil.Load(filepath.Join(rootDir, "example/namespace"))
+	require.NoError(t, err)
+	ch.Metadata.Version = "0.2.0"
+	err = chartutil.SaveDir(ch, tmpDir)
+	require.NoError(t, err)
+	chartRepo.AddChart(t, filepath.Join(tmpDir, "namespace"))
+	localChartDir := filepath.Join(tmpDir, "local")
+	err = os.MkdirAll(localChartDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: local\nversion: 0.1.0\n"), 0644)
+	require.NoError(t, err)
+	requirements := fmt.Sprintf("dependencies:\n- name: namespace\n  version: 0.1.0\n  repository: %s\n", chartRepo.URL)
+	err = ioutil.WriteFile(filepath.Join(localChartDir, "requirements.yaml"), []byte(requirements), 0644)
+	require.NoError(t, err)
+	localChartCfg := config.NewChartConfig()
+	localChartCfg.Chart = localChartDir
+	localChartCfg.Name = "myrelease"
+	remoteChartCfg := config.NewChartConfig()
+	remoteChartCfg.Repository = chartRepo.URL
+	remoteChartCfg.Chart = "namespace"
+	remoteChartCfg.Version = "0.1.0"
+	remoteChartCfg.Name = "myrelease"
+	latestChartCfg := *remoteChartCfg
+	latestChartCfg.Version = "0.2.0"
+
+	// Initialize kyaml's global openapi schema upfront since its lazy initialization is not thread-safe
+	_, _ = openapi.IsNamespaceScoped(kyaml.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"})
+
+	// Prune the older chart version continuously while it is rendered
+	done := make(chan struct{})
+	pruned := make(chan error, 1)
+	go func() {
+		h := NewHelm()
+		for {
+			select {
+			case <-done:
+				pruned <- nil
+				return
+			default:
+			}
+			if _, err := h.PruneCache(context.Background(), CachePruneOptions{KeepLatest: 1}); err != nil {
+				pruned <- err
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 10; i++ {
+		for _, cfg := range []*config.ChartConfig{localChartCfg, remoteChartCfg, &latestChartCfg} {
+			wg.Add(1)
+			go func(cfg config.ChartConfig) {
+				defer wg.Done()
+				errs <- errors.Wrapf(render(t, cfg, true, &bytes.Buffer{}), "render %s", cfg.Chart)
+			}(*cfg)
+		}
+	}
+	wg.Wait()
+	close(done)
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err, "render while pruning the cache")
+	}
+	require.NoError(t, <-pruned, "prune cache while rendering")
+}
+
+// fakeChartRepository serves a chart repository containing the provided charts
+type fakeChartRepository struct {
+	URL      string
+	Index    *repo.IndexFile
+	Files    map[string][]byte
+	Username string
+	Password string
+	Token    string
+	// Failures specifies the amount of 502 responses per path before it is served
+	Failures map[string]int
+	server   *httptest.Server
+	requests []string
+	mutex    sync.Mutex
+}
+
+func newFakeChartRepository(t *testing.T, chartDirs ...string) *fakeChartRepository {
+	r := &fakeChartRepository{Files: map[string][]byte{}}
+	r.server = httptest.NewServer(r)
+	return r.init(t, chartDirs)
+}
+
+// newFakeTLSChartRepository creates a fake chart repository that is served via HTTPS
+// and requires a client certificate signed by one of the given CAs.
+func newFakeTLSChartRepository(t *testing.T, clientCAs *x509.CertPool, chartDirs ...string) *fakeChartRepository {
+	r := &fakeChartRepository{Files: map[string][]byte{}}
+	r.server = httptest.NewUnstartedServer(r)
+	r.server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	r.server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	r.server.StartTLS()
+	return r.init(t, chartDirs)
+}
+
+func (r *fakeChartRepository) init(t *testing.T, chartDirs []string) *fakeChartRepository {
+	r.URL = r.server.URL
+	r.Index = repo.NewIndexFile()
+	for _, dir := range chartDirs {
+		r.AddChart(t, dir)
+	}
+	return r
+}
+
+// AddChart packages the given chart directory and publishes it within the repository
+func (r *fakeChartRepository) AddChart(t *testing.T, chartDir string) {
+	tmpDir, err := ioutil.TempDir("", "khelm-test-repo-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ch, err := chartutil.Load(chartDir)
+	require.NoError(t, err)
+	tgz, err := chartutil.Save(ch, tmpDir)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(tgz)
+	require.NoError(t, err)
+	fileName := filepath.Base(tgz)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Files["/"+fileName] = b
+	r.Index.Add(ch.Metadata, fileName, r.URL, fmt.Sprintf("%x", sha256.Sum256(b)))
+	r.Index.SortEntries()
+}
+
+func (r *fakeChartRepository) Close() {
+	r.server.Close()
+}
+
+// Requests returns the paths of all requests the server received
+func (r *fakeChartRepository) Requests() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+func (r *fakeChartRepository) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests = append(r.requests, req.URL.Path)
+	if r.Failures[req.URL.Path] > 0 {
+		r.Failures[req.URL.Path]--
+		writer.WriteHeader(502)
+		return
+	}
+	if r.Username != "" {
+		usr, pwd, ok := req.BasicAuth()
+		if !ok || usr != r.Username || pwd != r.Password {
+			writer.WriteHeader(401)
+			return
+		}
+	}
+	if r.Token != "" && req.Header.Get("Authorization") != "Bearer "+r.Token {
+		writer.WriteHeader(401)
+		return
+	}
+	if req.URL.Path == "/index.yaml" {
+		b, err := helmyaml.Marshal(r.Index)
+		if err != nil {
+			writer.WriteHeader(500)
+			return
+		}
+		writer.Write(b)
+		return
+	}
+	if b, ok := r.Files[req.URL.Path]; ok {
+		writer.Write(b)
+		return
+	}
+	writer.WriteHeader(404)
+}
+
+type fakeOCIRegistry struct {
+	URL            string
+	ManifestDigest string
+	BlobDownloads  int
+	// Failures specifies the amount of 503 responses per path before it is served
+	Failures    map[string]int
+	name        string
+	manifest    []byte
+	chartDigest string
+	blobs       map[string][]byte
+}
+
+func newFakeOCIRegistry(t *testing.T, name string, meta *chart.Metadata, chartTgz string) *fakeOCIRegistry {
+	chartData, err := ioutil.ReadFile(chartTgz)
+	require.NoError(t, err)
+	configData, err := json.Marshal(meta)
+	require.NoError(t, err)
+	digest := func(b []byte) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	}
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"config": map[string]interface{}{
+			"mediaType": ociChartConfigMediaType,
+			"digest":    digest(configData),
+			"size":      len(configData),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": ociChartLayerMediaType,
+			"digest":    digest(chartData),
+			"size":      len(chartData),
+		}},
+	}
+	manifestData, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	return &fakeOCIRegistry{
+		ManifestDigest: digest(manifestData),
+		name:           name,
+		manifest:       manifestData,
+		chartDigest:    digest(chartData),
+		blobs: map[string][]byte{
+			digest(configData): configData,
+			digest(chartData):  chartData,
+		},
+	}
+}
+
+func (f *fakeOCIRegistry) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		usr, pwd, ok := req.BasicAuth()
+		if !ok || usr != "fakeuser" || pwd != "fakepassword" {
+			writer.WriteHeader(401)
+			return
+		}
+		writer.Write([]byte(`{"token":"faketoken"}`))
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer faketoken" {
+		writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, f.URL, f.name))
+		writer.WriteHeader(401)
+		return
+	}
+	if f.Failures[req.URL.Path] > 0 {
+		f.Failures[req.URL.Path]--
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	prefix := fmt.Sprintf("/v2/%s/", f.name)
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		writer.WriteHeader(404)
+		return
+	}
+	p := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 2)
+	switch {
+	case p[0] == "tags" && p[1] == "list":
+		writer.Write([]byte(`{"tags":["0.0.1","0.1.0","notsemver"]}`))
+	case p[0] == "manifests" && (p[1] == "0.1.0" || p[1] == f.ManifestDigest):
+		writer.Header().Set("Content-Type", ociManifestMediaType)
+		writer.Write(f.manifest)
+	case p[0] == "blobs" && f.blobs[p[1]] != nil:
+		if p[1] == f.chartDigest {
+			f.BlobDownloads++
+		}
+		writer.Write(f.blobs[p[1]])
+	default:
+		writer.WriteHeader(404)
+	}
+}
+
+// chartArchive creates a chart archive containing the given files
+func chartArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		require.NoError(t, err)
+		_, err = tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
 func renderFile(t *testing.T, file string, trustAnyRepo bool, rootDir string, writer io.Writer) error {
 	f, err := os.Open(file)
 	require.NoError(t, err)
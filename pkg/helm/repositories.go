@@ -13,6 +13,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"k8s.io/helm/pkg/chartutil"
@@ -22,6 +24,9 @@ import (
 	"k8s.io/helm/pkg/repo"
 )
 
+// maxParallelIndexDownloads limits the amount of repository index files that are downloaded concurrently
+const maxParallelIndexDownloads = 5
+
 type untrustedRepoError struct {
 	error
 }
@@ -52,14 +57,39 @@ type repositoryConfig interface {
 	DownloadIndexFilesIfNotExist(context.Context) error
 	RequireTempHelmHome(bool)
 	Apply() (repositoryConfig, error)
+	MirrorURL(u string) string
+	RetryOptions() RetryOptions
+	IdentityTokenGetters(getter.Providers) getter.Providers
+}
+
+// repositoryOptions specifies how repositories are accessed
+type repositoryOptions struct {
+	TrustAnyRepository *bool
+	Offline            bool
+	// IndexMaxAge specifies how long a cached repository index file is used before it is updated (0 updates it on every UpdateIndex call)
+	IndexMaxAge time.Duration
+	// Mirrors specifies the mirrors repositories are accessed with
+	Mirrors Mirrors
+	// CredentialHelper specifies the executable that provides the credentials of repositories that have none configured
+	CredentialHelper string
+	// TrustPolicy specifies the repositories that may be used in addition to the ones within repositories.yaml
+	TrustPolicy *TrustPolicy
+	// Retry specifies how failed index and chart downloads are retried
+	Retry RetryOptions
 }
 
-func reposForURLs(repoURLs map[string]struct{}, trustAnyRepo *bool, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
+func reposForURLs(ctx context.Context, repoURLs map[string]struct{}, opts *repositoryOptions, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
 	repos, err := newRepositories(settings, getters)
 	if err != nil {
 		return nil, err
 	}
-	err = repos.setRepositoriesFromURLs(repoURLs, trustAnyRepo)
+	repos.offline = opts.Offline
+	repos.indexMaxAge = opts.IndexMaxAge
+	repos.mirrors = opts.Mirrors
+	repos.credentialHelper = opts.CredentialHelper
+	repos.trustPolicy = opts.TrustPolicy
+	repos.retry = opts.Retry
+	err = repos.setRepositoriesFromURLs(ctx, repoURLs, opts.TrustAnyRepository)
 	if err != nil {
 		return nil, err
 	}
@@ -67,12 +97,12 @@ func reposForURLs(repoURLs map[string]struct{}, trustAnyRepo *bool, settings *cl
 }
 
 // reposForDependencies create temporary repositories.yaml and configure settings with it.
-func reposForDependencies(deps []*chartutil.Dependency, trustAnyRepo *bool, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
+func reposForDependencies(ctx context.Context, deps []*chartutil.Dependency, opts *repositoryOptions, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
 	repoURLs := map[string]struct{}{}
 	for _, d := range deps {
 		repoURLs[d.Repository] = struct{}{}
 	}
-	repos, err := reposForURLs(repoURLs, trustAnyRepo, settings, getters)
+	repos, err := reposForURLs(ctx, repoURLs, opts, settings, getters)
 	if err != nil {
 		return nil, err
 	}
@@ -87,6 +117,15 @@ type repositories struct {
 	cacheDir     string
 	entriesAdded bool
 	indexFiles   map[string]*repo.IndexFile
+	offline      bool
+	indexMaxAge  time.Duration
+	mirrors      Mirrors
+	// credentialHelper provides credentials of repositories that have none configured
+	credentialHelper string
+	trustPolicy      *TrustPolicy
+	retry            RetryOptions
+	// identityTokens maps the URLs repositories are accessed with to the identity tokens the credential helper returned
+	identityTokens map[string]string
 }
 
 func (f *repositories) RequireTempHelmHome(createTemp bool) {
@@ -95,12 +134,13 @@ func (f *repositories) RequireTempHelmHome(createTemp bool) {
 
 func newRepositories(settings *cli.EnvSettings, getters getter.Providers) (r *repositories, err error) {
 	r = &repositories{
-		dir:        settings.Home,
-		repoURLMap: map[string]*repo.Entry{},
-		getters:    getters,
-		cacheDir:   settings.Home.Cache(),
-		indexFiles: map[string]*repo.IndexFile{},
+		dir:            settings.Home,
+		repoURLMap:     map[string]*repo.Entry{},
+		cacheDir:       settings.Home.Cache(),
+		indexFiles:     map[string]*repo.IndexFile{},
+		identityTokens: map[string]string{},
 	}
+	r.getters = identityTokenGetters(getters, r.identityTokens)
 	if !filepath.IsAbs(string(settings.Home)) {
 		return nil, errors.Errorf("helm home must specify absolute file path but was %q", settings.Home)
 	}
@@ -150,7 +190,10 @@ func (f *repositories) repoIndex(ctx context.Context, entry *repo.Entry) (*repo.
 	idx, err := loadIndexFile(ctx, idxFile)
 	if err != nil {
 		if os.IsNotExist(errors.Cause(err)) {
-			err = downloadIndexFile(ctx, entry, f.cacheDir, f.getters)
+			if f.offline {
+				return nil, newNotCachedError(fmt.Sprintf("repository index of %s (%s)", entry.URL, idxFile))
+			}
+			err = downloadIndexFile(ctx, f.mirrorEntry(entry), f.cacheDir, f.getters, f.retry)
 			if err != nil {
 				return nil, err
 			}
@@ -199,8 +242,11 @@ func (f *repositories) ResolveChartVersion(ctx context.Context, name, version, r
 	}
 	cv, err := idx.Get(name, version)
 	if err != nil {
+		if f.offline {
+			return nil, newNotCachedError(fmt.Sprintf("%s within repository index of %s", errMsg, entry.URL))
+		}
 		// Download latest index file and retry lookup if not found
-		err = downloadIndexFile(ctx, entry, f.cacheDir, f.getters)
+		err = downloadIndexFile(ctx, f.mirrorEntry(entry), f.cacheDir, f.getters, f.retry)
 		if err != nil {
 			return nil, errors.Wrapf(err, "repo index download after %s not found", errMsg)
 		}
@@ -259,36 +305,144 @@ func (f *repositories) Get(repo string) (*repo.Entry, error) {
 }
 
 func (f *repositories) DownloadIndexFilesIfNotExist(ctx context.Context) error {
+	if f.offline {
+		return f.requireIndexFiles()
+	}
+	missing := make([]*repo.Entry, 0, len(f.repos.Repositories))
 	for _, r := range f.repos.Repositories {
 		if _, err := os.Stat(indexFile(r, f.cacheDir)); err == nil {
 			continue // do not update existing repo index
 		}
-		if err := downloadIndexFile(ctx, r, f.cacheDir, f.getters); err != nil {
-			return errors.Wrap(err, "download repo index")
-		}
+		missing = append(missing, r)
 	}
-	return nil
+	return f.downloadIndexFiles(ctx, missing)
 }
 
 func (f *repositories) UpdateIndex(ctx context.Context) error {
+	if f.offline {
+		log.Println("Offline mode: using cached repository index files")
+		return f.requireIndexFiles()
+	}
+	expired := make([]*repo.Entry, 0, len(f.repos.Repositories))
 	for _, r := range f.repos.Repositories {
-		if err := downloadIndexFile(ctx, r, f.cacheDir, f.getters); err != nil {
-			return errors.Wrap(err, "download repo index")
+		if !f.isIndexFileFresh(r) {
+			expired = append(expired, r)
+		}
+	}
+	return f.downloadIndexFiles(ctx, expired)
+}
+
+// downloadIndexFiles downloads the index files of the given repositories concurrently
+// using a bounded amount of workers.
+// Instead of stopping at the first failure all errors are reported.
+func (f *repositories) downloadIndexFiles(ctx context.Context, entries []*repo.Entry) error {
+	errs := make([]error, len(entries))
+	jobs := make(chan int)
+	workers := maxParallelIndexDownloads
+	if len(entries) < workers {
+		workers = len(entries)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = downloadIndexFile(ctx, f.mirrorEntry(entries[i]), f.cacheDir, f.getters, f.retry)
+			}
+		}()
+	}
+	interrupt := ctx.Done()
+feed:
+	for i := range entries {
+		select {
+		case jobs <- i:
+		case <-interrupt:
+			break feed
 		}
 	}
+	close(jobs)
+	wg.Wait()
+
+	msgs := make([]string, 0, len(errs))
+	var lastErr error
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			lastErr = err
+		}
+	}
+	switch len(msgs) {
+	case 0:
+		return errors.WithStack(ctx.Err())
+	case 1:
+		return errors.Wrap(lastErr, "download repo index")
+	default:
+		return errors.Errorf("download repo index files:\n * %s", strings.Join(msgs, "\n * "))
+	}
+}
+
+// isIndexFileFresh returns true if the cached index file of the given repository is younger than the configured max age.
+func (f *repositories) isIndexFileFresh(entry *repo.Entry) bool {
+	if f.indexMaxAge <= 0 {
+		return false
+	}
+	fi, err := os.Stat(indexFile(entry, f.cacheDir))
+	if err != nil {
+		return false
+	}
+	age := time.Since(fi.ModTime())
+	if age > f.indexMaxAge {
+		return false
+	}
+	log.Printf("Using cached repository index of %s downloaded %s ago", entry.URL, age.Round(time.Second))
+	return true
+}
+
+// requireIndexFiles returns a not cached error listing all repository index files that do not exist
+func (f *repositories) requireIndexFiles() error {
+	missing := []string{}
+	for _, r := range f.repos.Repositories {
+		idxFile := indexFile(r, f.cacheDir)
+		if _, err := os.Stat(idxFile); err != nil {
+			missing = append(missing, fmt.Sprintf("repository index of %s (%s)", r.URL, idxFile))
+		}
+	}
+	if len(missing) > 0 {
+		return newNotCachedError(missing...)
+	}
 	return nil
 }
 
-func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, trustAnyRepo *bool) error {
+func (f *repositories) setRepositoriesFromURLs(ctx context.Context, repoURLs map[string]struct{}, trustAnyRepo *bool) error {
 	requiredRepos := make([]*repo.Entry, 0, len(repoURLs))
 	repoURLMap := map[string]*repo.Entry{}
+	mirrored := map[string]*repo.Entry{}
+	trusted := map[string]bool{}
 	for u := range repoURLs {
 		repo, _ := f.Get(u)
 		if repo != nil {
 			u = repo.URL
 		} else if strings.HasPrefix(u, "alias:") || strings.HasPrefix(u, "@") {
 			return errors.Errorf("repository %q not found in repositories.yaml", u)
-		} else if trustAnyRepo != nil && !*trustAnyRepo || trustAnyRepo == nil && f.repos != nil {
+		}
+		// The policy applies to the URL that is accessed
+		mirrorURL := f.mirrors.Rewrite(u)
+		allowed, err := f.trustPolicy.check(mirrorURL)
+		if err != nil {
+			return err
+		}
+		if mirrorURL != u {
+			// Trust and credentials are derived from the mirror since it is accessed instead of the repository
+			entry, isTrusted, err := f.mirrorRepository(u, mirrorURL, repo, allowed, trustAnyRepo)
+			if err != nil {
+				return err
+			}
+			mirrored[u] = entry
+			repoURLMap[u] = entry
+			trusted[u] = isTrusted
+			continue
+		} else if repo == nil && !allowed && !isUnknownRepositoryTrusted(trustAnyRepo, f.repos != nil, f.trustPolicy) {
 			err := errors.Errorf("repository %q not found in %s and usage of untrusted repositories is disabled", u, f.dir.RepositoryFile())
 			if f.repos == nil {
 				err = errors.Errorf("request repository %q: %s does not exist and usage of untrusted repositories is disabled", u, f.dir.RepositoryFile())
@@ -296,14 +450,25 @@ func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, tru
 			return &untrustedRepoError{err}
 		}
 		repoURLMap[u] = repo
+		trusted[u] = repo != nil || allowed
 	}
 	if f.repos != nil {
 		for _, entry := range f.repos.Repositories {
-			if repo := repoURLMap[entry.URL]; repo != nil {
+			if repo := repoURLMap[entry.URL]; repo != nil && mirrored[entry.URL] == nil {
 				requiredRepos = append(requiredRepos, repo)
 			}
 		}
 	}
+	mirroredURLs := make([]string, 0, len(mirrored))
+	for u, entry := range mirrored {
+		mirroredURLs = append(mirroredURLs, u)
+		f.repoURLMap[u] = entry
+		f.entriesAdded = true
+	}
+	sort.Strings(mirroredURLs)
+	for _, u := range mirroredURLs {
+		requiredRepos = append(requiredRepos, mirrored[u])
+	}
 	f.repos = repo.NewRepoFile()
 	f.repos.Repositories = requiredRepos
 	newURLs := make([]string, 0, len(repoURLMap))
@@ -320,17 +485,29 @@ func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, tru
 		}
 	}
 
+	if !f.offline {
+		if err := f.setCredentials(ctx); err != nil {
+			return err
+		}
+	}
+
 	// Log repository usage
 	repoUsage := make([]string, len(f.repos.Repositories))
 	for i, entry := range f.repos.Repositories {
-		if repo := repoURLMap[entry.URL]; repo != nil || trustAnyRepo != nil {
+		via := ""
+		if mirrorURL := f.mirrors.Rewrite(entry.URL); mirrorURL != entry.URL {
+			via = fmt.Sprintf(" via mirror %q", mirrorURL)
+		}
+		if trusted[entry.URL] || trustAnyRepo != nil {
 			authInfo := "unauthenticated"
 			if entry.Username != "" && entry.Password != "" {
 				authInfo = fmt.Sprintf("as user %q", entry.Username)
+			} else if f.identityTokens[f.mirrors.Rewrite(entry.URL)] != "" {
+				authInfo = "with identity token"
 			}
-			repoUsage[i] = fmt.Sprintf("Using repository %q (%s)", entry.URL, authInfo)
+			repoUsage[i] = fmt.Sprintf("Using repository %q%s (%s)", entry.URL, via, authInfo)
 		} else {
-			repoUsage[i] = fmt.Sprintf("WARNING: using untrusted repository %q", entry.URL)
+			repoUsage[i] = fmt.Sprintf("WARNING: using untrusted repository %q%s", entry.URL, via)
 		}
 	}
 	sort.Strings(repoUsage)
@@ -341,6 +518,90 @@ func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, tru
 	return nil
 }
 
+// setCredentials sets the credentials provided by the environment and credential helper on the repositories that have none configured.
+// Since helm reads the credentials from repositories.yaml a temporary one is used when credentials have been set.
+func (f *repositories) setCredentials(ctx context.Context) error {
+	for _, entry := range f.repos.Repositories {
+		repoURL := f.mirrors.Rewrite(entry.URL)
+		set, identityToken, err := setCredentials(ctx, entry, repoURL, f.credentialHelper)
+		if err != nil {
+			return err
+		}
+		if identityToken != "" {
+			f.identityTokens[repoURL] = identityToken
+		}
+		f.entriesAdded = f.entriesAdded || set
+	}
+	return nil
+}
+
+// mirrorRepository returns the entry of a repository that is accessed using the given mirror URL.
+// The mirror must either be registered within repositories.yaml (providing the credentials), be allowed by the trust policy or untrusted repositories must be allowed.
+// A registered repository's name is kept to be able to refer to it by its alias.
+// The entry's URL remains the repository URL since it identifies the repository within requirements, lock and cache.
+func (f *repositories) mirrorRepository(repoURL, mirrorURL string, registered *repo.Entry, allowed bool, trustAnyRepo *bool) (*repo.Entry, bool, error) {
+	mirrorRepo, _ := f.Get(mirrorURL)
+	if mirrorRepo == nil && !allowed && !isUnknownRepositoryTrusted(trustAnyRepo, f.repos != nil, f.trustPolicy) {
+		err := errors.Errorf("mirror %q of repository %q not found in %s and usage of untrusted repositories is disabled", mirrorURL, repoURL, f.dir.RepositoryFile())
+		return nil, false, &untrustedRepoError{err}
+	}
+	entry := &repo.Entry{URL: repoURL}
+	if registered != nil {
+		entry.Name = registered.Name
+	} else {
+		// Helm looks up the cached index file by name - derive it from the mirror the index is downloaded from
+		name, err := urlToHash(mirrorURL)
+		if err != nil {
+			return nil, false, err
+		}
+		entry.Name = name
+	}
+	entry.Cache = indexFile(entry, f.cacheDir)
+	if mirrorRepo != nil {
+		entry.Username = mirrorRepo.Username
+		entry.Password = mirrorRepo.Password
+		entry.CertFile = mirrorRepo.CertFile
+		entry.KeyFile = mirrorRepo.KeyFile
+		entry.CAFile = mirrorRepo.CAFile
+	}
+	return entry, mirrorRepo != nil || allowed, nil
+}
+
+// mirrorEntry returns a copy of the given entry that refers to the repository's mirror or the entry itself if it is not mirrored.
+func (f *repositories) mirrorEntry(entry *repo.Entry) *repo.Entry {
+	mirrorURL := f.mirrors.Rewrite(entry.URL)
+	if mirrorURL == entry.URL {
+		return entry
+	}
+	mirror := *entry
+	mirror.URL = mirrorURL
+	return &mirror
+}
+
+// MirrorURL returns the URL the given chart URL is accessed with.
+func (f *repositories) MirrorURL(u string) string {
+	return f.mirrors.Rewrite(u)
+}
+
+// RetryOptions returns how failed downloads from the repositories are retried.
+func (f *repositories) RetryOptions() RetryOptions {
+	return f.retry
+}
+
+// IdentityTokenGetters returns getters that authenticate using the identity tokens the credential helper returned for the repositories.
+func (f *repositories) IdentityTokenGetters(providers getter.Providers) getter.Providers {
+	return identityTokenGetters(providers, f.identityTokens)
+}
+
+// isUnknownRepositoryTrusted returns true if repositories that are not registered within repositories.yaml can be used.
+// By default this is only the case when repositories.yaml does not exist and the trust policy does not specify allow rules.
+func isUnknownRepositoryTrusted(trustAnyRepo *bool, repoFileExists bool, policy *TrustPolicy) bool {
+	if trustAnyRepo != nil {
+		return *trustAnyRepo
+	}
+	return !repoFileExists && !policy.restrictsUnknownRepositories()
+}
+
 func (f *repositories) addRepositoryURL(repoURL string) (*repo.Entry, error) {
 	for _, repo := range f.repos.Repositories {
 		f.repoURLMap[repo.URL] = repo
@@ -408,17 +669,34 @@ func (f *tempRepositories) HelmHome() helmpath.Home {
 }
 
 func (f *tempRepositories) Close() error {
-	return os.Remove(string(f.tmpDir))
+	// Removes the symlinks to the shared cache but not the cache itself
+	return os.RemoveAll(string(f.tmpDir))
 }
 
-func downloadIndexFile(ctx context.Context, entry *repo.Entry, cacheDir string, getters getter.Providers) error {
-	log.Printf("Downloading repository index of %s", entry.URL)
-
+func downloadIndexFile(ctx context.Context, entry *repo.Entry, cacheDir string, getters getter.Providers, retryOpts RetryOptions) error {
 	idxFile := indexFile(entry, cacheDir)
 	err := os.MkdirAll(filepath.Dir(idxFile), 0750)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+
+	// Skip the download when another process downloaded the index file while waiting for the lock
+	var lastModified time.Time
+	if fi, err := os.Stat(idxFile); err == nil {
+		lastModified = fi.ModTime()
+	}
+	unlock, err := lockPath(ctx, idxFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if fi, err := os.Stat(idxFile); err == nil && !fi.ModTime().Equal(lastModified) {
+		log.Printf("Using repository index of %s that has just been downloaded by another process", entry.URL)
+		return nil
+	}
+
+	log.Printf("Downloading repository index of %s", entry.URL)
+
 	tmpIdxFile, err := ioutil.TempFile(filepath.Dir(idxFile), fmt.Sprintf(".tmp-%s-index", entry.Name))
 	if err != nil {
 		return errors.WithStack(err)
@@ -442,7 +720,9 @@ func downloadIndexFile(ctx context.Context, entry *repo.Entry, cacheDir string,
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		err = r.DownloadIndexFile(cacheDir)
+		err = retry(ctx, retryOpts, fmt.Sprintf("download repository index of %s", entry.URL), func() error {
+			return r.DownloadIndexFile(cacheDir)
+		})
 		if err != nil {
 			return errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", entry.URL)
 		}
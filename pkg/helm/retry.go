@@ -0,0 +1,128 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpStatusErrorRegex matches the errors helm's HttpGetter (and the bearer token getter) return for unexpected HTTP status codes
+var httpStatusErrorRegex = regexp.MustCompile(`(?i)failed to fetch .* : (\d{3})\b`)
+
+// RetryOptions specifies how failed downloads are retried.
+// Only transient failures (network errors, HTTP 5xx and 429 responses) are retried.
+type RetryOptions struct {
+	// MaxRetries specifies how often a failed download is retried (0 disables retries)
+	MaxRetries int
+	// InitialBackoff specifies the delay before the first retry which doubles with every retry
+	InitialBackoff time.Duration
+	// MaxBackoff limits the delay between retries
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryOptions returns the retry options that are used by default
+func DefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		MaxRetries:     3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     20 * time.Second,
+	}
+}
+
+// retry calls the given function until it succeeds, fails with a permanent error or the retries are exhausted.
+// Between the attempts it waits with exponential backoff and jitter unless the context is cancelled.
+// The returned error contains the cause of every failed attempt.
+func retry(ctx context.Context, opts RetryOptions, action string, fn func() error) error {
+	var errs []error
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+		if attempt > opts.MaxRetries || ctx.Err() != nil || !isRetryable(err) {
+			return newRetryError(action, errs)
+		}
+		delay := withJitter(backoff)
+		log.Printf("Attempt %d/%d to %s failed, retrying in %s: %s", attempt, opts.MaxRetries+1, action, delay.Round(time.Millisecond), err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrap(ctx.Err(), newRetryError(action, errs).Error())
+		}
+		backoff *= 2
+		if opts.MaxBackoff > 0 && backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+// withJitter returns a random duration between half and the full given duration
+func withJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// isRetryable returns true if the given error is a transient download failure
+func isRetryable(err error) bool {
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false
+	}
+	if m := httpStatusErrorRegex.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return status >= 500 || status == 429
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// TLS certificate errors are permanent
+		return !strings.Contains(urlErr.Err.Error(), "certificate")
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryError reports every failed attempt of a download
+type retryError struct {
+	action string
+	errs   []error
+}
+
+func newRetryError(action string, errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return &retryError{action, errs}
+}
+
+func (e *retryError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = fmt.Sprintf("attempt %d: %s", i+1, err)
+	}
+	return fmt.Sprintf("%s failed after %d attempts:\n * %s", e.action, len(e.errs), strings.Join(msgs, "\n * "))
+}
+
+// Cause returns the last attempt's error
+func (e *retryError) Cause() error {
+	return e.errs[len(e.errs)-1]
+}
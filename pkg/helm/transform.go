@@ -3,6 +3,8 @@ package helm
 import (
 	"fmt"
 	"io"
+	"log"
+	"sort"
 	"strings"
 
 	"github.com/mgoltzsche/khelm/internal/matcher"
@@ -12,14 +14,48 @@ import (
 )
 
 const (
-	annotationManagedBy = "app.kubernetes.io/managed-by"
+	labelManagedBy = "app.kubernetes.io/managed-by"
+	labelHeritage  = "heritage"
+	labelHelmChart = "helm.sh/chart"
 )
 
+// helmMetadataAnnotations are removed from all resources when Helm metadata is stripped
+var helmMetadataAnnotations = []string{labelHelmChart, "meta.helm.sh/release-name", "meta.helm.sh/release-namespace"}
+
+// podTemplateMetadataPaths maps the built-in workload kinds to the metadata paths of their templates
+var podTemplateMetadataPaths = map[string][][]string{
+	"Deployment":            {{"spec", "template", "metadata"}},
+	"StatefulSet":           {{"spec", "template", "metadata"}},
+	"DaemonSet":             {{"spec", "template", "metadata"}},
+	"ReplicaSet":            {{"spec", "template", "metadata"}},
+	"ReplicationController": {{"spec", "template", "metadata"}},
+	"Job":                   {{"spec", "template", "metadata"}},
+	"CronJob":               {{"spec", "jobTemplate", "metadata"}, {"spec", "jobTemplate", "spec", "template", "metadata"}},
+}
+
+// labelSelectorPaths maps the built-in kinds to the paths of their label selectors
+var labelSelectorPaths = map[string][][]string{
+	"Service":               {{"spec", "selector"}},
+	"ReplicationController": {{"spec", "selector"}},
+	"Deployment":            {{"spec", "selector", "matchLabels"}},
+	"StatefulSet":           {{"spec", "selector", "matchLabels"}},
+	"DaemonSet":             {{"spec", "selector", "matchLabels"}},
+	"ReplicaSet":            {{"spec", "selector", "matchLabels"}},
+	"Job":                   {{"spec", "selector", "matchLabels"}},
+	"CronJob":               {{"spec", "jobTemplate", "spec", "selector", "matchLabels"}},
+	"PodDisruptionBudget":   {{"spec", "selector", "matchLabels"}},
+	"NetworkPolicy":         {{"spec", "podSelector", "matchLabels"}},
+}
+
 type manifestTransformer struct {
-	ForceNamespace string
-	Includes       matcher.ResourceMatchers
-	Excludes       matcher.ResourceMatchers
-	NamespacedOnly bool
+	ForceNamespace           string
+	Includes                 matcher.ResourceMatchers
+	Excludes                 matcher.ResourceMatchers
+	NamespacedOnly           bool
+	CommonLabels             map[string]string
+	CommonLabelSelectors     bool
+	CommonLabelsPodTemplates bool
+	CommonAnnotations        map[string]string
 }
 
 func (t *manifestTransformer) TransformManifest(manifest io.Reader) (r []*yaml.RNode, err error) {
@@ -90,6 +126,12 @@ func (t *manifestTransformer) addResources(o *yaml.RNode, r *[]*yaml.RNode, clus
 	if err != nil {
 		return err
 	}
+
+	// Add common labels and annotations
+	err = t.applyCommonMetadata(o, &meta)
+	if err != nil {
+		return errors.Wrapf(err, "add common labels and annotations to %s %s", meta.Kind, meta.Name)
+	}
 	*r = append(*r, o)
 	return nil
 }
@@ -133,3 +175,242 @@ func (t *manifestTransformer) applyNamespace(o *yaml.RNode, clusterScopedResourc
 	}
 	return nil
 }
+
+// applyCommonMetadata adds the common labels and annotations to the resource and the pod templates it contains.
+// The labels are only added to the pod templates when enabled or when the selectors are extended
+// since changing them makes the workloads roll out their pods.
+// Label selectors that already exist are only extended when enabled since they are immutable for most kinds.
+// Selectors' matchExpressions are left unchanged.
+func (t *manifestTransformer) applyCommonMetadata(o *yaml.RNode, meta *yaml.ResourceMeta) error {
+	if len(t.CommonLabels) == 0 && len(t.CommonAnnotations) == 0 {
+		return nil
+	}
+	metadataPaths := append([][]string{{yaml.MetadataField}}, podTemplateMetadataPaths[meta.Kind]...)
+	for _, path := range metadataPaths {
+		if len(path) > 1 {
+			parent, err := o.Pipe(yaml.Lookup(path[:len(path)-2]...))
+			if err != nil {
+				return err
+			}
+			if parent == nil || parent.Field(path[len(path)-2]) == nil {
+				continue // template is not specified
+			}
+		}
+		if len(path) == 1 || t.CommonLabelsPodTemplates || t.CommonLabelSelectors {
+			if err := setStringFields(o, t.CommonLabels, append(path, yaml.LabelsField)...); err != nil {
+				return err
+			}
+		}
+		if err := setStringFields(o, t.CommonAnnotations, append(path, yaml.AnnotationsField)...); err != nil {
+			return err
+		}
+	}
+	if t.CommonLabelSelectors {
+		for _, path := range labelSelectorPaths[meta.Kind] {
+			selectorPath := path
+			if path[len(path)-1] == "matchLabels" {
+				selectorPath = path[:len(path)-1]
+			}
+			selector, err := o.Pipe(yaml.Lookup(selectorPath...))
+			if err != nil {
+				return err
+			}
+			if yaml.IsMissingOrNull(selector) {
+				continue // selector is not specified (or generated)
+			}
+			if err = setStringFields(o, t.CommonLabels, path...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setStringFields sets the given fields within the mapping at the given path, creating it if it doesn't exist
+func setStringFields(o *yaml.RNode, fields map[string]string, path ...string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	// Remove the field if empty since LookupCreate() doesn't create the MappingNode if it exists but is empty (#13).
+	parentPath := path[:len(path)-1]
+	err := o.PipeE(yaml.LookupCreate(yaml.MappingNode, parentPath...), yaml.FieldClearer{Name: path[len(path)-1], IfEmpty: true})
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	m, err := o.Pipe(yaml.LookupCreate(yaml.MappingNode, path...))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = m.PipeE(yaml.SetField(k, yaml.NewStringRNode(fields[k]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripHelmMetadata removes the labels and annotations that claim a resource to be managed by Helm
+// from the resources and their pod templates or sets the managed-by label to the given value.
+// Since label selectors are immutable for most kinds they are not modified
+// and the labels they use are kept within pod (template) metadata and on the resource that owns the selector.
+func stripHelmMetadata(resources []*yaml.RNode, managedBy string) error {
+	selected := map[string]bool{}
+	ownSelected := make([]map[string]bool, len(resources))
+	for i, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return err
+		}
+		if ownSelected[i], err = selectorLabels(o, meta.Kind); err != nil {
+			return errors.Wrapf(err, "%s %s", meta.Kind, meta.Name)
+		}
+		for l := range ownSelected[i] {
+			selected[l] = true
+		}
+	}
+	kept := map[string]struct{}{}
+	for i, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return err
+		}
+		protected := ownSelected[i]
+		if meta.Kind == "Pod" {
+			protected = selected
+		}
+		metadataPaths := append([][]string{{yaml.MetadataField}}, podTemplateMetadataPaths[meta.Kind]...)
+		for j, path := range metadataPaths {
+			metadata, err := o.Pipe(yaml.Lookup(path...))
+			if err != nil {
+				return errors.Wrapf(err, "%s %s", meta.Kind, meta.Name)
+			}
+			if metadata == nil {
+				continue
+			}
+			if j > 0 {
+				protected = selected
+			}
+			err = stripHelmLabels(metadata, managedBy, protected, kept)
+			if err != nil {
+				return errors.Wrapf(err, "%s %s", meta.Kind, meta.Name)
+			}
+			for _, a := range helmMetadataAnnotations {
+				if err = metadata.PipeE(yaml.Lookup(yaml.AnnotationsField), yaml.FieldClearer{Name: a}); err != nil {
+					return errors.Wrapf(err, "%s %s", meta.Kind, meta.Name)
+				}
+			}
+			if err = metadata.PipeE(yaml.FieldClearer{Name: yaml.AnnotationsField, IfEmpty: true}); err != nil {
+				return errors.Wrapf(err, "%s %s", meta.Kind, meta.Name)
+			}
+		}
+	}
+	if len(kept) > 0 {
+		labels := make([]string, 0, len(kept))
+		for l := range kept {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		log.Printf("WARNING: Kept the Helm labels %s since they are used by label selectors", strings.Join(labels, ", "))
+	}
+	return nil
+}
+
+// selectorLabels returns the key=value pairs the resource's label selectors match.
+// The matchExpressions contribute the key=value pairs of an In operator
+// and the plain key for any other operator since they depend on the label's presence.
+func selectorLabels(o *yaml.RNode, kind string) (map[string]bool, error) {
+	selected := map[string]bool{}
+	for _, path := range labelSelectorPaths[kind] {
+		selector, err := o.Pipe(yaml.Lookup(path...))
+		if err != nil {
+			return nil, err
+		}
+		if selector != nil && selector.YNode().Kind == yaml.MappingNode {
+			c := selector.YNode().Content
+			for i := 0; i+1 < len(c); i += 2 {
+				selected[c[i].Value+"="+c[i+1].Value] = true
+			}
+		}
+		if path[len(path)-1] != "matchLabels" {
+			continue
+		}
+		exprPath := append(append([]string{}, path[:len(path)-1]...), "matchExpressions")
+		if err = addMatchExpressionLabels(o, exprPath, selected); err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
+
+func addMatchExpressionLabels(o *yaml.RNode, path []string, selected map[string]bool) error {
+	exprs, err := o.Pipe(yaml.Lookup(path...))
+	if err != nil || exprs == nil {
+		return err
+	}
+	elements, err := exprs.Elements()
+	if err != nil {
+		return errors.Wrap(err, "matchExpressions")
+	}
+	for _, expr := range elements {
+		key, err := expr.Pipe(yaml.Lookup("key"))
+		if err != nil || key == nil {
+			return err
+		}
+		operator, err := expr.Pipe(yaml.Lookup("operator"))
+		if err != nil {
+			return err
+		}
+		if operator == nil || yaml.GetValue(operator) != "In" {
+			selected[yaml.GetValue(key)] = true
+			continue
+		}
+		values, err := expr.Pipe(yaml.Lookup("values"))
+		if err != nil || values == nil {
+			return err
+		}
+		for _, v := range values.YNode().Content {
+			selected[yaml.GetValue(key)+"="+v.Value] = true
+		}
+	}
+	return nil
+}
+
+func stripHelmLabels(metadata *yaml.RNode, managedBy string, selected map[string]bool, kept map[string]struct{}) error {
+	labels, err := metadata.Pipe(yaml.Lookup(yaml.LabelsField))
+	if err != nil || labels == nil || labels.YNode().Kind != yaml.MappingNode {
+		return err
+	}
+	c := labels.YNode().Content
+	retained := make([]*yaml.Node, 0, len(c))
+	for i := 0; i+1 < len(c); i += 2 {
+		k, v := c[i].Value, c[i+1].Value
+		if isHelmLabel(k, v) {
+			if selected[k+"="+v] || selected[k] {
+				kept[k+"="+v] = struct{}{}
+			} else if k == labelManagedBy && managedBy != "" {
+				c[i+1] = yaml.NewStringRNode(managedBy).YNode()
+			} else {
+				continue
+			}
+		}
+		retained = append(retained, c[i], c[i+1])
+	}
+	labels.YNode().Content = retained
+	return metadata.PipeE(yaml.FieldClearer{Name: yaml.LabelsField, IfEmpty: true})
+}
+
+// isHelmLabel returns true if the given label refers to Helm
+func isHelmLabel(key, value string) bool {
+	switch key {
+	case labelHelmChart:
+		return true
+	case labelHeritage, labelManagedBy:
+		return value == "Tiller" || value == "Helm"
+	}
+	return false
+}
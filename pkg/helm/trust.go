@@ -0,0 +1,163 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/pkg/config"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const trustPolicyKind = "TrustPolicy"
+
+// scpGitURLRegex matches scp-like git URLs such as git@github.com:org/repo.git
+var scpGitURLRegex = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.*)$`)
+
+// TrustPolicy specifies the repositories (including OCI registries, git repositories and remote value files) that may be used.
+// A URL that matches a deny rule is never used, not even when it is registered within repositories.yaml.
+// A URL that matches an allow rule is trusted without being registered within repositories.yaml.
+// When allow rules are specified other URLs are only trusted when they are registered
+// (or usage of untrusted repositories is enabled explicitly).
+type TrustPolicy struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Allow      []TrustRule `yaml:"allow,omitempty"`
+	Deny       []TrustRule `yaml:"deny,omitempty"`
+	file       string
+}
+
+// TrustRule matches URLs. A rule matches when all of its specified fields match.
+type TrustRule struct {
+	// Scheme matches the URL scheme, e.g. https (the git+ prefix of git URLs is ignored)
+	Scheme string `yaml:"scheme,omitempty"`
+	// Host is a glob pattern that matches the URL's host name, e.g. *.example.org
+	Host string `yaml:"host,omitempty"`
+	// URLPrefix matches the URL itself and all URLs that start with it followed by a slash
+	URLPrefix string `yaml:"urlPrefix,omitempty"`
+}
+
+// LoadTrustPolicy loads the trust policy from the given file
+func LoadTrustPolicy(file string) (*TrustPolicy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "read trust policy")
+	}
+	p := &TrustPolicy{file: file}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(p); err != nil {
+		return nil, errors.Wrapf(err, "read trust policy %s", file)
+	}
+	if p.APIVersion != config.GeneratorAPIVersion || p.Kind != trustPolicyKind {
+		return nil, errors.Errorf("read trust policy %s: expected apiVersion %s and kind %s but was %s %s", file, config.GeneratorAPIVersion, trustPolicyKind, p.APIVersion, p.Kind)
+	}
+	for _, rules := range []struct {
+		name  string
+		rules []TrustRule
+	}{{"allow", p.Allow}, {"deny", p.Deny}} {
+		for i, r := range rules.rules {
+			if r.Scheme == "" && r.Host == "" && r.URLPrefix == "" {
+				return nil, errors.Errorf("read trust policy %s: %s[%d] does not specify any of scheme, host or urlPrefix", file, rules.name, i)
+			}
+			if _, err = path.Match(r.Host, ""); err != nil {
+				return nil, errors.Wrapf(err, "read trust policy %s: %s[%d].host", file, rules.name, i)
+			}
+		}
+	}
+	return p, nil
+}
+
+// check returns an untrusted repository error when the given URL is denied by the policy
+// and whether it is allowed explicitly.
+func (p *TrustPolicy) check(u string) (allowed bool, err error) {
+	if p == nil {
+		return false, nil
+	}
+	parsed, err := parseTrustPolicyURL(u)
+	if err != nil {
+		return false, &untrustedRepoError{errors.Wrapf(err, "trust policy %s", p.file)}
+	}
+	for _, r := range p.Deny {
+		if r.matches(u, parsed) {
+			err = errors.Errorf("usage of %q is denied by trust policy %s (rule %s)", u, p.file, r)
+			return false, &untrustedRepoError{err}
+		}
+	}
+	for _, r := range p.Allow {
+		if r.matches(u, parsed) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkValueFile returns an untrusted repository error when the given remote value file URL must not be used.
+// Since value files are not registered within repositories.yaml they need to match an allow rule when the policy specifies any.
+func (p *TrustPolicy) checkValueFile(u string, trustAnyRepo *bool) error {
+	allowed, err := p.check(u)
+	if err != nil || allowed || p == nil || len(p.Allow) == 0 || trustAnyRepo != nil && *trustAnyRepo {
+		return err
+	}
+	err = errors.Errorf("value file %q does not match any allow rule of trust policy %s", u, p.file)
+	return &untrustedRepoError{err}
+}
+
+// restrictsUnknownRepositories returns true if the policy allows only specific repositories
+func (p *TrustPolicy) restrictsUnknownRepositories() bool {
+	return p != nil && len(p.Allow) > 0
+}
+
+func (r TrustRule) matches(rawURL string, u *url.URL) bool {
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, u.Scheme) {
+		return false
+	}
+	if r.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(u.Hostname())); !ok {
+			return false
+		}
+	}
+	if r.URLPrefix != "" {
+		prefix := strings.TrimSuffix(r.URLPrefix, "/")
+		matchesPrefix := func(s string) bool {
+			return s == prefix || strings.HasPrefix(s, prefix+"/")
+		}
+		if !matchesPrefix(rawURL) && !matchesPrefix(strings.TrimPrefix(rawURL, gitSchemePrefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r TrustRule) String() string {
+	fields := make([]string, 0, 3)
+	if r.Scheme != "" {
+		fields = append(fields, fmt.Sprintf("scheme=%s", r.Scheme))
+	}
+	if r.Host != "" {
+		fields = append(fields, fmt.Sprintf("host=%s", r.Host))
+	}
+	if r.URLPrefix != "" {
+		fields = append(fields, fmt.Sprintf("urlPrefix=%s", r.URLPrefix))
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseTrustPolicyURL parses the given repository URL.
+// The git+ prefix of git URLs is removed and scp-like git URLs are mapped to the ssh scheme.
+func parseTrustPolicyURL(u string) (*url.URL, error) {
+	u = strings.TrimPrefix(u, gitSchemePrefix)
+	parsed, err := url.Parse(u)
+	if err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		return parsed, nil
+	}
+	if m := scpGitURLRegex.FindStringSubmatch(u); m != nil {
+		return &url.URL{Scheme: "ssh", Host: m[1], Path: m[2]}, nil
+	}
+	return nil, errors.Errorf("cannot evaluate URL %q since it does not specify a scheme and host", u)
+}
@@ -8,18 +8,20 @@ import (
 	"strings"
 
 	"github.com/ghodss/yaml"
+	"github.com/mgoltzsche/khelm/pkg/config"
 	"github.com/pkg/errors"
 	"k8s.io/helm/pkg/getter"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 )
 
 // vals merges values from files specified via -f/--values and
-// directly via --set or --set-string or --set-file, marshaling them to YAML
-func vals(chrt *chart.Chart, valueFiles []string, values map[string]interface{}, baseDir string, getters getter.Providers, certFile, keyFile, caFile string) (b []byte, err error) {
+// directly via --set or --set-string or --set-file, marshaling them to YAML.
+// Remote files are fetched using the given getters which apply the repository's TLS settings.
+func vals(chrt *chart.Chart, valueFiles []string, values map[string]interface{}, baseDir string, getters getter.Providers) (b []byte, err error) {
 	base := map[string]interface{}{}
 	for _, filePath := range valueFiles {
 		currentMap := map[string]interface{}{}
-		if b, err = readValuesFile(chrt, filePath, baseDir, getters, certFile, keyFile, caFile); err != nil {
+		if b, err = readValuesFile(chrt, filePath, baseDir, getters); err != nil {
 			return
 		}
 		if err = yaml.Unmarshal(b, &currentMap); err != nil {
@@ -31,8 +33,31 @@ func vals(chrt *chart.Chart, valueFiles []string, values map[string]interface{},
 	return yaml.Marshal(base)
 }
 
+// checkValueFiles verifies that the remote value files are permitted by the trust policy.
+// Since remote value files are not cached they are rejected in offline mode.
+func (h *Helm) checkValueFiles(req *config.ChartConfig) error {
+	for _, filePath := range req.ValueFiles {
+		if !isRemoteValueFile(filePath) {
+			continue
+		}
+		if req.Offline {
+			return errors.Errorf("offline mode: remote values file %s is not supported since it cannot be cached (use a local file instead)", filePath)
+		}
+		if err := h.TrustPolicy.checkValueFile(filePath, h.TrustAnyRepository); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRemoteValueFile returns true if the given values file location is a URL that is not a file URL
+func isRemoteValueFile(filePath string) bool {
+	u, err := url.Parse(filePath)
+	return err == nil && u.Scheme != "" && strings.ToLower(u.Scheme) != "file"
+}
+
 // readValuesFile load a file from the local directory or a remote file with a url.
-func readValuesFile(chrt *chart.Chart, filePath, baseDir string, getters getter.Providers, CertFile, KeyFile, CAFile string) (b []byte, err error) {
+func readValuesFile(chrt *chart.Chart, filePath, baseDir string, getters getter.Providers) (b []byte, err error) {
 	u, err := url.Parse(filePath)
 	if u.Scheme == "" || strings.ToLower(u.Scheme) == "file" {
 		// Load from local file, fallback to chart file
@@ -56,7 +81,7 @@ func readValuesFile(chrt *chart.Chart, filePath, baseDir string, getters getter.
 	if err != nil {
 		return
 	}
-	getter, err := getterConstructor(filePath, CertFile, KeyFile, CAFile)
+	getter, err := getterConstructor(filePath, "", "", "")
 	if err != nil {
 		return
 	}